@@ -0,0 +1,196 @@
+package v1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// OperatorConfig is cluster-scoped and tunes a running operator without restarting it.
+// Each operator watches the one named by its `operatorConfigName` ("default" unless configured otherwise).
+type OperatorConfig struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitzero"`
+
+	Spec   OperatorConfigSpec   `json:"spec,omitzero"`
+	Status OperatorConfigStatus `json:"status,omitzero"`
+}
+
+type OperatorConfigSpec struct {
+	// Class used by ServiceDeployments without `spec.className`, instead of the one annotated as default
+	DefaultClassName string `json:"defaultClassName,omitempty"`
+	// Stop reconciling: nothing is created, updated or deleted until unpaused
+	Paused bool `json:"paused,omitempty"`
+	// What happens to a child changed by someone else. Defaults to Correct.
+	DriftPolicy DriftPolicy `json:"driftPolicy,omitempty"`
+	// ServiceDeployments reconciled in parallel, up to the operator's own `maxConcurrentReconciles`. 0: that maximum.
+	MaxConcurrentReconciles int `json:"maxConcurrentReconciles,omitempty"`
+	// Which Events are recorded. Defaults to All.
+	EventVerbosity EventVerbosity `json:"eventVerbosity,omitempty"`
+	// Notification sinks of every namespace, in addition to the namespace's own
+	NotificationSinks []NotificationSink `json:"notificationSinks,omitempty"`
+	// URL prefixes the sinks of NotificationsAnnotation may POST to in every namespace, in addition to the
+	// `allowedAnnotationURLs` of the namespace's notifications ConfigMap. Annotation sinks are dropped without either.
+	AllowedNotificationURLs []string `json:"allowedNotificationURLs,omitempty"`
+	// Features turned on or off, by name
+	FeatureGates map[string]bool `json:"featureGates,omitempty"`
+	// Kinds ServiceDeployments may list in `spec.extraResources`, instead of the operator's own `allowedExtraResources`.
+	// An empty version allows every version of the kind. The operator also needs RBAC permissions for each.
+	AllowedExtraResources []metav1.GroupVersionKind `json:"allowedExtraResources,omitempty"`
+}
+
+type DriftPolicy string
+
+const (
+	// Overwrite the change with the rendered child
+	DriftPolicyCorrect DriftPolicy = "Correct"
+	// Leave the child alone and record a Warning Event
+	DriftPolicyReport DriftPolicy = "Report"
+)
+
+type EventVerbosity string
+
+const (
+	EventVerbosityAll      EventVerbosity = "All"
+	EventVerbosityWarnings EventVerbosity = "Warnings"
+	EventVerbosityNone     EventVerbosity = "None"
+)
+
+// NotificationSink is a notification sink, in the format of the namespaces' notifications ConfigMaps.
+type NotificationSink struct {
+	Name string `json:"name"`
+	// Kind of sink. Defaults to webhook.
+	Type string `json:"type,omitempty"`
+	// URL the notifications are POSTed to
+	URL string `json:"url"`
+	// Lifecycle events sent to this sink. Defaults to all of them.
+	Events []string `json:"events,omitempty"`
+	// Go template of the request body. Defaults to the notification as JSON.
+	Body string `json:"body,omitempty"`
+	// Extra request headers
+	Headers map[string]string `json:"headers,omitempty"`
+	// Key in a Secret the body is signed with, read from the namespace of the ServiceDeployment.
+	// The Secret must carry the NotificationSigningKeyLabel.
+	SigningSecret *corev1.SecretKeySelector `json:"signingSecret,omitempty"`
+	// Retries after a failed attempt. Defaults to 3.
+	Retries *int `json:"retries,omitempty"`
+}
+
+type OperatorConfigStatus struct {
+	// Generation of the spec the conditions are about
+	ObservedGeneration int64              `json:"observedGeneration,omitempty"`
+	Conditions         []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// Condition types set on OperatorConfigStatus
+const (
+	// The spec is valid and in effect. False while it is invalid: the operator keeps the last valid one.
+	ConditionValid string = "Valid"
+)
+
+type OperatorConfigList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitzero"`
+
+	Items []OperatorConfig `json:"items"`
+}
+
+// DeepCopyInto
+func (in *OperatorConfig) DeepCopyInto(out *OperatorConfig) {
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+func (in *OperatorConfigSpec) DeepCopyInto(out *OperatorConfigSpec) {
+	*out = *in
+	if in.NotificationSinks != nil {
+		out.NotificationSinks = make([]NotificationSink, len(in.NotificationSinks))
+		for i := range in.NotificationSinks {
+			in.NotificationSinks[i].DeepCopyInto(&out.NotificationSinks[i])
+		}
+	}
+	if in.AllowedNotificationURLs != nil {
+		out.AllowedNotificationURLs = make([]string, len(in.AllowedNotificationURLs))
+		copy(out.AllowedNotificationURLs, in.AllowedNotificationURLs)
+	}
+	if in.FeatureGates != nil {
+		out.FeatureGates = make(map[string]bool, len(in.FeatureGates))
+		for k, v := range in.FeatureGates {
+			out.FeatureGates[k] = v
+		}
+	}
+	if in.AllowedExtraResources != nil {
+		out.AllowedExtraResources = make([]metav1.GroupVersionKind, len(in.AllowedExtraResources))
+		copy(out.AllowedExtraResources, in.AllowedExtraResources)
+	}
+}
+
+func (in *NotificationSink) DeepCopyInto(out *NotificationSink) {
+	*out = *in
+	if in.Events != nil {
+		out.Events = make([]string, len(in.Events))
+		copy(out.Events, in.Events)
+	}
+	out.Headers = copyStringMap(in.Headers)
+	if in.SigningSecret != nil {
+		out.SigningSecret = in.SigningSecret.DeepCopy()
+	}
+	if in.Retries != nil {
+		retries := *in.Retries
+		out.Retries = &retries
+	}
+}
+
+func (in *OperatorConfigStatus) DeepCopyInto(out *OperatorConfigStatus) {
+	*out = *in
+	if in.Conditions != nil {
+		out.Conditions = make([]metav1.Condition, len(in.Conditions))
+		for i := range in.Conditions {
+			in.Conditions[i].DeepCopyInto(&out.Conditions[i])
+		}
+	}
+}
+
+// DeepCopy returns a pointer to a new OperatorConfigStatus by copying the receiver.
+func (in *OperatorConfigStatus) DeepCopy() *OperatorConfigStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(OperatorConfigStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopy returns a pointer to a new OperatorConfig by copying the receiver.
+func (in *OperatorConfig) DeepCopy() *OperatorConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(OperatorConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject returns a generically typed copy of the receiver, creating a new runtime.Object.
+func (in *OperatorConfig) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+func (in *OperatorConfigList) DeepCopyObject() runtime.Object {
+	out := new(OperatorConfigList)
+	out.TypeMeta = in.TypeMeta
+	out.ListMeta = in.ListMeta
+
+	if in.Items != nil {
+		out.Items = make([]OperatorConfig, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+	return out
+}
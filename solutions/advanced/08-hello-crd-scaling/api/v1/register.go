@@ -23,7 +23,12 @@ var (
 // these types are embedded in our controller package so it is aware of our new schema
 func addKnownTypes(scheme *runtime.Scheme) error {
 	// Only can add objects that implement interface `runtime.Object`.
-	scheme.AddKnownTypes(SchemeGroupVersion, &ServiceDeployment{}, &ServiceDeploymentList{})
+	scheme.AddKnownTypes(SchemeGroupVersion,
+		&ServiceDeployment{}, &ServiceDeploymentList{},
+		&ServiceDeploymentClass{}, &ServiceDeploymentClassList{},
+		&ServiceDeploymentSet{}, &ServiceDeploymentSetList{},
+		&OperatorConfig{}, &OperatorConfigList{},
+	)
 
 	metav1.AddToGroupVersion(scheme, SchemeGroupVersion)
 	return nil
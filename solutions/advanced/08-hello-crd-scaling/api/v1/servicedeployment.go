@@ -6,6 +6,7 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 type ServiceDeploymentStatus struct {
@@ -21,6 +22,88 @@ type ServiceDeploymentStatus struct {
 	Ports       string `json:"ports,omitempty"` // e.g. "80/TCP,443/TCP"
 
 	Selector string `json:"selector,omitempty"` // for scale subresource
+
+	// Per-cluster readiness when `spec.placement` is used
+	Clusters []ClusterStatus `json:"clusters,omitempty"`
+
+	// `controllerName` of the operator that last reconciled this ServiceDeployment
+	ControllerName string `json:"controllerName,omitempty"`
+
+	// With a sharded operator: the shard of this ServiceDeployment (e.g. "2/4") and the operator replica owning it
+	Shard      string `json:"shard,omitempty"`
+	ShardOwner string `json:"shardOwner,omitempty"`
+
+	// Hash of the rendered pod template, and of the one before it: rolling out to the previous one again is a rollback
+	TemplateHash         string `json:"templateHash,omitempty"`
+	PreviousTemplateHash string `json:"previousTemplateHash,omitempty"`
+
+	// One per `spec.extraResources` entry, plus those removed from it that couldn't be deleted yet
+	ExtraResources []ExtraResourceStatus `json:"extraResources,omitempty"`
+
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// Annotation with notification sinks of this ServiceDeployment only, in the format of the namespace's notifications ConfigMap.
+// Only URLs allowed by the ConfigMap or the OperatorConfig are used, and without a signingSecret.
+const NotificationsAnnotation string = "servicedeployment.k8s.example.com/notifications"
+
+// Label, set to "true", on the Secrets notification sinks may read their signing key from
+const NotificationSigningKeyLabel string = "servicedeployment.k8s.example.com/notification-signing-key"
+
+// Annotation on the children with a hash of their rendered state, to tell whether they need an update
+const SpecHashAnnotation string = "servicedeployment.k8s.example.com/spec-hash"
+
+// Annotation on the children with the keys of the labels and annotations the operator set, to remove those it no longer sets
+const ManagedMetadataAnnotation string = "servicedeployment.k8s.example.com/managed-metadata"
+
+// Label pinning a ServiceDeployment to a shard of a sharded operator, e.g. "2". Without it the shard is derived from the namespace.
+const ShardLabel string = "servicedeployment.k8s.example.com/shard"
+
+// Condition types set on ServiceDeploymentStatus
+const (
+	// All desired replicas are available
+	ConditionAvailable string = "Available"
+	// The Deployment is held at zero replicas until every `spec.dependsOn` entry is Available
+	ConditionWaitingForDependencies string = "WaitingForDependencies"
+	// The last reconcile failed with an error that retrying can't fix, e.g. the rendered children were rejected as invalid
+	ConditionDegraded string = "Degraded"
+	// An operator serving `spec.controllerName` handles the ServiceDeployment. False while none claimed it.
+	ConditionClaimed string = "Claimed"
+)
+
+type ExtraResourceStatus struct {
+	// Identify the resource, as far as the manifest could be read
+	APIVersion string `json:"apiVersion,omitempty"`
+	Kind       string `json:"kind,omitempty"`
+	Name       string `json:"name,omitempty"`
+
+	State   ExtraResourceState `json:"state"`
+	Message string             `json:"message,omitempty"`
+}
+
+type ExtraResourceState string
+
+const (
+	// The resource matches its manifest
+	ExtraResourceApplied ExtraResourceState = "Applied"
+	// The resource was changed outside the operator and left alone (`driftPolicy: Report`)
+	ExtraResourceDrifted ExtraResourceState = "Drifted"
+	// The kind isn't in the `allowedExtraResources` of the OperatorConfig
+	ExtraResourceNotAllowed ExtraResourceState = "NotAllowed"
+	// The manifest can't be applied as it is, e.g. it has no name or its kind is cluster-scoped
+	ExtraResourceInvalid ExtraResourceState = "Invalid"
+	// Applying (or deleting) the resource failed; retried
+	ExtraResourceFailed ExtraResourceState = "Failed"
+)
+
+type ClusterStatus struct {
+	// The target as it was last placed, so the children can still be removed once it is dropped from the spec
+	PlacementCluster `json:",inline"`
+
+	ReadyReplicas     int32  `json:"readyReplicas,omitempty"`
+	AvailableReplicas int32  `json:"availableReplicas,omitempty"`
+	Ready             string `json:"ready,omitempty"`   // e.g. "3/3"
+	Message           string `json:"message,omitempty"` // last error talking to the cluster, if any
 }
 
 type ServiceDeploymentList struct {
@@ -39,38 +122,171 @@ type ServiceDeployment struct {
 }
 
 type ServiceDeploymentSpec struct {
+	// Name of the cluster-scoped ServiceDeploymentClass to take defaults from.
+	// If empty, the class annotated as default (if any) is used.
+	ClassName  string                       `json:"className,omitempty"`
 	Replicas   int32                        `json:"replicas"`
 	Containers []corev1.Container           `json:"containers"`
 	Service    ServiceDeploymentSpecService `json:"service"`
+	// Target clusters to render the children in, instead of the cluster the ServiceDeployment lives in
+	Placement *ServiceDeploymentPlacement `json:"placement,omitempty"`
+	// ServiceDeployments that must be Available before this one is scaled up
+	DependsOn []ServiceDeploymentDependency `json:"dependsOn,omitempty"`
+	// Shorthand for readiness, liveness and startup probes on the container serving the Service port
+	Probes *ServiceDeploymentProbes `json:"probes,omitempty"`
+	// Operator instance that handles this ServiceDeployment, like `ingressClassName`.
+	// If empty, the default operator handles it.
+	ControllerName string `json:"controllerName,omitempty"`
+	// Manifests of namespaced objects applied along with the children (e.g. a ConfigMap), owned by the ServiceDeployment.
+	// Only kinds allowed by the OperatorConfig (`allowedExtraResources`) are applied.
+	ExtraResources []runtime.RawExtension `json:"extraResources,omitempty"`
+}
+
+type ServiceDeploymentProbes struct {
+	// Probe with an HTTP GET on this path. Mutually exclusive with TCP.
+	HTTPPath string `json:"httpPath,omitempty"`
+	// Probe by opening a TCP connection
+	TCP bool `json:"tcp,omitempty"`
+	// Service port (by name or port number) whose targetPort is probed. Defaults to the first Service port.
+	Port intstr.IntOrString `json:"port,omitzero"`
+}
+
+type ServiceDeploymentDependency struct {
+	Name string `json:"name"`
+	// Defaults to the namespace of the depending ServiceDeployment
+	Namespace string `json:"namespace,omitempty"`
+}
+
+type ServiceDeploymentPlacement struct {
+	Clusters []PlacementCluster `json:"clusters"`
+}
+
+type PlacementCluster struct {
+	// Unique name of the target cluster, used in status
+	Name string `json:"name"`
+	// Secret in the ServiceDeployment's namespace holding a kubeconfig for the target cluster
+	SecretName string `json:"secretName"`
+	// Key of the kubeconfig in the Secret. Defaults to "kubeconfig".
+	Key string `json:"key,omitempty"`
 }
 
 type ServiceDeploymentSpecService struct {
 	Name  string               `json:"name,omitzero"`
 	Type  corev1.ServiceType   `json:"type"`
 	Ports []corev1.ServicePort `json:"ports,omitempty"`
+	// DNS name the Service is an alias (CNAME) of. Required with, and only allowed with, type ExternalName.
+	ExternalName string `json:"externalName,omitempty"`
+	// Render a headless Service (`clusterIP: None`): its DNS name resolves to the pods. ClusterIP Services only.
+	Headless                 bool                                `json:"headless,omitempty"`
+	PublishNotReadyAddresses bool                                `json:"publishNotReadyAddresses,omitempty"`
+	SessionAffinity          corev1.ServiceAffinity              `json:"sessionAffinity,omitempty"`
+	ExternalTrafficPolicy    corev1.ServiceExternalTrafficPolicy `json:"externalTrafficPolicy,omitempty"`
+	InternalTrafficPolicy    corev1.ServiceInternalTrafficPolicy `json:"internalTrafficPolicy,omitempty"`
+	IPFamilyPolicy           corev1.IPFamilyPolicy               `json:"ipFamilyPolicy,omitempty"`
+	LoadBalancerClass        string                              `json:"loadBalancerClass,omitempty"`
+	LoadBalancerSourceRanges []string                            `json:"loadBalancerSourceRanges,omitempty"`
+	// Added to the Service, on top of the class labels and annotations. An annotation removed here is also removed
+	// from the Service (see ManagedMetadataAnnotation); annotations set by others are kept.
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+func (in *ServiceDeploymentSpecService) DeepCopyInto(out *ServiceDeploymentSpecService) {
+	*out = *in
+	if in.Ports != nil {
+		out.Ports = make([]corev1.ServicePort, len(in.Ports))
+		for i := range in.Ports {
+			in.Ports[i].DeepCopyInto(&out.Ports[i])
+		}
+	}
+	if in.LoadBalancerSourceRanges != nil {
+		out.LoadBalancerSourceRanges = make([]string, len(in.LoadBalancerSourceRanges))
+		copy(out.LoadBalancerSourceRanges, in.LoadBalancerSourceRanges)
+	}
+	if in.Labels != nil {
+		out.Labels = make(map[string]string, len(in.Labels))
+		for k, v := range in.Labels {
+			out.Labels[k] = v
+		}
+	}
+	if in.Annotations != nil {
+		out.Annotations = make(map[string]string, len(in.Annotations))
+		for k, v := range in.Annotations {
+			out.Annotations[k] = v
+		}
+	}
 }
 
 // DeepCopyInto
 func (in *ServiceDeployment) DeepCopyInto(out *ServiceDeployment) {
 	out.TypeMeta = in.TypeMeta
-	out.ObjectMeta = in.ObjectMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+func (in *ServiceDeploymentStatus) DeepCopyInto(out *ServiceDeploymentStatus) {
+	*out = *in // shallow copy is fine for value fields
+	if in.Clusters != nil {
+		out.Clusters = make([]ClusterStatus, len(in.Clusters))
+		copy(out.Clusters, in.Clusters)
+	}
+	if in.ExtraResources != nil {
+		out.ExtraResources = make([]ExtraResourceStatus, len(in.ExtraResources))
+		copy(out.ExtraResources, in.ExtraResources)
+	}
+	if in.Conditions != nil {
+		out.Conditions = make([]metav1.Condition, len(in.Conditions))
+		for i := range in.Conditions {
+			in.Conditions[i].DeepCopyInto(&out.Conditions[i])
+		}
+	}
+}
 
-	containersCopy := make([]corev1.Container, len(in.Spec.Containers))
-	copy(containersCopy, in.Spec.Containers)
+// DeepCopy returns a pointer to a new ServiceDeploymentStatus by copying the receiver.
+func (in *ServiceDeploymentStatus) DeepCopy() *ServiceDeploymentStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ServiceDeploymentStatus)
+	in.DeepCopyInto(out)
+	return out
+}
 
-	portsCopy := make([]corev1.ServicePort, len(in.Spec.Service.Ports))
-	copy(portsCopy, in.Spec.Service.Ports)
+func (in *ServiceDeploymentSpec) DeepCopyInto(out *ServiceDeploymentSpec) {
+	// Containers hold pointers (resources, probes, security context), so copy each one deeply
+	containersCopy := make([]corev1.Container, len(in.Containers))
+	for i := range in.Containers {
+		in.Containers[i].DeepCopyInto(&containersCopy[i])
+	}
 
-	out.Spec = ServiceDeploymentSpec{
-		Replicas:   in.Spec.Replicas,
-		Containers: containersCopy,
-		Service: ServiceDeploymentSpecService{
-			Name:  in.Spec.Service.Name,
-			Type:  in.Spec.Service.Type,
-			Ports: portsCopy,
-		},
+	*out = ServiceDeploymentSpec{
+		ClassName:      in.ClassName,
+		ControllerName: in.ControllerName,
+		Replicas:       in.Replicas,
+		Containers:     containersCopy,
+	}
+	in.Service.DeepCopyInto(&out.Service)
+	if in.Placement != nil {
+		out.Placement = &ServiceDeploymentPlacement{
+			Clusters: make([]PlacementCluster, len(in.Placement.Clusters)),
+		}
+		copy(out.Placement.Clusters, in.Placement.Clusters)
+	}
+	if in.Probes != nil {
+		probes := *in.Probes
+		out.Probes = &probes
+	}
+	if in.DependsOn != nil {
+		out.DependsOn = make([]ServiceDeploymentDependency, len(in.DependsOn))
+		copy(out.DependsOn, in.DependsOn)
+	}
+	if in.ExtraResources != nil {
+		out.ExtraResources = make([]runtime.RawExtension, len(in.ExtraResources))
+		for i := range in.ExtraResources {
+			in.ExtraResources[i].DeepCopyInto(&out.ExtraResources[i])
+		}
 	}
-	out.Status = in.Status // shallow copy is fine for value fields
 }
 
 // DeepCopy returns a pointer to a new ServiceDeploment by copying the receiver.
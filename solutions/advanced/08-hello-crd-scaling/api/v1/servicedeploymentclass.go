@@ -0,0 +1,125 @@
+package v1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// Annotation that marks a ServiceDeploymentClass as the cluster default.
+// ServiceDeployments without `spec.className` use the default class (similar to IngressClass / StorageClass).
+const DefaultClassAnnotation string = "servicedeploymentclass.k8s.example.com/is-default-class"
+
+// ServiceDeploymentClass is cluster-scoped and holds defaults that are merged into every
+// ServiceDeployment referencing it via `spec.className`. Values set on the ServiceDeployment always win.
+type ServiceDeploymentClass struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitzero"`
+
+	Spec ServiceDeploymentClassSpec `json:"spec"`
+}
+
+type ServiceDeploymentClassSpec struct {
+	// Default requests/limits for every container that does not set them
+	Resources corev1.ResourceRequirements `json:"resources,omitzero"`
+	// Pod-level security context, if the pod does not have one
+	PodSecurityContext *corev1.PodSecurityContext `json:"podSecurityContext,omitempty"`
+	// Container-level security context, for every container that does not have one
+	SecurityContext *corev1.SecurityContext `json:"securityContext,omitempty"`
+	// Labels and Annotations added to the child Deployment, its pod template and the child Service
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Tolerations appended to the pod template
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+	// Service type used when `spec.service.type` is not set
+	ServiceType corev1.ServiceType `json:"serviceType,omitempty"`
+	// Sidecar containers appended to the pod (skipped if a container with the same name already exists)
+	Sidecars []corev1.Container `json:"sidecars,omitempty"`
+}
+
+type ServiceDeploymentClassList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitzero"`
+
+	Items []ServiceDeploymentClass `json:"items"`
+}
+
+// IsDefault reports whether the class is annotated as the cluster default.
+func (in *ServiceDeploymentClass) IsDefault() bool {
+	return in.GetAnnotations()[DefaultClassAnnotation] == "true"
+}
+
+// DeepCopyInto
+func (in *ServiceDeploymentClass) DeepCopyInto(out *ServiceDeploymentClass) {
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+func (in *ServiceDeploymentClassSpec) DeepCopyInto(out *ServiceDeploymentClassSpec) {
+	*out = *in
+	in.Resources.DeepCopyInto(&out.Resources)
+	if in.PodSecurityContext != nil {
+		out.PodSecurityContext = in.PodSecurityContext.DeepCopy()
+	}
+	if in.SecurityContext != nil {
+		out.SecurityContext = in.SecurityContext.DeepCopy()
+	}
+	out.Labels = copyStringMap(in.Labels)
+	out.Annotations = copyStringMap(in.Annotations)
+	if in.Tolerations != nil {
+		out.Tolerations = make([]corev1.Toleration, len(in.Tolerations))
+		for i := range in.Tolerations {
+			in.Tolerations[i].DeepCopyInto(&out.Tolerations[i])
+		}
+	}
+	if in.Sidecars != nil {
+		out.Sidecars = make([]corev1.Container, len(in.Sidecars))
+		for i := range in.Sidecars {
+			in.Sidecars[i].DeepCopyInto(&out.Sidecars[i])
+		}
+	}
+}
+
+// DeepCopy returns a pointer to a new ServiceDeploymentClass by copying the receiver.
+func (in *ServiceDeploymentClass) DeepCopy() *ServiceDeploymentClass {
+	if in == nil {
+		return nil
+	}
+	out := new(ServiceDeploymentClass)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject returns a generically typed copy of the receiver, creating a new runtime.Object.
+func (in *ServiceDeploymentClass) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+func (in *ServiceDeploymentClassList) DeepCopyObject() runtime.Object {
+	out := new(ServiceDeploymentClassList)
+	out.TypeMeta = in.TypeMeta
+	out.ListMeta = in.ListMeta
+
+	if in.Items != nil {
+		out.Items = make([]ServiceDeploymentClass, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+	return out
+}
+
+func copyStringMap(in map[string]string) map[string]string {
+	if in == nil {
+		return nil
+	}
+	out := make(map[string]string, len(in))
+	for k, v := range in {
+		out[k] = v
+	}
+	return out
+}
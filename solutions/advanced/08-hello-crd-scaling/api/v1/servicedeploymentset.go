@@ -0,0 +1,125 @@
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// Label set on every ServiceDeployment stamped out by a ServiceDeploymentSet, holding the set's name.
+const SetNameLabel string = "servicedeploymentset.k8s.example.com/name"
+
+// ServiceDeploymentSet is cluster-scoped and stamps out one ServiceDeployment (named after the set)
+// in every namespace matching `spec.namespaceSelector`.
+type ServiceDeploymentSet struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitzero"`
+
+	Spec   ServiceDeploymentSetSpec   `json:"spec"`
+	Status ServiceDeploymentSetStatus `json:"status,omitzero"`
+}
+
+type ServiceDeploymentSetSpec struct {
+	// Namespaces to create a ServiceDeployment in. An empty selector matches every namespace.
+	NamespaceSelector metav1.LabelSelector `json:"namespaceSelector,omitzero"`
+	// Template of the ServiceDeployment created in each namespace
+	Template ServiceDeploymentTemplate `json:"template"`
+	// Per-namespace JSON merge patches applied to `template.spec`
+	Overrides []ServiceDeploymentSetOverride `json:"overrides,omitempty"`
+}
+
+type ServiceDeploymentTemplate struct {
+	// Only labels and annotations are used
+	metav1.ObjectMeta `json:"metadata,omitzero"`
+
+	Spec ServiceDeploymentSpec `json:"spec"`
+}
+
+type ServiceDeploymentSetOverride struct {
+	Namespace string `json:"namespace"`
+	// JSON merge patch (RFC 7386) applied to the template spec, e.g. {"replicas": 5}
+	Patch runtime.RawExtension `json:"patch"`
+}
+
+type ServiceDeploymentSetStatus struct {
+	Namespaces      int32    `json:"namespaces,omitempty"`
+	ReadyNamespaces int32    `json:"readyNamespaces,omitempty"`
+	Ready           string   `json:"ready,omitempty"`    // e.g. "4/5"
+	NotReady        []string `json:"notReady,omitempty"` // namespaces whose ServiceDeployment is not ready yet
+
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// Condition types set on ServiceDeploymentSetStatus
+const (
+	// A matching namespace already has a ServiceDeployment of the set's name that the set doesn't control: it is left alone.
+	ConditionConflict string = "Conflict"
+)
+
+type ServiceDeploymentSetList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitzero"`
+
+	Items []ServiceDeploymentSet `json:"items"`
+}
+
+// DeepCopyInto
+func (in *ServiceDeploymentSet) DeepCopyInto(out *ServiceDeploymentSet) {
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+
+	in.Spec.NamespaceSelector.DeepCopyInto(&out.Spec.NamespaceSelector)
+	in.Spec.Template.ObjectMeta.DeepCopyInto(&out.Spec.Template.ObjectMeta)
+	in.Spec.Template.Spec.DeepCopyInto(&out.Spec.Template.Spec)
+	out.Spec.Overrides = nil
+	if in.Spec.Overrides != nil {
+		out.Spec.Overrides = make([]ServiceDeploymentSetOverride, len(in.Spec.Overrides))
+		for i := range in.Spec.Overrides {
+			out.Spec.Overrides[i].Namespace = in.Spec.Overrides[i].Namespace
+			in.Spec.Overrides[i].Patch.DeepCopyInto(&out.Spec.Overrides[i].Patch)
+		}
+	}
+
+	out.Status = in.Status
+	if in.Status.NotReady != nil {
+		out.Status.NotReady = make([]string, len(in.Status.NotReady))
+		copy(out.Status.NotReady, in.Status.NotReady)
+	}
+	if in.Status.Conditions != nil {
+		out.Status.Conditions = make([]metav1.Condition, len(in.Status.Conditions))
+		for i := range in.Status.Conditions {
+			in.Status.Conditions[i].DeepCopyInto(&out.Status.Conditions[i])
+		}
+	}
+}
+
+// DeepCopy returns a pointer to a new ServiceDeploymentSet by copying the receiver.
+func (in *ServiceDeploymentSet) DeepCopy() *ServiceDeploymentSet {
+	if in == nil {
+		return nil
+	}
+	out := new(ServiceDeploymentSet)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject returns a generically typed copy of the receiver, creating a new runtime.Object.
+func (in *ServiceDeploymentSet) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+func (in *ServiceDeploymentSetList) DeepCopyObject() runtime.Object {
+	out := new(ServiceDeploymentSetList)
+	out.TypeMeta = in.TypeMeta
+	out.ListMeta = in.ListMeta
+
+	if in.Items != nil {
+		out.Items = make([]ServiceDeploymentSet, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+	return out
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Audit log: an append-only stream of every create, update and delete the operator makes, one JSON object per line.
+// Unlike Events it doesn't expire, and unlike the "reconciled" log line it says what changed and why.
+type auditConfig struct {
+	// stdout, file, or empty to disable the audit log
+	Sink string `json:"sink,omitempty"`
+	// File the `file` sink appends to
+	File string `json:"file,omitempty"`
+	// Size in megabytes from which the file is rotated to `<file>.1`. 0 never rotates.
+	MaxSizeMB int `json:"maxSizeMB,omitempty"`
+	// Rotated files kept, `<file>.1` being the most recent. At least 1 when the file is rotated.
+	MaxBackups int `json:"maxBackups,omitempty"`
+}
+
+func (o *auditConfig) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Sink, "audit-sink", o.Sink, "Audit log of every change the operator makes: stdout or file. Empty disables it.")
+	fs.StringVar(&o.File, "audit-file", o.File, "File the `file` audit sink appends to.")
+	fs.IntVar(&o.MaxSizeMB, "audit-max-size-mb", o.MaxSizeMB, "Size in megabytes from which the audit file is rotated. 0 never rotates.")
+	fs.IntVar(&o.MaxBackups, "audit-max-backups", o.MaxBackups, "Rotated audit files kept. At least 1 unless --audit-max-size-mb is 0.")
+}
+
+func (o *auditConfig) validate() error {
+	var errs []error
+	switch o.Sink {
+	case "", "stdout":
+	case "file":
+		if o.File == "" {
+			errs = append(errs, errors.New("  audit.file: must be set with the file sink"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("  audit.sink: %q: must be stdout, file or empty", o.Sink))
+	}
+	if o.MaxSizeMB < 0 {
+		errs = append(errs, fmt.Errorf("  audit.maxSizeMB: must not be negative, got %d", o.MaxSizeMB))
+	}
+	if o.MaxBackups < 0 {
+		errs = append(errs, fmt.Errorf("  audit.maxBackups: must not be negative, got %d", o.MaxBackups))
+	}
+	// Rotating without a backup would delete the log
+	if o.MaxBackups == 0 && o.MaxSizeMB > 0 {
+		errs = append(errs, errors.New("  audit.maxBackups: must be at least 1 when audit.maxSizeMB is set"))
+	}
+	return errors.Join(errs...)
+}
+
+// auditRecord is one line of the audit log.
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	Cluster   string    `json:"cluster,omitempty"` // with `spec.placement`
+	Operation string    `json:"operation"`         // create, update, delete, or event with `events.mirror: [audit]`
+	Kind      string    `json:"kind"`
+	Namespace string    `json:"namespace,omitempty"`
+	Name      string    `json:"name"`
+	// The object whose reconcile made the change
+	Owner *auditOwner `json:"owner,omitempty"`
+	// Fields changed by an update
+	Changes []auditFieldChange `json:"changes,omitempty"`
+	// Event recorded on the object
+	Event *auditEvent `json:"event,omitempty"`
+	// Trace of the reconcile, with tracing enabled
+	TraceID string `json:"traceID,omitempty"`
+}
+
+type auditOwner struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	// Generation the reconcile acted on
+	Generation int64 `json:"generation,omitempty"`
+}
+
+type auditEvent struct {
+	Type    string `json:"type"`
+	Reason  string `json:"reason"`
+	Action  string `json:"action"`
+	Note    string `json:"note,omitempty"`
+	Related string `json:"related,omitempty"` // e.g. `Deployment team-a/web`
+}
+
+type auditFieldChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old,omitempty"`
+	New   interface{} `json:"new,omitempty"`
+}
+
+type auditOwnerKey struct{}
+
+// withAuditOwner records in `ctx` the object being reconciled, which the audit log names as the cause of the changes.
+func withAuditOwner(ctx context.Context, owner auditOwner) context.Context {
+	return context.WithValue(ctx, auditOwnerKey{}, owner)
+}
+
+type auditLog struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+func newAuditLog(cfg auditConfig) (*auditLog, error) {
+	if cfg.Sink == "stdout" {
+		return &auditLog{w: os.Stdout}, nil
+	}
+	f, err := openRotatingFile(cfg.File, int64(cfg.MaxSizeMB)<<20, cfg.MaxBackups)
+	if err != nil {
+		return nil, fmt.Errorf("open audit log: %w", err)
+	}
+	return &auditLog{w: f, closer: f}, nil
+}
+
+func (a *auditLog) Close() error {
+	if a.closer == nil {
+		return nil
+	}
+	return a.closer.Close()
+}
+
+// client wraps `c` so that its writes are recorded. `cluster` names a placement target, empty for the local cluster.
+func (a *auditLog) client(c client.Client, cluster string) client.Client {
+	return &auditClient{Client: c, audit: a, cluster: cluster}
+}
+
+// deleted records a delete made without an audited client. Does nothing on a nil audit log.
+func (a *auditLog) deleted(ctx context.Context, kind, namespace, name string) {
+	if a == nil {
+		return
+	}
+	a.write(ctx, auditRecord{Operation: "delete", Kind: kind, Namespace: namespace, Name: name})
+}
+
+func (a *auditLog) record(ctx context.Context, c client.Client, cluster, operation string, before, after client.Object) {
+	obj := after
+	if obj == nil {
+		obj = before
+	}
+	rec := auditRecord{
+		Cluster:   cluster,
+		Operation: operation,
+		Namespace: obj.GetNamespace(),
+		Name:      obj.GetName(),
+	}
+	if gvk, err := c.GroupVersionKindFor(obj); err == nil {
+		rec.Kind = gvk.Kind
+	}
+	if operation == "update" {
+		fieldChanges("", diffable(before), diffable(after), &rec.Changes)
+		if len(rec.Changes) == 0 {
+			return
+		}
+	}
+	if _, ok := ctx.Value(auditOwnerKey{}).(auditOwner); !ok {
+		if owner := changeOwner(c, obj); owner != nil {
+			rec.Owner = &auditOwner{Kind: owner.GetObjectKind().GroupVersionKind().Kind, Namespace: owner.GetNamespace(), Name: owner.GetName()}
+		}
+	}
+	a.write(ctx, rec)
+}
+
+func (a *auditLog) write(ctx context.Context, rec auditRecord) {
+	rec.Time = time.Now().UTC()
+	if owner, ok := ctx.Value(auditOwnerKey{}).(auditOwner); ok {
+		rec.Owner = &owner
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		rec.TraceID = sc.TraceID().String()
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "failed to encode audit record")
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.w.Write(append(line, '\n')); err != nil {
+		log.FromContext(ctx).Error(err, "failed to write audit record")
+	}
+}
+
+// fieldChanges appends to `out` the leaves that differ between `old` and `new`, by path (e.g. `spec.replicas`).
+// Lists that changed length and values that changed type are reported whole.
+func fieldChanges(path string, old, new interface{}, out *[]auditFieldChange) {
+	oldMap, oldIsMap := old.(map[string]interface{})
+	newMap, newIsMap := new.(map[string]interface{})
+	if oldIsMap && newIsMap {
+		keys := make([]string, 0, len(oldMap)+len(newMap))
+		for k := range oldMap {
+			keys = append(keys, k)
+		}
+		for k := range newMap {
+			if _, ok := oldMap[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fieldChanges(fieldPath(path, k), oldMap[k], newMap[k], out)
+		}
+		return
+	}
+	oldList, oldIsList := old.([]interface{})
+	newList, newIsList := new.([]interface{})
+	if oldIsList && newIsList && len(oldList) == len(newList) {
+		for i := range oldList {
+			fieldChanges(fmt.Sprintf("%s[%d]", path, i), oldList[i], newList[i], out)
+		}
+		return
+	}
+	if !reflect.DeepEqual(old, new) {
+		*out = append(*out, auditFieldChange{Field: path, Old: old, New: new})
+	}
+}
+
+// fieldPath appends `key` to `path`, quoted if it isn't a plain identifier (e.g. label keys).
+func fieldPath(path, key string) string {
+	if strings.ContainsAny(key, "./ ") || key == "" {
+		return fmt.Sprintf("%s[%q]", path, key)
+	}
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// auditClient records every successful write, with the difference between the live object and the one
+// the API server returned.
+type auditClient struct {
+	client.Client
+	audit   *auditLog
+	cluster string
+}
+
+func (c *auditClient) live(ctx context.Context, obj client.Object) client.Object {
+	before := obj.DeepCopyObject().(client.Object)
+	if err := c.Get(ctx, client.ObjectKeyFromObject(obj), before); err != nil {
+		return nil
+	}
+	return before
+}
+
+func (c *auditClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if err := c.Client.Create(ctx, obj, opts...); err != nil {
+		return err
+	}
+	c.audit.record(ctx, c.Client, c.cluster, "create", nil, obj)
+	return nil
+}
+
+func (c *auditClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	before := c.live(ctx, obj)
+	if err := c.Client.Update(ctx, obj, opts...); err != nil {
+		return err
+	}
+	c.audit.record(ctx, c.Client, c.cluster, "update", before, obj)
+	return nil
+}
+
+func (c *auditClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	before := c.live(ctx, obj)
+	if err := c.Client.Patch(ctx, obj, patch, opts...); err != nil {
+		return err
+	}
+	c.audit.record(ctx, c.Client, c.cluster, "update", before, obj)
+	return nil
+}
+
+func (c *auditClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	if err := c.Client.Delete(ctx, obj, opts...); err != nil {
+		return err
+	}
+	c.audit.record(ctx, c.Client, c.cluster, "delete", obj, nil)
+	return nil
+}
+
+// rotatingFile appends to `path`, moving it to `path.1` (and `path.1` to `path.2`, ...) once it reaches `maxSize`.
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file, r.size = f, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, fmt.Errorf("rotate %s: %w", r.path, err)
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	for i := r.maxBackups - 1; i >= 1; i-- {
+		if err := os.Rename(backupPath(r.path, i), backupPath(r.path, i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Rename(r.path, backupPath(r.path, 1)); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
+
+func backupPath(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+// auditQuery implements `controller audit [flags] [FILE]`: prints the records of the audit log matching the filters,
+// oldest first. FILE is read along with its rotated files; without FILE, the records are read from stdin.
+func auditQuery(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("audit", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: controller audit [flags] [FILE]\n\nPrints the audit records of FILE and its rotated files (or stdin) matching every filter.")
+		fs.PrintDefaults()
+	}
+	var (
+		kind      = fs.String("kind", "", "Only changes to objects of this kind, e.g. Deployment.")
+		namespace = fs.String("namespace", "", "Only changes to objects in this namespace.")
+		name      = fs.String("name", "", "Only changes to objects with this name.")
+		owner     = fs.String("owner", "", "Only changes made for this object, as name or namespace/name (e.g. the ServiceDeployment).")
+		cluster   = fs.String("cluster", "", "Only changes in this placement cluster.")
+		operation = fs.String("operation", "", "Only this operation: create, update, delete or event.")
+		traceID   = fs.String("trace-id", "", "Only changes made by the reconcile with this trace ID.")
+		since     = fs.Duration("since", 0, "Only changes more recent than this, e.g. 24h.")
+		output    = fs.String("o", "json", "Output format: json (the records as they are) or text.")
+	)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 1 || (*output != "json" && *output != "text") {
+		fs.Usage()
+		return 2
+	}
+
+	matches := func(rec *auditRecord) bool {
+		switch {
+		case *kind != "" && !strings.EqualFold(rec.Kind, *kind),
+			*namespace != "" && rec.Namespace != *namespace,
+			*name != "" && rec.Name != *name,
+			*cluster != "" && rec.Cluster != *cluster,
+			*operation != "" && rec.Operation != *operation,
+			*traceID != "" && rec.TraceID != *traceID,
+			*since > 0 && time.Since(rec.Time) > *since:
+			return false
+		}
+		if *owner != "" {
+			if rec.Owner == nil {
+				return false
+			}
+			if ns, n, ok := strings.Cut(*owner, "/"); ok {
+				return rec.Owner.Namespace == ns && rec.Owner.Name == n
+			}
+			return rec.Owner.Name == *owner
+		}
+		return true
+	}
+
+	var files []string
+	if fs.NArg() == 1 {
+		path := fs.Arg(0)
+		// Rotated files are numbered newest first
+		for i := 1; ; i++ {
+			if _, err := os.Stat(backupPath(path, i)); err != nil {
+				break
+			}
+			files = append([]string{backupPath(path, i)}, files...)
+		}
+		files = append(files, path)
+	}
+
+	status := 0
+	query := func(source string, r io.Reader) {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 16<<20)
+		for line := 1; scanner.Scan(); line++ {
+			var rec auditRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				fmt.Fprintf(stderr, "%s:%d: %v\n", source, line, err)
+				status = 1
+				continue
+			}
+			// Skip the operator's own log lines, mixed in with the stdout sink
+			if rec.Operation == "" || !matches(&rec) {
+				continue
+			}
+			if *output == "text" {
+				fmt.Fprintln(stdout, rec.String())
+			} else {
+				fmt.Fprintln(stdout, scanner.Text())
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			fmt.Fprintf(stderr, "%s: %v\n", source, err)
+			status = 1
+		}
+	}
+	if len(files) == 0 {
+		query("stdin", stdin)
+		return status
+	}
+	for _, path := range files {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			status = 1
+			continue
+		}
+		query(path, f)
+		f.Close()
+	}
+	return status
+}
+
+// String summarizes the record on one line, e.g.
+// `2026-01-02T15:04:05Z update Deployment team-a/web by ServiceDeployment team-a/web (generation 4): spec.replicas 2 → 3`.
+func (rec *auditRecord) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s %s %s", rec.Time.Format(time.RFC3339), rec.Operation, rec.Kind, objectRef(rec.Namespace, rec.Name))
+	if rec.Cluster != "" {
+		fmt.Fprintf(&b, " in cluster %s", rec.Cluster)
+	}
+	if rec.Owner != nil {
+		fmt.Fprintf(&b, " by %s %s", rec.Owner.Kind, objectRef(rec.Owner.Namespace, rec.Owner.Name))
+		if rec.Owner.Generation != 0 {
+			fmt.Fprintf(&b, " (generation %d)", rec.Owner.Generation)
+		}
+	}
+	for i, c := range rec.Changes {
+		sep := ", "
+		if i == 0 {
+			sep = ": "
+		}
+		fmt.Fprintf(&b, "%s%s %s → %s", sep, c.Field, auditValue(c.Old), auditValue(c.New))
+	}
+	if e := rec.Event; e != nil {
+		fmt.Fprintf(&b, ": %s %s (%s)", e.Type, e.Reason, e.Action)
+		if e.Related != "" {
+			fmt.Fprintf(&b, " related to %s", e.Related)
+		}
+		fmt.Fprintf(&b, ": %s", e.Note)
+	}
+	if rec.TraceID != "" {
+		fmt.Fprintf(&b, " [trace %s]", rec.TraceID)
+	}
+	return b.String()
+}
+
+func objectRef(namespace, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return namespace + "/" + name
+}
+
+func auditValue(v interface{}) string {
+	if v == nil {
+		return "<none>"
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// readLines returns the lines of `path`, nil if it doesn't exist.
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	f, err := openRotatingFile(path, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 40 bytes each: two fit in a file
+	line := func(i int) string { return fmt.Sprintf("record %d %s", i, strings.Repeat(".", 30)) }
+	for i := 1; i <= 7; i++ {
+		if _, err := fmt.Fprintln(f, line(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The oldest records went with the third backup
+	want := map[string][]string{
+		path:                {line(7)},
+		backupPath(path, 1): {line(5), line(6)},
+		backupPath(path, 2): {line(3), line(4)},
+		backupPath(path, 3): nil,
+	}
+	for p, lines := range want {
+		if diff := cmp.Diff(lines, readLines(t, p)); diff != "" {
+			t.Errorf("%s (-want +got):\n%s", filepath.Base(p), diff)
+		}
+	}
+
+	// Reopened, the file is appended to, and its size counts towards the next rotation
+	if f, err = openRotatingFile(path, 100, 2); err != nil {
+		t.Fatal(err)
+	}
+	for i := 8; i <= 9; i++ {
+		if _, err := fmt.Fprintln(f, line(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{line(9)}, readLines(t, path)); diff != "" {
+		t.Errorf("after reopening (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{line(7), line(8)}, readLines(t, backupPath(path, 1))); diff != "" {
+		t.Errorf("%s after reopening (-want +got):\n%s", filepath.Base(backupPath(path, 1)), diff)
+	}
+}
+
+func TestRotatingFileUnlimited(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	f, err := openRotatingFile(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 100 {
+		if _, err := fmt.Fprintln(f, strings.Repeat(".", 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(readLines(t, path)); got != 100 {
+		t.Errorf("got %d lines, want 100", got)
+	}
+	if _, err := os.Stat(backupPath(path, 1)); !os.IsNotExist(err) {
+		t.Errorf("rotated although maxSize is 0: %v", err)
+	}
+}
+
+func TestAuditConfigValidate(t *testing.T) {
+	for _, tt := range []struct {
+		cfg     auditConfig
+		wantErr string
+	}{
+		{cfg: auditConfig{Sink: "file", File: "audit.log", MaxSizeMB: 100, MaxBackups: 5}},
+		{cfg: auditConfig{Sink: "file", File: "audit.log"}}, // never rotated
+		{cfg: auditConfig{Sink: "file", File: "audit.log", MaxSizeMB: 100}, wantErr: "audit.maxBackups: must be at least 1 when audit.maxSizeMB is set"},
+		{cfg: auditConfig{Sink: "file", MaxSizeMB: 1, MaxBackups: 1}, wantErr: "audit.file: must be set with the file sink"},
+		{cfg: auditConfig{Sink: "file", File: "audit.log", MaxSizeMB: -1, MaxBackups: 1}, wantErr: "audit.maxSizeMB: must not be negative"},
+		{cfg: auditConfig{Sink: "syslog"}, wantErr: `audit.sink: "syslog": must be stdout, file or empty`},
+	} {
+		err := tt.cfg.validate()
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%+v: got error %v, want %q", tt.cfg, err, tt.wantErr)
+		}
+	}
+}
+
+func TestAuditQuery(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	records := []auditRecord{
+		{Time: now.Add(-48 * time.Hour), Operation: "create", Kind: "Deployment", Namespace: "team-a", Name: "web",
+			Owner: &auditOwner{Kind: "ServiceDeployment", Namespace: "team-a", Name: "web", Generation: 1}},
+		{Time: now.Add(-time.Hour), Operation: "update", Kind: "Deployment", Namespace: "team-a", Name: "web",
+			Owner:   &auditOwner{Kind: "ServiceDeployment", Namespace: "team-a", Name: "web", Generation: 2},
+			Changes: []auditFieldChange{{Field: "spec.replicas", Old: 2, New: 3}}, TraceID: "abc"},
+		{Time: now.Add(-time.Minute), Operation: "delete", Kind: "Service", Namespace: "team-b", Name: "api", Cluster: "east",
+			Owner: &auditOwner{Kind: "ServiceDeployment", Namespace: "team-b", Name: "api"}},
+	}
+	lines := make([]string, len(records))
+	for i := range records {
+		data, err := json.Marshal(&records[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines[i] = string(data)
+	}
+	// The oldest record is in the rotated file, next to a log line of the operator (stdout sink)
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if err := os.WriteFile(backupPath(path, 1), []byte(lines[0]+"\n"+`{"level":"info","msg":"reconciled"}`+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(lines[1]+"\n"+lines[2]+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		args       []string
+		stdin      string
+		want       []string
+		wantStatus int
+	}{
+		{name: "everything, oldest first", args: []string{path}, want: lines},
+		{name: "kind, case-insensitive", args: []string{"-kind", "deployment", path}, want: lines[:2]},
+		{name: "owner by name", args: []string{"-owner", "api", path}, want: lines[2:]},
+		{name: "owner by namespace/name", args: []string{"-owner", "team-a/web", "-operation", "update", path}, want: lines[1:2]},
+		{name: "cluster", args: []string{"-cluster", "east", path}, want: lines[2:]},
+		{name: "trace ID", args: []string{"-trace-id", "abc", path}, want: lines[1:2]},
+		{name: "since", args: []string{"-since", "24h", "-namespace", "team-a", path}, want: lines[1:2]},
+		{
+			name: "text",
+			args: []string{"-o", "text", "-operation", "update", path},
+			want: []string{now.Add(-time.Hour).Format(time.RFC3339) + " update Deployment team-a/web by ServiceDeployment team-a/web (generation 2): spec.replicas 2 → 3 [trace abc]"},
+		},
+		{name: "stdin", args: []string{"-name", "api"}, stdin: strings.Join(lines, "\n"), want: lines[2:]},
+		{name: "invalid line", args: []string{"-name", "api"}, stdin: "not json\n" + lines[2], want: lines[2:], wantStatus: 1},
+		{name: "unknown output", args: []string{"-o", "yaml", path}, wantStatus: 2},
+		{name: "two files", args: []string{path, path}, wantStatus: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			status := auditQuery(tt.args, strings.NewReader(tt.stdin), &stdout, &stderr)
+			if status != tt.wantStatus {
+				t.Errorf("exit status: got %d, want %d (stderr: %s)", status, tt.wantStatus, stderr.String())
+			}
+			var got []string
+			if out := strings.TrimSuffix(stdout.String(), "\n"); out != "" {
+				got = strings.Split(out, "\n")
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("output (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
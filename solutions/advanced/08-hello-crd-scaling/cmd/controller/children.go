@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+
+	apiv1 "github.com/jayantasamaddar/quick-reference-kubernetes/solutions/hello-crd-scaling/api/v1"
+
+	"go.opentelemetry.io/otel/attribute"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// childGenerator is one kind of child rendered from a ServiceDeployment, e.g. its Deployment.
+// The reconciler does the rest the same way for every kind: create or update (locally with an owner reference, or in
+// every placement target), Events, metrics, drift policy, watches and deletion.
+// Adding a kind is a file implementing this interface plus an entry in childGenerators
+// (and, for a new API group, adding it to the scheme in main.go and to the RBAC in k8s/rbac.yaml).
+type childGenerator interface {
+	// Kind of the child, as it appears in Events, metrics, errors and logs
+	kind() string
+	// object returns an empty child. It is also the type the ServiceDeployment controller watches (`Owns`).
+	object() client.Object
+	// name returns the name of the child of the ServiceDeployment `sdName`
+	name(sdName string) string
+	// render writes the desired state into the (possibly already existing) child, see render.go
+	render(obj client.Object, sd, effective *apiv1.ServiceDeployment, class *apiv1.ServiceDeploymentClass)
+	// fillStatus adds what the child tells about the ServiceDeployment to its status
+	fillStatus(dst *apiv1.ServiceDeploymentStatus, sd *apiv1.ServiceDeployment, obj client.Object)
+	// fillClusterStatus does the same for the status of one placement target
+	fillClusterStatus(dst *apiv1.ClusterStatus, obj client.Object)
+	// delete deletes the child named `name` without reading it first (the failsafe deletion of reconcile)
+	delete(ctx context.Context, kube kubernetes.Interface, namespace, name string, opts metav1.DeleteOptions) error
+	// revision changes whenever someone may have changed what render sets, but as seldom as possible otherwise
+	// (see childRevisions)
+	revision(obj client.Object) string
+}
+
+// childGenerators are applied in this order and deleted in reverse: the Service first, so no new traffic is sent
+// to the pods of the Deployment while they terminate.
+var childGenerators = []childGenerator{
+	deploymentGenerator{},
+	serviceGenerator{},
+}
+
+// newChild returns an empty child of `gen` for the ServiceDeployment `namespace/sdName`.
+func newChild(gen childGenerator, namespace, sdName string) client.Object {
+	obj := gen.object()
+	obj.SetName(gen.name(sdName))
+	obj.SetNamespace(namespace)
+	return obj
+}
+
+// applyChild creates or updates the child of `gen` in the local cluster, controlled by `sd`, and records what it did.
+// `live` and `unchanged` decide what happens to a drifted child (see driftGuard).
+func (r *reconciler) applyChild(ctx context.Context, gen childGenerator, sd, effective *apiv1.ServiceDeployment, class *apiv1.ServiceDeploymentClass, live *liveSettings, unchanged bool) (client.Object, error) {
+	kind := gen.kind()
+	desired := newChild(gen, sd.Namespace, sd.Name)
+	gen.render(desired, sd, effective, class)
+	if err := controllerutil.SetControllerReference(sd, desired, r.scheme); err != nil {
+		return nil, fmt.Errorf("apply %s: %w", strings.ToLower(kind), err)
+	}
+	obj := newChild(gen, sd.Namespace, sd.Name)
+	result, err := r.applyRendered(ctx, r.Client, "", gen, obj, desired, driftGuard(live, unchanged, obj, func() error {
+		gen.render(obj, sd, effective, class)
+
+		// [Very Important]: Set controller `ownerReferences` for GC + Owns()
+		// It sets the OwnerReference on the child, pointing to ServiceDeployment (CR).
+		return controllerutil.SetControllerReference(sd, obj, r.scheme)
+	}))
+	if errors.Is(err, errDriftReported) {
+		r.eventf(ctx, sd, obj, corev1.EventTypeWarning, "DriftDetected", "Apply", "%s %q was changed outside the operator; not correcting it (driftPolicy: Report)", kind, obj.GetName())
+		result, err = controllerutil.OperationResultNone, nil
+	}
+	if err != nil {
+		// Optimistic-concurrency conflict:
+		// Sometimes the child's metadata.resourceVersion changed between your read and your write
+		// (e.g., defaults/managedFields/status updates or two reconciles racing), so the API rejected your update once;
+		// the next attempt used the latest object and succeeded—hence the subsequent “Updated” events.
+		//
+		// This is a benign race condition and we can treat it as transient and requeu without spamming as a Warning Event
+		// (handleError requeues conflicts after a short delay).
+		if k8serrors.IsConflict(err) {
+			conflictRequeues.WithLabelValues(kind).Inc()
+		} else {
+			// Record a Warning tied to the CR
+			r.eventf(ctx, sd, obj, corev1.EventTypeWarning, "Apply"+kind+"Failed", "Apply", "Failed to apply %s %q: %v", kind, obj.GetName(), err)
+			recordApplyFailure(kind, err)
+		}
+		return nil, fmt.Errorf("apply %s: %w", strings.ToLower(kind), err)
+	}
+	// Record Normal event for created/updated/noop
+	switch result {
+	case controllerutil.OperationResultCreated:
+		r.eventf(ctx, sd, obj, corev1.EventTypeNormal, kind+"Created", "Create", "Created %s %q", kind, obj.GetName())
+	case controllerutil.OperationResultUpdated:
+		r.eventf(ctx, sd, obj, corev1.EventTypeNormal, kind+"Updated", "Update", "Updated %s %q", kind, obj.GetName())
+		// Nothing it is rendered from changed: it was changed outside the operator
+		if unchanged {
+			driftCorrections.WithLabelValues(kind).Inc()
+		}
+	default:
+		// No change; keep noise low—skip or log a verbose message
+	}
+	return obj, nil
+}
+
+// Result of applyRendered for a child that was neither read in full nor written (see childRevisions)
+const operationResultSkipped controllerutil.OperationResult = "skipped"
+
+// applyRendered is createOrUpdate for the child `obj` of `gen` in `cluster` (empty: the local one), unless nothing changed
+// since it was last written. `desired` is the child as rendered from scratch: its hash is stored in the spec-hash annotation.
+func (r *reconciler) applyRendered(ctx context.Context, c client.Client, cluster string, gen childGenerator, obj, desired client.Object, f controllerutil.MutateFn, attrs ...attribute.KeyValue) (controllerutil.OperationResult, error) {
+	kind := gen.kind()
+	hash := specHash(desired)
+	key := childKey{cluster: cluster, kind: kind, namespace: obj.GetNamespace(), name: obj.GetName()}
+	if r.revisions.unchanged(ctx, c, key, gen, obj, desired, hash) {
+		childApplies.WithLabelValues(kind, string(operationResultSkipped)).Inc()
+		return operationResultSkipped, nil
+	}
+	result, err := createOrUpdate(ctx, c, kind, obj, func() error {
+		if err := f(); err != nil {
+			return err
+		}
+		annotations := obj.GetAnnotations()
+		if annotations == nil {
+			annotations = make(map[string]string)
+		}
+		annotations[apiv1.SpecHashAnnotation] = hash
+		obj.SetAnnotations(annotations)
+		return nil
+	}, attrs...)
+	if err != nil {
+		return result, err
+	}
+	childApplies.WithLabelValues(kind, string(result)).Inc()
+	r.revisions.store(key, gen, obj)
+	return result, nil
+}
+
+// specHash returns a stable hash of the rendered child `obj`.
+func specHash(obj client.Object) string {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return ""
+	}
+	h := fnv.New64a()
+	h.Write(data)
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// childKey identifies a child across clusters.
+type childKey struct {
+	cluster, kind, namespace, name string
+}
+
+type childRevision struct {
+	uid      types.UID
+	revision string
+}
+
+// childRevisions remembers the revision (see childGenerator) of every child as the operator last wrote it.
+// A child whose spec hash is the one rendered now, whose revision is still the same and that still has the rendered
+// labels, annotations and controller changed neither on our side nor on anyone else's, so it is skipped:
+// no mutate function that might rewrite defaulted fields, no update.
+// Only in memory: after a restart every child is applied once in full.
+type childRevisions struct {
+	mu sync.Mutex
+	m  map[childKey]childRevision
+}
+
+func newChildRevisions() *childRevisions {
+	return &childRevisions{m: make(map[childKey]childRevision)}
+}
+
+// unchanged reads the child of `key` into `obj` and reports whether it can be skipped, `desired` being the child as
+// rendered now. Nil never skips.
+func (c *childRevisions) unchanged(ctx context.Context, reader client.Reader, key childKey, gen childGenerator, obj, desired client.Object, hash string) bool {
+	if c == nil || hash == "" {
+		return false
+	}
+	c.mu.Lock()
+	last, ok := c.m[key]
+	c.mu.Unlock()
+	if !ok {
+		return false
+	}
+	if err := reader.Get(ctx, client.ObjectKeyFromObject(obj), obj); err != nil {
+		return false
+	}
+	return obj.GetUID() == last.uid && gen.revision(obj) == last.revision &&
+		obj.GetAnnotations()[apiv1.SpecHashAnnotation] == hash && hasMetadata(obj, desired)
+}
+
+// hasMetadata reports whether `obj` has the labels, annotations and controller of `desired`.
+// Revisions may not change with the metadata alone (e.g. the generation of a Deployment), so it is compared as well.
+func hasMetadata(obj, desired client.Object) bool {
+	for k, v := range desired.GetLabels() {
+		if got, ok := obj.GetLabels()[k]; !ok || got != v {
+			return false
+		}
+	}
+	for k, v := range desired.GetAnnotations() {
+		if got, ok := obj.GetAnnotations()[k]; !ok || got != v {
+			return false
+		}
+	}
+	want, got := metav1.GetControllerOf(desired), metav1.GetControllerOf(obj)
+	return (want == nil) == (got == nil) && (want == nil || want.UID == got.UID)
+}
+
+func (c *childRevisions) store(key childKey, gen childGenerator, obj client.Object) {
+	if c == nil || obj.GetUID() == "" {
+		return // e.g. a dry-run create
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m[key] = childRevision{uid: obj.GetUID(), revision: gen.revision(obj)}
+}
+
+// forget drops the children of the ServiceDeployment `namespace/sdName` in `cluster`.
+func (c *childRevisions) forget(cluster, namespace, sdName string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, gen := range childGenerators {
+		delete(c.m, childKey{cluster: cluster, kind: gen.kind(), namespace: namespace, name: gen.name(sdName)})
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	apiv1 "github.com/jayantasamaddar/quick-reference-kubernetes/solutions/hello-crd-scaling/api/v1"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+// defaultContainers sets container fields the way the API server defaults them. The render functions assign the
+// containers of the spec as they are, so without the spec hash every reconcile would update the Deployment again.
+var defaultContainers = interceptor.Funcs{
+	Create: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.CreateOption) error {
+		applyContainerDefaults(obj)
+		return c.Create(ctx, obj, opts...)
+	},
+	Update: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.UpdateOption) error {
+		applyContainerDefaults(obj)
+		return c.Update(ctx, obj, opts...)
+	},
+}
+
+func applyContainerDefaults(obj client.Object) {
+	dep, ok := obj.(*appsv1.Deployment)
+	if !ok {
+		return
+	}
+	for i := range dep.Spec.Template.Spec.Containers {
+		ctr := &dep.Spec.Template.Spec.Containers[i]
+		if ctr.TerminationMessagePath == "" {
+			ctr.TerminationMessagePath = corev1.TerminationMessagePathDefault
+		}
+		if ctr.ImagePullPolicy == "" {
+			ctr.ImagePullPolicy = corev1.PullIfNotPresent
+		}
+	}
+}
+
+// newUnchangedEnv returns a testEnv with `n` ServiceDeployments, reconciled once.
+func newUnchangedEnv(t testing.TB, n int, skip bool) (*testEnv, []*apiv1.ServiceDeployment) {
+	t.Helper()
+	sds := make([]*apiv1.ServiceDeployment, n)
+	objs := make([]client.Object, n)
+	for i := range sds {
+		sds[i] = newTestServiceDeployment("children", fmt.Sprintf("web%d", i))
+		objs[i] = sds[i]
+	}
+	env := newTestEnv(t, defaultContainers, objs...)
+	env.events.Events = nil // not looked at, and a full buffer would block the reconciles
+	if !skip {
+		env.r.revisions = nil
+	}
+	for _, sd := range sds {
+		if _, err := env.reconcile(t, sd); err != nil {
+			t.Fatalf("reconcile %s: %v", sd.Name, err)
+		}
+	}
+	env.takeWrites()
+	return env, sds
+}
+
+func childWrites(writes map[string]int) int {
+	return writes["*v1.Deployment"] + writes["*v1.Service"]
+}
+
+func TestUnchangedChildrenAreSkipped(t *testing.T) {
+	const n = 20
+	for _, tt := range []struct {
+		skip bool
+		want int
+	}{
+		{skip: false, want: n}, // every Deployment, rewritten with the API server defaults stripped
+		{skip: true, want: 0},
+	} {
+		t.Run(fmt.Sprintf("skip=%t", tt.skip), func(t *testing.T) {
+			env, sds := newUnchangedEnv(t, n, tt.skip)
+			for round := range 3 {
+				for _, sd := range sds {
+					if _, err := env.reconcile(t, sd); err != nil {
+						t.Fatalf("reconcile %s: %v", sd.Name, err)
+					}
+				}
+				if got := childWrites(env.takeWrites()); got != tt.want {
+					t.Errorf("round %d: got %d child writes, want %d", round, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSkippedChildDriftIsCorrected(t *testing.T) {
+	ctx := context.Background()
+	env, sds := newUnchangedEnv(t, 1, true)
+	sd := sds[0]
+	key := client.ObjectKey{Namespace: sd.Namespace, Name: sd.Name}
+
+	tests := []struct {
+		name string
+		edit func(dep *appsv1.Deployment)
+	}{
+		{name: "label edited", edit: func(dep *appsv1.Deployment) { dep.Labels["app"] = "other" }},
+		{name: "spec-hash annotation removed", edit: func(dep *appsv1.Deployment) { delete(dep.Annotations, apiv1.SpecHashAnnotation) }},
+		{name: "owner removed", edit: func(dep *appsv1.Deployment) { dep.OwnerReferences = nil }},
+		{name: "spec edited", edit: func(dep *appsv1.Deployment) {
+			dep.Spec.Template.Spec.Containers[0].Image = "nginx:latest"
+			dep.Generation++
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var dep appsv1.Deployment
+			if err := env.client.Get(ctx, key, &dep); err != nil {
+				t.Fatal(err)
+			}
+			want := dep.DeepCopy()
+			// Like `kubectl edit`: the generation only changes with the spec
+			tt.edit(&dep)
+			if err := env.client.Update(ctx, &dep); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := env.reconcile(t, sd); err != nil {
+				t.Fatalf("reconcile: %v", err)
+			}
+			if got := env.takeWrites()["*v1.Deployment"]; got != 1 {
+				t.Errorf("got %d Deployment writes, want 1", got)
+			}
+			if err := env.client.Get(ctx, key, &dep); err != nil {
+				t.Fatal(err)
+			}
+			if dep.Labels["app"] != want.Labels["app"] || dep.Annotations[apiv1.SpecHashAnnotation] != want.Annotations[apiv1.SpecHashAnnotation] ||
+				len(dep.OwnerReferences) != 1 || dep.Spec.Template.Spec.Containers[0].Image != want.Spec.Template.Spec.Containers[0].Image {
+				t.Errorf("drift not corrected: labels %v, annotations %v, owners %v, image %q",
+					dep.Labels, dep.Annotations, dep.OwnerReferences, dep.Spec.Template.Spec.Containers[0].Image)
+			}
+		})
+	}
+}
+
+// BenchmarkReconcileUnchanged reconciles ServiceDeployments whose children are up to date, as on a resync,
+// and reports the API writes per reconcile.
+func BenchmarkReconcileUnchanged(b *testing.B) {
+	for _, skip := range []bool{false, true} {
+		b.Run(fmt.Sprintf("skip=%t", skip), func(b *testing.B) {
+			env, sds := newUnchangedEnv(b, 50, skip)
+			writes := 0
+			b.ResetTimer()
+			for i := range b.N {
+				if _, err := env.reconcile(b, sds[i%len(sds)]); err != nil {
+					b.Fatal(err)
+				}
+				writes += childWrites(env.takeWrites())
+			}
+			b.ReportMetric(float64(writes)/float64(b.N), "writes/op")
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"sort"
+
+	apiv1 "github.com/jayantasamaddar/quick-reference-kubernetes/solutions/hello-crd-scaling/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// Field index on ServiceDeployments so that a class change can find its members without listing everything.
+const classNameIndex = ".spec.className"
+
+func indexClassName(obj client.Object) []string {
+	sd, ok := obj.(*apiv1.ServiceDeployment)
+	if !ok {
+		return nil
+	}
+	return []string{sd.Spec.ClassName}
+}
+
+// resolveClass returns the ServiceDeploymentClass that applies to `sd`:
+//   - `spec.className` if set (a missing class is returned as a NotFound error),
+//   - otherwise the OperatorConfig's `defaultClassName`, if set (likewise),
+//   - otherwise the class annotated as default,
+//   - otherwise nil (no defaults apply).
+//
+// In namespace-scoped mode classes can't be read (they are cluster-scoped), so there is no default class
+// and a `spec.className` is an errClassesUnavailable error.
+func (r *reconciler) resolveClass(ctx context.Context, sd *apiv1.ServiceDeployment) (*apiv1.ServiceDeploymentClass, error) {
+	if r.scope.restricted() {
+		if sd.Spec.ClassName != "" {
+			return nil, errClassesUnavailable
+		}
+		return nil, nil
+	}
+	if name := r.className(sd); name != "" {
+		var class apiv1.ServiceDeploymentClass
+		if err := r.Get(ctx, types.NamespacedName{Name: name}, &class); err != nil {
+			return nil, err
+		}
+		return &class, nil
+	}
+
+	var classes apiv1.ServiceDeploymentClassList
+	if err := r.List(ctx, &classes); err != nil {
+		return nil, err
+	}
+	// If more than one class is marked default, pick the first by name so the choice is at least deterministic.
+	sort.Slice(classes.Items, func(i, j int) bool { return classes.Items[i].Name < classes.Items[j].Name })
+	for i := range classes.Items {
+		if classes.Items[i].IsDefault() {
+			return &classes.Items[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// className returns the name of the class `sd` asks for, if any: `spec.className` or the OperatorConfig's default.
+func (r *reconciler) className(sd *apiv1.ServiceDeployment) string {
+	if sd.Spec.ClassName != "" {
+		return sd.Spec.ClassName
+	}
+	return r.live.load().DefaultClassName
+}
+
+// applyClass returns a copy of `sd` with the class defaults merged into its spec.
+// Anything explicitly set on the ServiceDeployment wins over the class. `sd` itself is never modified,
+// so it stays safe to use for owner references and status updates.
+func applyClass(sd *apiv1.ServiceDeployment, class *apiv1.ServiceDeploymentClass) *apiv1.ServiceDeployment {
+	out := sd.DeepCopy()
+	if class == nil {
+		return out
+	}
+
+	for i := range out.Spec.Containers {
+		c := &out.Spec.Containers[i]
+		for name, qty := range class.Spec.Resources.Requests {
+			if _, ok := c.Resources.Requests[name]; !ok {
+				if c.Resources.Requests == nil {
+					c.Resources.Requests = corev1.ResourceList{}
+				}
+				c.Resources.Requests[name] = qty.DeepCopy()
+			}
+		}
+		for name, qty := range class.Spec.Resources.Limits {
+			if _, ok := c.Resources.Limits[name]; !ok {
+				if c.Resources.Limits == nil {
+					c.Resources.Limits = corev1.ResourceList{}
+				}
+				c.Resources.Limits[name] = qty.DeepCopy()
+			}
+		}
+		if c.SecurityContext == nil && class.Spec.SecurityContext != nil {
+			c.SecurityContext = class.Spec.SecurityContext.DeepCopy()
+		}
+	}
+
+	// Sidecars are appended, unless the user already has a container with the same name
+	for _, sidecar := range class.Spec.Sidecars {
+		exists := false
+		for _, c := range out.Spec.Containers {
+			if c.Name == sidecar.Name {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			out.Spec.Containers = append(out.Spec.Containers, *sidecar.DeepCopy())
+		}
+	}
+
+	if out.Spec.Service.Type == "" {
+		out.Spec.Service.Type = class.Spec.ServiceType
+	}
+	return out
+}
+
+// applyClassToPodTemplate sets the pod-level class defaults that have no counterpart in ServiceDeploymentSpec.
+func applyClassToPodTemplate(tmpl *corev1.PodTemplateSpec, class *apiv1.ServiceDeploymentClass) {
+	if class == nil {
+		tmpl.Spec.Tolerations = nil
+		tmpl.Spec.SecurityContext = nil
+		return
+	}
+	tmpl.Spec.Tolerations = class.Spec.Tolerations
+	tmpl.Spec.SecurityContext = class.Spec.PodSecurityContext
+}
+
+// mapClassToServiceDeployments enqueues every ServiceDeployment affected by a class change:
+// the ones referencing it by name and, if it is (or was) a default class, the ones without a className.
+// On updates controller-runtime calls this for both the old and the new object, so un-defaulting a class is covered too.
+func (r *reconciler) mapClassToServiceDeployments(ctx context.Context, obj client.Object) []reconcile.Request {
+	class, ok := obj.(*apiv1.ServiceDeploymentClass)
+	if !ok {
+		return nil
+	}
+
+	names := []string{class.Name}
+	if class.IsDefault() || class.Name == r.live.load().DefaultClassName {
+		names = append(names, "")
+	}
+
+	var requests []reconcile.Request
+	for _, name := range names {
+		var sds apiv1.ServiceDeploymentList
+		if err := r.List(ctx, &sds, client.MatchingFields{classNameIndex: name}); err != nil {
+			log.FromContext(ctx).Error(err, "failed to list servicedeployments for class", "class", class.Name)
+			continue
+		}
+		for _, sd := range sds.Items {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: sd.Namespace, Name: sd.Name}})
+		}
+	}
+	return requests
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/yaml"
+)
+
+// Versioned format of the `--config` file
+const (
+	configAPIVersion = "config.k8s.example.com/v1alpha1"
+	configKind       = "OperatorConfiguration"
+)
+
+// operatorConfig is everything that can be tuned about the operator.
+// Values are resolved in this order, each overriding the previous: defaults, the `--config` file, command-line flags.
+type operatorConfig struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+
+	// Path to a kubeconfig. If empty: $KUBECONFIG, then ~/.kube/config, then the in-cluster config.
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+	// Context in the kubeconfig to use. If empty: the current context.
+	Context string `json:"context,omitempty"`
+
+	// Namespaces to watch. If empty: all namespaces.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Value of `spec.controllerName` this operator handles
+	ControllerName string `json:"controllerName,omitempty"`
+	// Also handle ServiceDeployments without `spec.controllerName` and ServiceDeploymentSets, and report unclaimed
+	// ServiceDeployments. Exactly one of the operators running side by side should be the default.
+	DefaultController bool `json:"defaultController,omitempty"`
+	// How many ServiceDeployments are reconciled in parallel. The OperatorConfig can lower it at runtime.
+	MaxConcurrentReconciles int `json:"maxConcurrentReconciles,omitempty"`
+	// OperatorConfig (cluster-scoped) tuning this operator at runtime. Empty: none, the settings keep their defaults.
+	OperatorConfigName string `json:"operatorConfigName,omitempty"`
+	// Kinds ServiceDeployments may list in `spec.extraResources`, as <apiVersion>/<Kind> (e.g. v1/ConfigMap).
+	// An OperatorConfig listing kinds of its own replaces these.
+	AllowedExtraResources []string `json:"allowedExtraResources,omitempty"`
+	// Retries after failed reconciles
+	Requeue requeueConfig `json:"requeue,omitzero"`
+
+	// "0" disables the endpoint
+	MetricsBindAddress     string `json:"metricsBindAddress,omitempty"`
+	HealthProbeBindAddress string `json:"healthProbeBindAddress,omitempty"`
+
+	Log            logConfig            `json:"log,omitzero"`
+	LeaderElection leaderElectionConfig `json:"leaderElection,omitzero"`
+	Tracing        tracingConfig        `json:"tracing,omitzero"`
+	DryRun         dryRunConfig         `json:"dryRun,omitzero"`
+	Sharding       shardingConfig       `json:"sharding,omitzero"`
+	Webhook        webhookConfig        `json:"webhook,omitzero"`
+	Audit          auditConfig          `json:"audit,omitzero"`
+	Events         eventsConfig         `json:"events,omitzero"`
+	Notifications  notificationsConfig  `json:"notifications,omitzero"`
+}
+
+type logConfig struct {
+	// debug, info, warn or error
+	Level string `json:"level,omitempty"`
+	// json or console
+	Format string `json:"format,omitempty"`
+}
+
+func defaultConfig() operatorConfig {
+	return operatorConfig{
+		APIVersion:              configAPIVersion,
+		Kind:                    configKind,
+		ControllerName:          "k8s.example.com/servicedeployments-operator",
+		DefaultController:       true,
+		MaxConcurrentReconciles: 1,
+		OperatorConfigName:      "default",
+		Requeue: requeueConfig{
+			ConflictDelay: metav1.Duration{Duration: time.Second},
+			WaitingDelay:  metav1.Duration{Duration: time.Minute},
+			BaseDelay:     metav1.Duration{Duration: 5 * time.Millisecond},
+			MaxDelay:      metav1.Duration{Duration: 5 * time.Minute},
+			QPS:           10,
+			Burst:         100,
+		},
+		MetricsBindAddress:     ":8080",
+		HealthProbeBindAddress: ":8081",
+		Log: logConfig{
+			Level:  "info",
+			Format: "json",
+		},
+		LeaderElection: leaderElectionConfig{
+			ID:            "servicedeployments-operator.k8s.example.com",
+			LeaseDuration: metav1.Duration{Duration: 15 * time.Second},
+			RenewDeadline: metav1.Duration{Duration: 10 * time.Second},
+			RetryPeriod:   metav1.Duration{Duration: 2 * time.Second},
+		},
+		Tracing: tracingConfig{
+			SampleRatio: 1,
+		},
+		Sharding: shardingConfig{
+			Shards:        8,
+			LeaseDuration: metav1.Duration{Duration: 15 * time.Second},
+			RenewPeriod:   metav1.Duration{Duration: 2 * time.Second},
+		},
+		Webhook: webhookConfig{
+			Port:                            9443,
+			ServiceName:                     "servicedeployments-operator-webhook",
+			SecretName:                      "servicedeployments-operator-webhook-cert",
+			ValidatingWebhookConfigurations: []string{"servicedeployments-operator"},
+			MutatingWebhookConfigurations:   []string{"servicedeployments-operator"},
+			ConversionCRDs: []string{
+				"servicedeployments.k8s.example.com",
+				"servicedeploymentclasses.k8s.example.com",
+				"servicedeploymentsets.k8s.example.com",
+			},
+			CertValidity: metav1.Duration{Duration: 90 * 24 * time.Hour},
+			RotateBefore: metav1.Duration{Duration: 30 * 24 * time.Hour},
+		},
+		Audit: auditConfig{
+			MaxSizeMB:  100,
+			MaxBackups: 5,
+		},
+		Events: eventsConfig{
+			Burst:    5,
+			Interval: metav1.Duration{Duration: time.Minute},
+		},
+		Notifications: notificationsConfig{
+			ConfigMapName: "servicedeployment-notifications",
+			Timeout:       metav1.Duration{Duration: 10 * time.Second},
+			QueueSize:     100,
+		},
+	}
+}
+
+func (c *operatorConfig) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Kubeconfig, "kubeconfig", c.Kubeconfig, "Path to a kubeconfig. Defaults to $KUBECONFIG, then ~/.kube/config, then the in-cluster config.")
+	fs.StringVar(&c.Context, "context", c.Context, "Kubeconfig context to use. Defaults to the current context.")
+	fs.Var((*stringList)(&c.Namespaces), "namespaces", "Comma-separated namespaces to watch. Defaults to all namespaces.")
+	fs.StringVar(&c.ControllerName, "controller-name", c.ControllerName, "Value of spec.controllerName this operator handles.")
+	fs.BoolVar(&c.DefaultController, "default-controller", c.DefaultController, "Also handle ServiceDeployments without spec.controllerName and ServiceDeploymentSets, and report unclaimed ServiceDeployments.")
+	fs.IntVar(&c.MaxConcurrentReconciles, "max-concurrent-reconciles", c.MaxConcurrentReconciles, "How many ServiceDeployments are reconciled in parallel.")
+	fs.StringVar(&c.OperatorConfigName, "operator-config-name", c.OperatorConfigName, "OperatorConfig tuning this operator at runtime. Empty disables it.")
+	fs.Var((*stringList)(&c.AllowedExtraResources), "allowed-extra-resources", "Comma-separated kinds allowed in spec.extraResources, as <apiVersion>/<Kind> (e.g. v1/ConfigMap). Defaults to none.")
+	c.Requeue.bindFlags(fs)
+	fs.StringVar(&c.MetricsBindAddress, "metrics-bind-address", c.MetricsBindAddress, "Address the metrics endpoint binds to. \"0\" disables it.")
+	fs.StringVar(&c.HealthProbeBindAddress, "health-probe-bind-address", c.HealthProbeBindAddress, "Address the /healthz and /readyz endpoints bind to. \"0\" disables them.")
+	fs.StringVar(&c.Log.Level, "log-level", c.Log.Level, "Log level: debug, info, warn or error.")
+	fs.StringVar(&c.Log.Format, "log-format", c.Log.Format, "Log format: json or console.")
+	c.LeaderElection.bindFlags(fs)
+	c.Tracing.bindFlags(fs)
+	c.DryRun.bindFlags(fs)
+	c.Sharding.bindFlags(fs)
+	c.Webhook.bindFlags(fs)
+	c.Audit.bindFlags(fs)
+	c.Events.bindFlags(fs)
+	c.Notifications.bindFlags(fs)
+}
+
+// loadConfig resolves the configuration from defaults, the file passed with `--config` and the flags in `args`.
+// Flags win over the file: after the file is read, the flags that were explicitly set are applied again.
+func loadConfig(fs *flag.FlagSet, args []string) (*operatorConfig, error) {
+	cfg := defaultConfig()
+	var path string
+	fs.StringVar(&path, "config", "", "Path to a YAML config file (apiVersion: "+configAPIVersion+", kind: "+configKind+"). Flags override its values.")
+	cfg.bindFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if path != "" {
+		set := map[string]string{}
+		fs.Visit(func(f *flag.Flag) { set[f.Name] = f.Value.String() })
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read config file: %w", err)
+		}
+		// Unmarshal on top of the defaults; unknown fields are most likely typos, so reject them
+		if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+			return nil, fmt.Errorf("parse config file %q: %w", path, err)
+		}
+		for name, value := range set {
+			if err := fs.Set(name, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return &cfg, nil
+}
+
+// validate returns every problem with the configuration at once, one per line.
+func (c *operatorConfig) validate() error {
+	var errs []error
+	if c.APIVersion != configAPIVersion || c.Kind != configKind {
+		errs = append(errs, fmt.Errorf("  apiVersion/kind: must be %s/%s, got %s/%s", configAPIVersion, configKind, c.APIVersion, c.Kind))
+	}
+	for _, ns := range c.Namespaces {
+		for _, msg := range validation.IsDNS1123Label(ns) {
+			errs = append(errs, fmt.Errorf("  namespaces: %q: %s", ns, msg))
+		}
+	}
+	// Like ingress class controllers: a domain-prefixed path such as k8s.example.com/canary
+	for _, msg := range validation.IsQualifiedName(c.ControllerName) {
+		errs = append(errs, fmt.Errorf("  controllerName: %q: %s", c.ControllerName, msg))
+	}
+	if c.MaxConcurrentReconciles < 1 {
+		errs = append(errs, fmt.Errorf("  maxConcurrentReconciles: must be at least 1, got %d", c.MaxConcurrentReconciles))
+	}
+	if c.OperatorConfigName != "" {
+		for _, msg := range validation.IsDNS1123Subdomain(c.OperatorConfigName) {
+			errs = append(errs, fmt.Errorf("  operatorConfigName: %q: %s", c.OperatorConfigName, msg))
+		}
+	}
+	for _, kind := range c.AllowedExtraResources {
+		if _, err := parseAPIVersionKind(kind); err != nil {
+			errs = append(errs, fmt.Errorf("  allowedExtraResources: %q: %v", kind, err))
+		}
+	}
+	if err := c.Requeue.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	for name, addr := range map[string]string{"metricsBindAddress": c.MetricsBindAddress, "healthProbeBindAddress": c.HealthProbeBindAddress} {
+		if addr == "0" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			errs = append(errs, fmt.Errorf("  %s: %q is not host:port or \"0\": %v", name, addr, err))
+		}
+	}
+	if _, err := zapcore.ParseLevel(c.Log.Level); err != nil {
+		errs = append(errs, fmt.Errorf("  log.level: %q: must be debug, info, warn or error", c.Log.Level))
+	}
+	if c.Log.Format != "json" && c.Log.Format != "console" {
+		errs = append(errs, fmt.Errorf("  log.format: %q: must be json or console", c.Log.Format))
+	}
+	if err := c.LeaderElection.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Tracing.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.DryRun.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Sharding.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Webhook.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Audit.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Events.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Notifications.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if slices.Contains(c.Events.Mirror, "audit") && c.Audit.Sink == "" {
+		errs = append(errs, errors.New("  events.mirror: audit needs audit.sink"))
+	}
+	// Sharded replicas all reconcile at once; leader election would leave all but one idle
+	if c.Sharding.Enabled && c.LeaderElection.Enabled {
+		errs = append(errs, errors.New("  sharding.enabled: leaderElection.enabled must be false with sharding"))
+	}
+	return errors.Join(errs...)
+}
+
+// allowedExtraResourceKinds returns `allowedExtraResources`, which are valid.
+func (c *operatorConfig) allowedExtraResourceKinds() []metav1.GroupVersionKind {
+	kinds := make([]metav1.GroupVersionKind, 0, len(c.AllowedExtraResources))
+	for _, kind := range c.AllowedExtraResources {
+		gvk, _ := parseAPIVersionKind(kind)
+		kinds = append(kinds, gvk)
+	}
+	return kinds
+}
+
+// parseAPIVersionKind parses <apiVersion>/<Kind>, e.g. v1/ConfigMap or rbac.authorization.k8s.io/v1/Role.
+func parseAPIVersionKind(s string) (metav1.GroupVersionKind, error) {
+	i := strings.LastIndex(s, "/")
+	if i <= 0 || i == len(s)-1 {
+		return metav1.GroupVersionKind{}, errors.New("must be <apiVersion>/<Kind>, e.g. v1/ConfigMap")
+	}
+	gv, err := schema.ParseGroupVersion(s[:i])
+	if err != nil {
+		return metav1.GroupVersionKind{}, err
+	}
+	return metav1.GroupVersionKind{Group: gv.Group, Version: gv.Version, Kind: s[i+1:]}, nil
+}
+
+// restConfig builds the client config: `kubeconfig`/$KUBECONFIG/~/.kube/config if there is one, else in-cluster.
+func (c *operatorConfig) restConfig() (*rest.Config, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = c.Kubeconfig
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: c.Context}
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+}
+
+// Namespace of the pod, mounted with its service account token
+const inClusterNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// operatorNamespace returns `namespace` if set, else the namespace the operator runs in.
+// `field` names the setting in the error outside a cluster.
+func operatorNamespace(namespace, field string) (string, error) {
+	if namespace != "" {
+		return namespace, nil
+	}
+	data, err := os.ReadFile(inClusterNamespaceFile)
+	if err != nil {
+		return "", fmt.Errorf("%s must be set when not running in a cluster", field)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// stringList is a comma-separated flag.Value
+type stringList []string
+
+func (s *stringList) String() string {
+	if s == nil {
+		return ""
+	}
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = nil
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*s = append(*s, v)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func parseConfig(args ...string) (*operatorConfig, error) {
+	fs := flag.NewFlagSet("controller", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return loadConfig(fs, args)
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	cfg, err := parseConfig()
+	if err != nil {
+		t.Fatalf("defaults are invalid: %v", err)
+	}
+	if diff := cmp.Diff(defaultConfig(), *cfg); diff != "" {
+		t.Errorf("config without file nor flags (-want +got):\n%s", diff)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		check   func(t *testing.T, cfg *operatorConfig)
+		wantErr []string // every line expected in the error
+	}{
+		{
+			name: "file over defaults",
+			args: []string{"--config", "testdata/config/valid.yaml"},
+			check: func(t *testing.T, cfg *operatorConfig) {
+				want := defaultConfig()
+				want.MaxConcurrentReconciles = 2
+				want.Namespaces = []string{"team-a", "team-b"}
+				want.Log = logConfig{Level: "debug", Format: "console"}
+				// Only the field set in the file changes in a nested struct
+				want.Requeue.ConflictDelay = metav1.Duration{Duration: 2 * time.Second}
+				if diff := cmp.Diff(want, *cfg); diff != "" {
+					t.Errorf("(-want +got):\n%s", diff)
+				}
+			},
+		},
+		{
+			name: "flags over file",
+			args: []string{"--log-level=warn", "--config", "testdata/config/valid.yaml", "--max-concurrent-reconciles=5", "--requeue-conflict-delay=3s"},
+			check: func(t *testing.T, cfg *operatorConfig) {
+				if cfg.MaxConcurrentReconciles != 5 || cfg.Log.Level != "warn" || cfg.Requeue.ConflictDelay.Duration != 3*time.Second {
+					t.Errorf("got maxConcurrentReconciles %d, log.level %q, requeue.conflictDelay %s; want the flags: 5, warn, 3s",
+						cfg.MaxConcurrentReconciles, cfg.Log.Level, cfg.Requeue.ConflictDelay.Duration)
+				}
+				// Not set by a flag: still from the file
+				if cfg.Log.Format != "console" || !slices.Equal(cfg.Namespaces, []string{"team-a", "team-b"}) {
+					t.Errorf("got log.format %q, namespaces %v; want the file's: console, [team-a team-b]", cfg.Log.Format, cfg.Namespaces)
+				}
+			},
+		},
+		{
+			name: "flag set to the default still overrides the file",
+			args: []string{"--config", "testdata/config/valid.yaml", "--max-concurrent-reconciles=1"},
+			check: func(t *testing.T, cfg *operatorConfig) {
+				if cfg.MaxConcurrentReconciles != 1 {
+					t.Errorf("got maxConcurrentReconciles %d, want 1", cfg.MaxConcurrentReconciles)
+				}
+			},
+		},
+		{
+			name:    "unknown field",
+			args:    []string{"--config", "testdata/config/unknown-field.yaml"},
+			wantErr: []string{`parse config file "testdata/config/unknown-field.yaml"`, `unknown field "maxConcurentReconciles"`},
+		},
+		{
+			name: "invalid values, all reported",
+			args: []string{"--config", "testdata/config/invalid-value.yaml"},
+			wantErr: []string{
+				"invalid configuration:",
+				"  maxConcurrentReconciles: must be at least 1, got 0",
+				`  log.format: "text": must be json or console`,
+			},
+		},
+		{
+			name: "invalid file fixed by a flag",
+			args: []string{"--config", "testdata/config/invalid-value.yaml", "--max-concurrent-reconciles=3", "--log-format=json"},
+			check: func(t *testing.T, cfg *operatorConfig) {
+				if cfg.MaxConcurrentReconciles != 3 || cfg.Log.Format != "json" {
+					t.Errorf("got maxConcurrentReconciles %d, log.format %q; want 3, json", cfg.MaxConcurrentReconciles, cfg.Log.Format)
+				}
+			},
+		},
+		{
+			name:    "invalid flag",
+			args:    []string{"--requeue-qps=0"},
+			wantErr: []string{"  requeue.qps: must be positive, got 0"},
+		},
+		{
+			name:    "missing file",
+			args:    []string{"--config", "testdata/config/missing.yaml"},
+			wantErr: []string{"read config file"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseConfig(tt.args...)
+			if len(tt.wantErr) > 0 {
+				if err == nil {
+					t.Fatal("got no error")
+				}
+				for _, want := range tt.wantErr {
+					if !strings.Contains(err.Error(), want) {
+						t.Errorf("error %q doesn't contain %q", err, want)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			tt.check(t, cfg)
+		})
+	}
+}
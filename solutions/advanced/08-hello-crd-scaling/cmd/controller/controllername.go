@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	apiv1 "github.com/jayantasamaddar/quick-reference-kubernetes/solutions/hello-crd-scaling/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Field selector on `spec.controllerName`, declared in the CRD's `selectableFields`
+const controllerNameField = "spec.controllerName"
+
+// How long a new ServiceDeployment naming another controller may stay unclaimed before it is reported,
+// so the usual race between the operators watching it doesn't flash a Warning on every create
+const unclaimedGracePeriod = 30 * time.Second
+
+// Several builds of the operator (e.g. stable and canary) can run side by side, `spec.controllerName` picks the one
+// handling a ServiceDeployment, like `ingressClassName` picks an ingress controller.
+//   - Every operator handles the ServiceDeployments naming its `controllerName`.
+//   - The default operator also handles those without `spec.controllerName` and the ServiceDeploymentSets.
+//     It caches every ServiceDeployment, so it can mark those naming a controller that never claims them as unclaimed.
+//   - The other operators only cache their own ServiceDeployments.
+type controllerSelector struct {
+	name      string
+	isDefault bool
+}
+
+// claims reports whether this operator handles `sd`.
+func (c controllerSelector) claims(sd *apiv1.ServiceDeployment) bool {
+	if sd.Spec.ControllerName == "" {
+		return c.isDefault
+	}
+	return sd.Spec.ControllerName == c.name
+}
+
+// watches reports whether this operator has anything to do with `sd`: handle it,
+// or, as the default operator, report it as unclaimed.
+func (c controllerSelector) watches(sd *apiv1.ServiceDeployment) bool {
+	return c.claims(sd) || (c.isDefault && sd.Status.ControllerName != sd.Spec.ControllerName)
+}
+
+// filtersCache reports whether the cache only holds the ServiceDeployments this operator handles.
+// A cache miss then doesn't mean the ServiceDeployment is gone.
+func (c controllerSelector) filtersCache() bool {
+	return !c.isDefault
+}
+
+// applyCache restricts the ServiceDeployments in the cache to those naming this operator, unless it is the default one.
+func (c controllerSelector) applyCache(opts *cache.Options) {
+	if !c.filtersCache() {
+		return
+	}
+	opts.ByObject = map[client.Object]cache.ByObject{
+		&apiv1.ServiceDeployment{}: {Field: fields.OneTermEqualSelector(controllerNameField, c.name)},
+	}
+}
+
+// fillStatus records in `dst` that this operator claimed `sd`.
+func (c controllerSelector) fillStatus(dst *apiv1.ServiceDeploymentStatus, sd *apiv1.ServiceDeployment) {
+	dst.ControllerName = c.name
+	meta.SetStatusCondition(&dst.Conditions, metav1.Condition{
+		Type:               apiv1.ConditionClaimed,
+		Status:             metav1.ConditionTrue,
+		Reason:             "Claimed",
+		Message:            fmt.Sprintf("Handled by controller %q", c.name),
+		ObservedGeneration: sd.Generation,
+	})
+}
+
+// reportUnclaimed sets the Claimed condition to False on a ServiceDeployment naming another controller,
+// as long as that controller hasn't claimed it. Only the default operator sees such ServiceDeployments.
+func (r *reconciler) reportUnclaimed(ctx context.Context, sd *apiv1.ServiceDeployment) (ctrl.Result, error) {
+	if sd.Status.ControllerName == sd.Spec.ControllerName {
+		return ctrl.Result{}, nil
+	}
+	if wait := time.Until(sd.CreationTimestamp.Add(unclaimedGracePeriod)); wait > 0 {
+		return ctrl.Result{RequeueAfter: wait}, nil
+	}
+
+	orig := sd.DeepCopy()
+	changed := meta.SetStatusCondition(&sd.Status.Conditions, metav1.Condition{
+		Type:               apiv1.ConditionClaimed,
+		Status:             metav1.ConditionFalse,
+		Reason:             "Unclaimed",
+		Message:            fmt.Sprintf("No operator serving controllerName %q claimed this ServiceDeployment", sd.Spec.ControllerName),
+		ObservedGeneration: sd.Generation,
+	})
+	if !changed && sd.Status.ControllerName == "" {
+		return ctrl.Result{}, nil
+	}
+	sd.Status.ControllerName = ""
+	// The controller claiming it at the same time wins: our patch then conflicts, and the retry finds it claimed
+	if err := r.Status().Patch(ctx, sd, client.MergeFromWithOptions(orig, client.MergeFromWithOptimisticLock{})); err != nil {
+		return ctrl.Result{}, fmt.Errorf("report unclaimed: %w", err)
+	}
+	if changed {
+		r.eventf(ctx, sd, nil, corev1.EventTypeWarning, "Unclaimed", "Claim", "No operator serves controllerName %q", sd.Spec.ControllerName)
+	}
+	return ctrl.Result{}, nil
+}
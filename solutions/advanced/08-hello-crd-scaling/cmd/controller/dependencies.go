@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	apiv1 "github.com/jayantasamaddar/quick-reference-kubernetes/solutions/hello-crd-scaling/api/v1"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// Field index on ServiceDeployments by the "namespace/name" of each dependency,
+// so a change to a ServiceDeployment can find its dependents.
+const dependsOnIndex = ".spec.dependsOn"
+
+var errDependencyCycle = errors.New("dependency cycle")
+
+func indexDependsOn(obj client.Object) []string {
+	sd, ok := obj.(*apiv1.ServiceDeployment)
+	if !ok {
+		return nil
+	}
+	keys := make([]string, 0, len(sd.Spec.DependsOn))
+	for _, d := range sd.Spec.DependsOn {
+		keys = append(keys, dependencyKey(sd, d).String())
+	}
+	return keys
+}
+
+func dependencyKey(sd *apiv1.ServiceDeployment, d apiv1.ServiceDeploymentDependency) types.NamespacedName {
+	ns := d.Namespace
+	if ns == "" {
+		ns = sd.Namespace
+	}
+	return types.NamespacedName{Namespace: ns, Name: d.Name}
+}
+
+// checkDependencies returns the dependencies of `sd` that are not Available yet (missing ones included).
+// If the dependency graph loops back to `sd`, it returns errDependencyCycle naming the path;
+// a dependency in a namespace the operator does not watch is an errOutOfScope error.
+func (r *reconciler) checkDependencies(ctx context.Context, sd *apiv1.ServiceDeployment) ([]string, error) {
+	for _, d := range sd.Spec.DependsOn {
+		if key := dependencyKey(sd, d); !r.scope.contains(key.Namespace) {
+			return nil, fmt.Errorf("dependency %s is %w (%s)", key, errOutOfScope, r.scope)
+		}
+	}
+	if err := r.detectCycle(ctx, sd); err != nil {
+		return nil, err
+	}
+
+	var waiting []string
+	for _, d := range sd.Spec.DependsOn {
+		key := dependencyKey(sd, d)
+		var dep apiv1.ServiceDeployment
+		if err := r.Get(ctx, key, &dep); err != nil {
+			if k8serrors.IsNotFound(err) {
+				waiting = append(waiting, key.String())
+				continue
+			}
+			return nil, err
+		}
+		if !meta.IsStatusConditionTrue(dep.Status.Conditions, apiv1.ConditionAvailable) {
+			waiting = append(waiting, key.String())
+		}
+	}
+	return waiting, nil
+}
+
+// detectCycle walks the dependency graph depth-first from `sd`. Dependencies that don't exist (yet) end the walk.
+func (r *reconciler) detectCycle(ctx context.Context, sd *apiv1.ServiceDeployment) error {
+	root := types.NamespacedName{Namespace: sd.Namespace, Name: sd.Name}
+	done := map[types.NamespacedName]bool{}
+
+	var visit func(current *apiv1.ServiceDeployment, path []string) error
+	visit = func(current *apiv1.ServiceDeployment, path []string) error {
+		for _, d := range current.Spec.DependsOn {
+			key := dependencyKey(current, d)
+			if key == root {
+				return fmt.Errorf("%w: %s", errDependencyCycle, strings.Join(append(path, key.String()), " -> "))
+			}
+			if done[key] || !r.scope.contains(key.Namespace) {
+				continue
+			}
+			done[key] = true
+
+			var next apiv1.ServiceDeployment
+			if err := r.Get(ctx, key, &next); err != nil {
+				if k8serrors.IsNotFound(err) {
+					continue
+				}
+				return err
+			}
+			// Full slice expression, so sibling branches never share (and overwrite) the same backing array
+			if err := visit(&next, append(path[:len(path):len(path)], key.String())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return visit(sd, []string{root.String()})
+}
+
+// dependenciesCondition builds the WaitingForDependencies condition from the result of checkDependencies.
+func dependenciesCondition(sd *apiv1.ServiceDeployment, waiting []string, err error) metav1.Condition {
+	cond := metav1.Condition{
+		Type:               apiv1.ConditionWaitingForDependencies,
+		ObservedGeneration: sd.Generation,
+	}
+	switch {
+	case errors.Is(err, errDependencyCycle):
+		cond.Status = metav1.ConditionTrue
+		cond.Reason = "DependencyCycle"
+		cond.Message = err.Error()
+	case errors.Is(err, errOutOfScope):
+		cond.Status = metav1.ConditionTrue
+		cond.Reason = "DependencyOutOfScope"
+		cond.Message = err.Error()
+	case len(waiting) > 0:
+		cond.Status = metav1.ConditionTrue
+		cond.Reason = "DependenciesNotAvailable"
+		cond.Message = fmt.Sprintf("Waiting for %s", strings.Join(waiting, ", "))
+	case len(sd.Spec.DependsOn) == 0:
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = "NoDependencies"
+	default:
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = "DependenciesAvailable"
+		cond.Message = "All dependencies are Available"
+	}
+	return cond
+}
+
+// mapDependencyToDependents enqueues the ServiceDeployments that depend on the changed one,
+// so that they are scaled up as soon as it becomes Available (and held again if it goes away).
+func (r *reconciler) mapDependencyToDependents(ctx context.Context, obj client.Object) []reconcile.Request {
+	key := types.NamespacedName{Namespace: obj.GetNamespace(), Name: obj.GetName()}
+
+	var dependents apiv1.ServiceDeploymentList
+	if err := r.List(ctx, &dependents, client.MatchingFields{dependsOnIndex: key.String()}); err != nil {
+		log.FromContext(ctx).Error(err, "failed to list dependents", "servicedeployment", key)
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(dependents.Items))
+	for _, sd := range dependents.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: sd.Namespace, Name: sd.Name}})
+	}
+	return requests
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	apiv1 "github.com/jayantasamaddar/quick-reference-kubernetes/solutions/hello-crd-scaling/api/v1"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+// dependent returns a ServiceDeployment in team-a depending on `deps`, "name" or "namespace/name" each.
+func dependent(name string, deps ...string) *apiv1.ServiceDeployment {
+	sd := newTestServiceDeployment("team-a", name)
+	for _, dep := range deps {
+		d := apiv1.ServiceDeploymentDependency{Name: dep}
+		if ns, name, ok := strings.Cut(dep, "/"); ok {
+			d = apiv1.ServiceDeploymentDependency{Namespace: ns, Name: name}
+		}
+		sd.Spec.DependsOn = append(sd.Spec.DependsOn, d)
+	}
+	return sd
+}
+
+func TestDetectCycle(t *testing.T) {
+	tests := []struct {
+		name string
+		sds  []*apiv1.ServiceDeployment // the first one is checked
+		want string                     // the path of the cycle, empty if there is none
+	}{
+		{
+			name: "no dependencies",
+			sds:  []*apiv1.ServiceDeployment{dependent("web")},
+		},
+		{
+			name: "self-dependency",
+			sds:  []*apiv1.ServiceDeployment{dependent("web", "web")},
+			want: "team-a/web -> team-a/web",
+		},
+		{
+			name: "2-node cycle",
+			sds:  []*apiv1.ServiceDeployment{dependent("web", "api"), dependent("api", "web")},
+			want: "team-a/web -> team-a/api -> team-a/web",
+		},
+		{
+			name: "longer cycle, across namespaces",
+			sds: []*apiv1.ServiceDeployment{
+				dependent("web", "api"),
+				dependent("api", "team-b/db"),
+				func() *apiv1.ServiceDeployment {
+					db := dependent("db", "team-a/web")
+					db.Namespace = "team-b"
+					return db
+				}(),
+			},
+			want: "team-a/web -> team-a/api -> team-b/db -> team-a/web",
+		},
+		{
+			name: "diamond",
+			sds: []*apiv1.ServiceDeployment{
+				dependent("web", "api", "auth"),
+				dependent("api", "db"),
+				dependent("auth", "db"),
+				dependent("db"),
+			},
+		},
+		{
+			name: "missing dependency",
+			sds:  []*apiv1.ServiceDeployment{dependent("web", "api"), dependent("api", "db")},
+		},
+		{
+			// Reported by those in the cycle, not by everything depending on it
+			name: "cycle further down",
+			sds:  []*apiv1.ServiceDeployment{dependent("web", "api"), dependent("api", "db"), dependent("db", "api")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objs := make([]client.Object, len(tt.sds))
+			for i, sd := range tt.sds {
+				objs[i] = sd
+			}
+			env := newTestEnv(t, interceptor.Funcs{}, objs...)
+
+			err := env.r.detectCycle(context.Background(), tt.sds[0])
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("got error %v, want none", err)
+				}
+				return
+			}
+			if !errors.Is(err, errDependencyCycle) || !strings.HasSuffix(err.Error(), ": "+tt.want) {
+				t.Errorf("got error %v, want the cycle %s", err, tt.want)
+			}
+		})
+	}
+}
+
+// TestDependencyCycleHoldsReplicas checks that a ServiceDeployment in a cycle gets a Deployment of 0 replicas.
+func TestDependencyCycleHoldsReplicas(t *testing.T) {
+	ctx := context.Background()
+	web, api := dependent("web", "api"), dependent("api", "web")
+	env := newTestEnv(t, interceptor.Funcs{}, web, api)
+	if _, err := env.reconcile(t, web); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+
+	var dep appsv1.Deployment
+	if err := env.client.Get(ctx, client.ObjectKeyFromObject(web), &dep); err != nil {
+		t.Fatal(err)
+	}
+	if got := ptr.Deref(dep.Spec.Replicas, -1); got != 0 {
+		t.Errorf("Deployment replicas: got %d, want 0", got)
+	}
+	if err := env.client.Get(ctx, client.ObjectKeyFromObject(web), web); err != nil {
+		t.Fatal(err)
+	}
+	cond := meta.FindStatusCondition(web.Status.Conditions, apiv1.ConditionWaitingForDependencies)
+	if cond == nil || cond.Status != metav1.ConditionTrue || cond.Reason != "DependencyCycle" {
+		t.Errorf("%s condition: got %+v, want True/DependencyCycle", apiv1.ConditionWaitingForDependencies, cond)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	apiv1 "github.com/jayantasamaddar/quick-reference-kubernetes/solutions/hello-crd-scaling/api/v1"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// deploymentGenerator renders the Deployment running the pods, named after the ServiceDeployment.
+// Its replica counts make up most of the status.
+type deploymentGenerator struct{}
+
+func (deploymentGenerator) kind() string {
+	return "Deployment"
+}
+
+func (deploymentGenerator) object() client.Object {
+	return &appsv1.Deployment{}
+}
+
+func (deploymentGenerator) name(sdName string) string {
+	return sdName
+}
+
+func (deploymentGenerator) render(obj client.Object, sd, effective *apiv1.ServiceDeployment, class *apiv1.ServiceDeploymentClass) {
+	renderDeployment(obj.(*appsv1.Deployment), sd, effective, class)
+}
+
+func (deploymentGenerator) fillStatus(dst *apiv1.ServiceDeploymentStatus, sd *apiv1.ServiceDeployment, obj client.Object) {
+	fillFromDeploymentStatus(dst, sd, obj.(*appsv1.Deployment))
+}
+
+func (deploymentGenerator) fillClusterStatus(dst *apiv1.ClusterStatus, obj client.Object) {
+	dep := obj.(*appsv1.Deployment)
+	dst.ReadyReplicas = dep.Status.ReadyReplicas
+	dst.AvailableReplicas = dep.Status.AvailableReplicas
+}
+
+func (deploymentGenerator) delete(ctx context.Context, kube kubernetes.Interface, namespace, name string, opts metav1.DeleteOptions) error {
+	return kube.AppsV1().Deployments(namespace).Delete(ctx, name, opts)
+}
+
+// The generation only changes with the spec, not with the status updates of a rollout.
+// Nor with the metadata, which childRevisions compares itself.
+func (deploymentGenerator) revision(obj client.Object) string {
+	return strconv.FormatInt(obj.GetGeneration(), 10)
+}
+
+func fillFromDeploymentStatus(dst *apiv1.ServiceDeploymentStatus, sd *apiv1.ServiceDeployment, dep *appsv1.Deployment) {
+	dst.DesiredReplicas = sd.Spec.Replicas
+	dst.ReadyReplicas = dep.Status.ReadyReplicas
+	dst.UpdatedReplicas = dep.Status.UpdatedReplicas
+	dst.AvailableReplicas = dep.Status.AvailableReplicas
+	dst.Ready = fmt.Sprintf("%d/%d", dep.Status.ReadyReplicas, sd.Spec.Replicas)
+
+	// Build the selector string for the scale subresource
+	if dep.Spec.Selector != nil {
+		if sel, err := metav1.LabelSelectorAsSelector(dep.Spec.Selector); err == nil {
+			dst.Selector = sel.String() // e.g. "app=nginx"
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	apiv1 "github.com/jayantasamaddar/quick-reference-kubernetes/solutions/hello-crd-scaling/api/v1"
+
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/events"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Event notes have a size limit (maxEventNote); the full diff is always in the log (and the report file)
+const maxDryRunEventDiff = 900
+
+// Dry-run mode: everything is reconciled as usual, but every write is sent with server-side dry run,
+// so admission and defaulting run while nothing is persisted. What would have changed is reported per object.
+type dryRunConfig struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// File the changes are appended to, one JSON object per line. If empty, they are recorded as Events
+	// on the owning ServiceDeployment instead (the only writes a dry run makes).
+	Report string `json:"report,omitempty"`
+}
+
+func (o *dryRunConfig) bindFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&o.Enabled, "dry-run", o.Enabled, "Send every write with server-side dry run and report what would change instead. Disables leader election.")
+	fs.StringVar(&o.Report, "dry-run-report", o.Report, "File the dry-run changes are appended to as JSON lines. Defaults to Events on the ServiceDeployments.")
+}
+
+func (o *dryRunConfig) validate() error {
+	if o.Report != "" && !o.Enabled {
+		return errors.New("  dryRun.report: only used with dryRun.enabled")
+	}
+	return nil
+}
+
+// Action of the DryRun Events, by operation
+var dryRunActions = map[string]string{"create": "Create", "update": "Update", "delete": "Delete"}
+
+// dryRunChange is one line of the report file.
+type dryRunChange struct {
+	Time      time.Time `json:"time"`
+	Cluster   string    `json:"cluster,omitempty"` // with `spec.placement`
+	Operation string    `json:"operation"`         // create, update or delete
+	Kind      string    `json:"kind"`
+	Namespace string    `json:"namespace,omitempty"`
+	Name      string    `json:"name"`
+	Owner     string    `json:"owner,omitempty"`
+	Diff      string    `json:"diff"`
+}
+
+type dryRunReporter struct {
+	mu       sync.Mutex
+	file     *os.File
+	recorder events.EventRecorder
+}
+
+func newDryRunReporter(cfg dryRunConfig, recorder events.EventRecorder) (*dryRunReporter, error) {
+	r := &dryRunReporter{recorder: recorder}
+	if cfg.Report != "" {
+		f, err := os.OpenFile(cfg.Report, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("open dry-run report: %w", err)
+		}
+		r.file = f
+	}
+	return r, nil
+}
+
+func (r *dryRunReporter) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Close()
+}
+
+// client wraps `c` so that its writes are dry-run and reported. `cluster` names a placement target, empty for the local cluster.
+func (r *dryRunReporter) client(c client.Client, cluster string) client.Client {
+	return &dryRunClient{Client: client.NewDryRunClient(c), reporter: r, cluster: cluster}
+}
+
+func (r *dryRunReporter) report(ctx context.Context, c client.Client, cluster, operation string, before, after client.Object) {
+	obj := after
+	if obj == nil {
+		obj = before
+	}
+	diff := cmp.Diff(diffable(before), diffable(after))
+	if diff == "" {
+		return
+	}
+	change := dryRunChange{
+		Time:      time.Now().UTC(),
+		Cluster:   cluster,
+		Operation: operation,
+		Namespace: obj.GetNamespace(),
+		Name:      obj.GetName(),
+		Diff:      diff,
+	}
+	if gvk, err := c.GroupVersionKindFor(obj); err == nil {
+		change.Kind = gvk.Kind
+	}
+	owner := changeOwner(c, obj)
+	if owner != nil {
+		change.Owner = fmt.Sprintf("%s %s", owner.GetObjectKind().GroupVersionKind().Kind, client.ObjectKeyFromObject(owner))
+	}
+	log.FromContext(ctx).Info("dry run: would "+operation, "cluster", cluster, "kind", change.Kind, "namespace", change.Namespace, "name", change.Name, "diff", diff)
+
+	if r.file != nil {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if err := json.NewEncoder(r.file).Encode(change); err != nil {
+			log.FromContext(ctx).Error(err, "failed to write dry-run report")
+		}
+		return
+	}
+	if owner != nil {
+		if len(diff) > maxDryRunEventDiff {
+			diff = diff[:maxDryRunEventDiff] + "\n(truncated)"
+		}
+		// The child is only related while it exists; a reference to an object that was never created would dangle
+		var related runtime.Object
+		if operation != "create" {
+			related = obj
+		}
+		r.recorder.Eventf(owner, related, corev1.EventTypeNormal, "DryRun", dryRunActions[operation], "Would %s %s %s:\n%s", operation, change.Kind, change.Name, diff)
+	}
+}
+
+// changeOwner returns the object a change is reported on: the controller owner of local children
+// (ServiceDeployment or ServiceDeploymentSet), the ServiceDeployment named by the labels of placed children.
+func changeOwner(c client.Client, obj client.Object) client.Object {
+	owner := &metav1.PartialObjectMetadata{}
+	if ref := metav1.GetControllerOf(obj); ref != nil {
+		owner.APIVersion, owner.Kind = ref.APIVersion, ref.Kind
+		owner.Name, owner.UID = ref.Name, ref.UID
+		// Owners are in the same namespace unless cluster-scoped (ServiceDeploymentSet)
+		if namespaced, err := c.IsObjectNamespaced(owner); err != nil || namespaced {
+			owner.Namespace = obj.GetNamespace()
+		}
+		return owner
+	}
+	if name := obj.GetLabels()[placedByNameLabel]; name != "" {
+		owner.APIVersion, owner.Kind = apiv1.SchemeGroupVersion.String(), apiv1.Kind
+		owner.Name, owner.Namespace = name, obj.GetLabels()[placedByNamespaceLabel]
+		return owner
+	}
+	if sd, ok := obj.(*apiv1.ServiceDeployment); ok {
+		owner.APIVersion, owner.Kind = apiv1.SchemeGroupVersion.String(), apiv1.Kind
+		owner.Name, owner.Namespace, owner.UID = sd.Name, sd.Namespace, sd.UID
+		return owner
+	}
+	return nil
+}
+
+// diffable converts `obj` to a map without the fields that change on every write or that we don't set.
+func diffable(obj client.Object) map[string]interface{} {
+	if obj == nil {
+		return nil
+	}
+	m, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil
+	}
+	delete(m, "status")
+	if md, ok := m["metadata"].(map[string]interface{}); ok {
+		for _, f := range []string{"managedFields", "resourceVersion", "generation", "creationTimestamp", "uid"} {
+			delete(md, f)
+		}
+	}
+	return m
+}
+
+// dryRunClient sends every write with `dryRun=All` and reports the difference between the live object
+// and the one the API server returned.
+type dryRunClient struct {
+	client.Client
+	reporter *dryRunReporter
+	cluster  string
+}
+
+func (c *dryRunClient) live(ctx context.Context, obj client.Object) client.Object {
+	before := obj.DeepCopyObject().(client.Object)
+	if err := c.Get(ctx, client.ObjectKeyFromObject(obj), before); err != nil {
+		return nil
+	}
+	return before
+}
+
+func (c *dryRunClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if err := c.Client.Create(ctx, obj, opts...); err != nil {
+		return err
+	}
+	c.reporter.report(ctx, c.Client, c.cluster, "create", nil, obj)
+	return nil
+}
+
+func (c *dryRunClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	before := c.live(ctx, obj)
+	if err := c.Client.Update(ctx, obj, opts...); err != nil {
+		return err
+	}
+	c.reporter.report(ctx, c.Client, c.cluster, "update", before, obj)
+	return nil
+}
+
+func (c *dryRunClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	before := c.live(ctx, obj)
+	if err := c.Client.Patch(ctx, obj, patch, opts...); err != nil {
+		return err
+	}
+	c.reporter.report(ctx, c.Client, c.cluster, "update", before, obj)
+	return nil
+}
+
+func (c *dryRunClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	before := c.live(ctx, obj)
+	if err := c.Client.Delete(ctx, obj, opts...); err != nil {
+		return err
+	}
+	if before != nil {
+		c.reporter.report(ctx, c.Client, c.cluster, "delete", before, nil)
+	}
+	return nil
+}
+
+// dryRunRecorder marks the regular Events of a dry run, which describe what would have happened.
+// With a report file nothing at all is written to the cluster, so they are dropped.
+type dryRunRecorder struct {
+	events.EventRecorder
+	discard bool
+}
+
+func (r dryRunRecorder) Eventf(regarding, related runtime.Object, eventtype, reason, action, note string, args ...interface{}) {
+	if !r.discard {
+		r.EventRecorder.Eventf(regarding, related, eventtype, reason, action, "%s", truncateNote("[dry-run] "+fmt.Sprintf(note, args...)))
+	}
+}
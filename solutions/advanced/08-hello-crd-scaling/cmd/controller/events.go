@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/time/rate"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/events"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// The API server rejects events.k8s.io/v1 Events with a longer note
+const maxEventNote = 1024
+
+// Events are recorded through the events.k8s.io/v1 API. Its broadcaster already aggregates repeated Events
+// (same object, related object, type, reason and action) into a series, counted on a single Event.
+// On top of that every object and reason gets a token bucket, so a flapping child can't flood the API server.
+type eventsConfig struct {
+	// Events allowed at once for each object and reason...
+	Burst int `json:"burst,omitempty"`
+	// ...then one more per interval. 0 disables rate limiting.
+	Interval metav1.Duration `json:"interval,omitzero"`
+	// Also send every Event to: audit (the audit log) and/or metrics (servicedeployment_events_total)
+	Mirror []string `json:"mirror,omitempty"`
+}
+
+func (o *eventsConfig) bindFlags(fs *flag.FlagSet) {
+	fs.IntVar(&o.Burst, "event-burst", o.Burst, "Events allowed at once for each object and reason.")
+	fs.DurationVar(&o.Interval.Duration, "event-interval", o.Interval.Duration, "After the burst, at most one Event per object and reason per interval. 0 disables rate limiting.")
+	fs.Var((*stringList)(&o.Mirror), "event-mirror", "Comma-separated pipelines every Event is also sent to: audit, metrics.")
+}
+
+func (o *eventsConfig) validate() error {
+	var errs []error
+	if o.Interval.Duration < 0 {
+		errs = append(errs, fmt.Errorf("  events.interval: must not be negative, got %v", o.Interval.Duration))
+	}
+	if o.Interval.Duration > 0 && o.Burst < 1 {
+		errs = append(errs, fmt.Errorf("  events.burst: must be at least 1, got %d", o.Burst))
+	}
+	for _, m := range o.Mirror {
+		if m != "audit" && m != "metrics" {
+			errs = append(errs, fmt.Errorf("  events.mirror: %q: must be audit or metrics", m))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// eventSender sends the recorded Events to the API server while the manager runs. Not leader elected, so it stops at
+// the very start of the manager's shutdown: Events recorded by the reconciles still finishing are dropped, and none is
+// written once the leader election Lease is released.
+type eventSender struct{ events.EventBroadcaster }
+
+func (s eventSender) NeedLeaderElection() bool { return false }
+
+func (s eventSender) Start(ctx context.Context) error {
+	if err := s.StartRecordingToSinkWithContext(ctx); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	s.Shutdown()
+	return nil
+}
+
+// eventRecorder is what the reconcilers record Events with: filtered by the OperatorConfig's `eventVerbosity`, rate limited,
+// then sent to `recorder` and the mirrors.
+type eventRecorder struct {
+	recorder events.EventRecorder
+	scheme   *runtime.Scheme
+	live     *liveConfig
+	limiter  *eventLimiter // nil without rate limiting
+	audit    *auditLog     // with `mirror: [audit]`
+	metrics  bool          // with `mirror: [metrics]`
+}
+
+func newEventRecorder(cfg eventsConfig, recorder events.EventRecorder, scheme *runtime.Scheme, audit *auditLog, live *liveConfig) *eventRecorder {
+	r := &eventRecorder{recorder: recorder, scheme: scheme, live: live, metrics: slices.Contains(cfg.Mirror, "metrics")}
+	if cfg.Interval.Duration > 0 {
+		r.limiter = newEventLimiter(cfg.Burst, cfg.Interval.Duration)
+	}
+	if slices.Contains(cfg.Mirror, "audit") {
+		r.audit = audit
+	}
+	return r
+}
+
+// eventf records an Event about `regarding`. `related` is the other object involved, usually a child; it may be nil.
+// `action` says what the operator did or failed to do, e.g. Create or Apply.
+func (r *eventRecorder) eventf(ctx context.Context, regarding, related client.Object, eventtype, reason, action, noteFmt string, args ...interface{}) {
+	if !r.live.load().records(eventtype) {
+		return
+	}
+	if !r.limiter.allow(regarding, reason) {
+		eventsThrottled.WithLabelValues(reason).Inc()
+		log.FromContext(ctx).V(1).Info("event throttled", "reason", reason, "object", client.ObjectKeyFromObject(regarding))
+		return
+	}
+	note := truncateNote(fmt.Sprintf(noteFmt, args...))
+	var rel runtime.Object
+	if related != nil {
+		rel = related
+	}
+	r.recorder.Eventf(regarding, rel, eventtype, reason, action, "%s", note)
+
+	if r.metrics {
+		eventsRecorded.WithLabelValues(eventtype, reason).Inc()
+	}
+	if r.audit != nil {
+		rec := auditRecord{
+			Operation: "event",
+			Namespace: regarding.GetNamespace(),
+			Name:      regarding.GetName(),
+			Event:     &auditEvent{Type: eventtype, Reason: reason, Action: action, Note: note},
+		}
+		if gvk, err := apiutil.GVKForObject(regarding, r.scheme); err == nil {
+			rec.Kind = gvk.Kind
+		}
+		if related != nil {
+			rec.Event.Related = objectRef(related.GetNamespace(), related.GetName())
+			if gvk, err := apiutil.GVKForObject(related, r.scheme); err == nil {
+				rec.Event.Related = gvk.Kind + " " + rec.Event.Related
+			}
+		}
+		r.audit.write(ctx, rec)
+	}
+}
+
+// truncateNote cuts `note` to the length the API server accepts, on a character boundary.
+func truncateNote(note string) string {
+	const suffix = " (truncated)"
+	if len(note) <= maxEventNote {
+		return note
+	}
+	cut := maxEventNote - len(suffix)
+	for cut > 0 && !utf8.RuneStart(note[cut]) {
+		cut--
+	}
+	return note[:cut] + suffix
+}
+
+type eventLimiterKey struct {
+	uid             types.UID
+	namespace, name string
+	reason          string
+}
+
+type eventLimiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// eventLimiter is a token bucket per object and reason. Buckets unused long enough to be full again are dropped.
+type eventLimiter struct {
+	mu        sync.Mutex
+	burst     int
+	interval  time.Duration
+	buckets   map[eventLimiterKey]*eventLimiterEntry
+	lastSweep time.Time
+}
+
+func newEventLimiter(burst int, interval time.Duration) *eventLimiter {
+	return &eventLimiter{burst: burst, interval: interval, buckets: map[eventLimiterKey]*eventLimiterEntry{}}
+}
+
+// allow reports whether an Event about `obj` with `reason` may be recorded now. Always true on a nil limiter.
+func (l *eventLimiter) allow(obj client.Object, reason string) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	idle := time.Duration(l.burst) * l.interval
+	if now.Sub(l.lastSweep) > idle {
+		for key, entry := range l.buckets {
+			if now.Sub(entry.lastSeen) > idle {
+				delete(l.buckets, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	key := eventLimiterKey{uid: obj.GetUID(), namespace: obj.GetNamespace(), name: obj.GetName(), reason: reason}
+	entry, ok := l.buckets[key]
+	if !ok {
+		entry = &eventLimiterEntry{limiter: rate.NewLimiter(rate.Every(l.interval), l.burst)}
+		l.buckets[key] = entry
+	}
+	entry.lastSeen = now
+	return entry.limiter.AllowN(now, 1)
+}
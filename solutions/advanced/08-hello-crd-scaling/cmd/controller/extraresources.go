@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	apiv1 "github.com/jayantasamaddar/quick-reference-kubernetes/solutions/hello-crd-scaling/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// Extra resources (`spec.extraResources`) are objects of any namespaced kind the OperatorConfig allows, applied next to
+// the children with the ServiceDeployment as controller owner. Their types aren't known here: they are handled as
+// unstructured objects, which the client reads and writes through the dynamic client and the RESTMapper, bypassing the
+// cache (so no informer is started per kind). Nothing watches them; a changed one is corrected on the next reconcile.
+
+// Field manager of the server-side applies of extra resources
+const extraResourceFieldOwner = "servicedeployments-operator"
+
+// extraResourceKey identifies an extra resource independently of the version of its kind.
+type extraResourceKey struct {
+	group, kind, name string
+}
+
+func extraResourceKeyOf(st apiv1.ExtraResourceStatus) extraResourceKey {
+	gv, _ := schema.ParseGroupVersion(st.APIVersion)
+	return extraResourceKey{gv.Group, st.Kind, st.Name}
+}
+
+// applyExtraResources applies `spec.extraResources` and deletes the extra resources applied before that are no longer listed.
+// It returns the status of each; the error joins the failures worth retrying.
+func (r *reconciler) applyExtraResources(ctx context.Context, sd *apiv1.ServiceDeployment, live *liveSettings, unchanged bool) (statuses []apiv1.ExtraResourceStatus, err error) {
+	ctx, span := tracer.Start(ctx, "ApplyExtraResources")
+	defer func() { endSpan(span, err) }()
+
+	var errs []error
+	listed := make(map[extraResourceKey]bool, len(sd.Spec.ExtraResources))
+	for i, raw := range sd.Spec.ExtraResources {
+		obj, invalid := decodeExtraResource(raw, sd.Namespace)
+		st := apiv1.ExtraResourceStatus{APIVersion: obj.GetAPIVersion(), Kind: obj.GetKind(), Name: obj.GetName()}
+		key := extraResourceKeyOf(st)
+		if invalid == nil && listed[key] {
+			invalid = errors.New("listed more than once")
+		}
+		if invalid != nil {
+			st.State, st.Message = apiv1.ExtraResourceInvalid, fmt.Sprintf("spec.extraResources[%d]: %v", i, invalid)
+			r.eventf(ctx, sd, nil, corev1.EventTypeWarning, "InvalidExtraResource", "Apply", "%s", st.Message)
+			statuses = append(statuses, st)
+			continue
+		}
+		listed[key] = true
+		if err := r.applyExtraResource(ctx, sd, obj, live, unchanged, &st); err != nil {
+			errs = append(errs, fmt.Errorf("apply %s %q: %w", st.Kind, st.Name, err))
+		}
+		statuses = append(statuses, st)
+	}
+
+	for _, st := range sd.Status.ExtraResources {
+		if st.Name == "" || listed[extraResourceKeyOf(st)] {
+			continue
+		}
+		if err := r.pruneExtraResource(ctx, sd, st); err != nil {
+			// Stays in the status until deleted, so the next reconcile tries again
+			st.State, st.Message = apiv1.ExtraResourceFailed, fmt.Sprintf("delete: %v", err)
+			statuses = append(statuses, st)
+			errs = append(errs, fmt.Errorf("delete %s %q: %w", st.Kind, st.Name, err))
+		}
+	}
+	return statuses, errors.Join(errs...)
+}
+
+// decodeExtraResource reads a manifest of `spec.extraResources` into an object in `namespace`.
+// The object is never nil, so that even an invalid manifest can be told apart in the status by what could be read.
+func decodeExtraResource(raw runtime.RawExtension, namespace string) (*unstructured.Unstructured, error) {
+	obj := &unstructured.Unstructured{}
+	if len(raw.Raw) == 0 {
+		return obj, errors.New("empty manifest")
+	}
+	if err := obj.UnmarshalJSON(raw.Raw); err != nil {
+		return obj, err
+	}
+	switch {
+	case obj.GetAPIVersion() == "":
+		return obj, errors.New("apiVersion: must not be empty")
+	case obj.GetName() == "":
+		return obj, errors.New("metadata.name: must not be empty")
+	case obj.GetNamespace() != "" && obj.GetNamespace() != namespace:
+		return obj, fmt.Errorf("metadata.namespace: must be the namespace of the ServiceDeployment (%q), got %q", namespace, obj.GetNamespace())
+	}
+	obj.SetNamespace(namespace)
+	// Server-side apply refuses these, and they mean nothing in a manifest anyway
+	obj.SetResourceVersion("")
+	obj.SetManagedFields(nil)
+	unstructured.RemoveNestedField(obj.Object, "status")
+	return obj, nil
+}
+
+// applyExtraResource applies `obj` unless its kind isn't allowed, recording the outcome in `st`.
+// Errors are returned for the failures worth retrying, and for a resource controlled by someone else.
+func (r *reconciler) applyExtraResource(ctx context.Context, sd *apiv1.ServiceDeployment, obj *unstructured.Unstructured, live *liveSettings, unchanged bool, st *apiv1.ExtraResourceStatus) error {
+	gvk := obj.GroupVersionKind()
+	kind := gvk.Kind
+	if !live.allowsExtraResource(gvk) {
+		st.State, st.Message = apiv1.ExtraResourceNotAllowed, fmt.Sprintf("%s is not in the allowedExtraResources of the OperatorConfig", gvk.GroupKind())
+		r.eventf(ctx, sd, nil, corev1.EventTypeWarning, "ExtraResourceNotAllowed", "Apply", "%s %q: %s", kind, obj.GetName(), st.Message)
+		return nil
+	}
+	mapping, err := r.RESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		st.State, st.Message = apiv1.ExtraResourceFailed, err.Error()
+		if meta.IsNoMatchError(err) {
+			// Its CRD may not be installed yet
+			return waitingError("ExtraResourceKindNotFound", err)
+		}
+		return err
+	}
+	if mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+		st.State, st.Message = apiv1.ExtraResourceInvalid, fmt.Sprintf("%s is cluster-scoped, it can't be owned by a ServiceDeployment", gvk.GroupKind())
+		r.eventf(ctx, sd, nil, corev1.EventTypeWarning, "InvalidExtraResource", "Apply", "%s %q: %s", kind, obj.GetName(), st.Message)
+		return nil
+	}
+
+	existing := &unstructured.Unstructured{}
+	existing.SetGroupVersionKind(gvk)
+	if err := r.Get(ctx, client.ObjectKeyFromObject(obj), existing); err != nil {
+		if !k8serrors.IsNotFound(err) {
+			st.State, st.Message = apiv1.ExtraResourceFailed, err.Error()
+			return err
+		}
+		existing = nil
+	}
+	if existing != nil {
+		if owner := metav1.GetControllerOf(existing); owner != nil && owner.UID != sd.UID {
+			err := &controllerutil.AlreadyOwnedError{Object: existing, Owner: *owner}
+			st.State, st.Message = apiv1.ExtraResourceInvalid, err.Error()
+			r.eventf(ctx, sd, existing, corev1.EventTypeWarning, "Apply"+kind+"Failed", "Apply", "Failed to apply %s %q: %v", kind, obj.GetName(), err)
+			return err
+		}
+		// Nothing it is rendered from changed, and it still has every field of its manifest: spare the API server a write
+		if unchanged && metav1.IsControlledBy(existing, sd) && hasFields(existing.Object, obj.Object) {
+			st.State = apiv1.ExtraResourceApplied
+			return nil
+		}
+		if unchanged && live.DriftPolicy == apiv1.DriftPolicyReport {
+			st.State, st.Message = apiv1.ExtraResourceDrifted, "changed outside the operator; not corrected (driftPolicy: Report)"
+			r.eventf(ctx, sd, existing, corev1.EventTypeWarning, "DriftDetected", "Apply", "%s %q was changed outside the operator; not correcting it (driftPolicy: Report)", kind, obj.GetName())
+			return nil
+		}
+	}
+
+	if err := controllerutil.SetControllerReference(sd, obj, r.scheme); err != nil {
+		st.State, st.Message = apiv1.ExtraResourceInvalid, err.Error()
+		r.eventf(ctx, sd, nil, corev1.EventTypeWarning, "InvalidExtraResource", "Apply", "%s %q: %v", kind, obj.GetName(), err)
+		return nil
+	}
+	patchCtx, span := tracer.Start(ctx, "Apply "+kind)
+	err = r.Patch(patchCtx, obj, client.Apply, client.FieldOwner(extraResourceFieldOwner), client.ForceOwnership)
+	endSpan(span, err)
+	if err != nil {
+		st.State, st.Message = apiv1.ExtraResourceFailed, err.Error()
+		// Same treatment as the children's (see applyChild)
+		if k8serrors.IsConflict(err) {
+			conflictRequeues.WithLabelValues(kind).Inc()
+		} else {
+			r.eventf(ctx, sd, existing, corev1.EventTypeWarning, "Apply"+kind+"Failed", "Apply", "Failed to apply %s %q: %v", kind, obj.GetName(), err)
+			recordApplyFailure(kind, err)
+		}
+		return err
+	}
+	st.State = apiv1.ExtraResourceApplied
+	switch {
+	case existing == nil:
+		r.eventf(ctx, sd, obj, corev1.EventTypeNormal, kind+"Created", "Create", "Created %s %q", kind, obj.GetName())
+	case obj.GetResourceVersion() != existing.GetResourceVersion():
+		r.eventf(ctx, sd, obj, corev1.EventTypeNormal, kind+"Updated", "Update", "Updated %s %q", kind, obj.GetName())
+		// Nothing it is rendered from changed: it was changed outside the operator
+		if unchanged {
+			driftCorrections.WithLabelValues(kind).Inc()
+		}
+	}
+	return nil
+}
+
+// pruneExtraResource deletes the extra resource of `st`, which is no longer listed in `spec.extraResources`.
+// Resources that are gone, or no longer controlled by `sd`, are left alone.
+func (r *reconciler) pruneExtraResource(ctx context.Context, sd *apiv1.ServiceDeployment, st apiv1.ExtraResourceStatus) error {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(st.APIVersion)
+	obj.SetKind(st.Kind)
+	err := r.Get(ctx, types.NamespacedName{Namespace: sd.Namespace, Name: st.Name}, obj)
+	if k8serrors.IsNotFound(err) || meta.IsNoMatchError(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !metav1.IsControlledBy(obj, sd) {
+		return nil
+	}
+	uid := obj.GetUID()
+	if err := r.Delete(ctx, obj, client.Preconditions{UID: &uid}); client.IgnoreNotFound(err) != nil {
+		return err
+	}
+	r.eventf(ctx, sd, nil, corev1.EventTypeNormal, st.Kind+"Deleted", "Delete", "Deleted %s %q, no longer in spec.extraResources", st.Kind, st.Name)
+	return nil
+}
+
+// hasFields reports whether `obj` has every field of `manifest` with the same value.
+// Fields only `obj` has, e.g. defaulted ones, don't matter; list items are compared the same way, by position.
+func hasFields(obj, manifest interface{}) bool {
+	switch want := manifest.(type) {
+	case map[string]interface{}:
+		got, ok := obj.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for k, v := range want {
+			if !hasFields(got[k], v) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		got, ok := obj.([]interface{})
+		if !ok || len(got) != len(want) {
+			return false
+		}
+		for i := range want {
+			if !hasFields(got[i], want[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(obj, manifest)
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"strings"
+	"testing"
+
+	apiv1 "github.com/jayantasamaddar/quick-reference-kubernetes/solutions/hello-crd-scaling/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// serverSideApply stands in for the server-side applies the fake client refuses: the applied object replaces the existing one.
+var serverSideApply = interceptor.Funcs{
+	Patch: func(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+		applied, ok := obj.(*unstructured.Unstructured)
+		if !ok || patch.Type() != types.ApplyPatchType {
+			return c.Patch(ctx, obj, patch, opts...)
+		}
+		existing := &unstructured.Unstructured{}
+		existing.SetGroupVersionKind(applied.GroupVersionKind())
+		if err := c.Get(ctx, client.ObjectKeyFromObject(applied), existing); err != nil {
+			if !k8serrors.IsNotFound(err) {
+				return err
+			}
+			return c.Create(ctx, applied)
+		}
+		applied.SetUID(existing.GetUID())
+		applied.SetResourceVersion(existing.GetResourceVersion())
+		return c.Update(ctx, applied)
+	},
+}
+
+// configMapManifest returns a manifest of `spec.extraResources`: a ConfigMap with `data`, in the namespace of its
+// ServiceDeployment unless `namespace` is set.
+func configMapManifest(t *testing.T, namespace, name string, data map[string]string) runtime.RawExtension {
+	t.Helper()
+	cm := &corev1.ConfigMap{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Data:       data,
+	}
+	raw, err := json.Marshal(cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return runtime.RawExtension{Raw: raw}
+}
+
+// allowingConfigMaps returns the settings of `env` with ConfigMaps allowed as extra resources.
+func allowingConfigMaps(env *testEnv) *liveSettings {
+	live := *env.r.live.load()
+	live.AllowedExtraResources = []metav1.GroupVersionKind{{Version: "v1", Kind: "ConfigMap"}}
+	return &live
+}
+
+// ownedConfigMap returns a ConfigMap in the namespace of `sd` controlled by the object of UID `owner`.
+func ownedConfigMap(sd *apiv1.ServiceDeployment, name string, owner types.UID) *corev1.ConfigMap {
+	return &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+		Namespace:       sd.Namespace,
+		Name:            name,
+		UID:             types.UID("uid-cm-" + name),
+		OwnerReferences: []metav1.OwnerReference{{APIVersion: "v1", Kind: "Secret", Name: "other", UID: owner, Controller: ptr.To(true)}},
+	}}
+}
+
+func extraResourceStates(statuses []apiv1.ExtraResourceStatus) map[string]apiv1.ExtraResourceState {
+	states := make(map[string]apiv1.ExtraResourceState, len(statuses))
+	for _, st := range statuses {
+		states[st.Kind+"/"+st.Name] = st.State
+	}
+	return states
+}
+
+// TestExtraResourcesPrune applies two extra resources, then deletes the one no longer listed.
+func TestExtraResourcesPrune(t *testing.T) {
+	ctx := context.Background()
+	sd := newTestServiceDeployment("team-a", "web")
+	env := newTestEnv(t, serverSideApply, sd)
+	live := allowingConfigMaps(env)
+
+	sd.Spec.ExtraResources = []runtime.RawExtension{
+		configMapManifest(t, "", "settings", map[string]string{"mode": "fast"}),
+		configMapManifest(t, "team-a", "legacy", nil),
+	}
+	statuses, err := env.r.applyExtraResources(ctx, sd, live, false)
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if got, want := extraResourceStates(statuses), map[string]apiv1.ExtraResourceState{"ConfigMap/settings": apiv1.ExtraResourceApplied, "ConfigMap/legacy": apiv1.ExtraResourceApplied}; !maps.Equal(got, want) {
+		t.Fatalf("states: got %v, want %v", got, want)
+	}
+	var settings corev1.ConfigMap
+	if err := env.client.Get(ctx, types.NamespacedName{Namespace: "team-a", Name: "settings"}, &settings); err != nil {
+		t.Fatal(err)
+	}
+	if !metav1.IsControlledBy(&settings, sd) || settings.Data["mode"] != "fast" {
+		t.Errorf("ConfigMap settings: got owners %v, data %v; want controlled by the ServiceDeployment, mode fast", settings.OwnerReferences, settings.Data)
+	}
+
+	// legacy is no longer listed
+	sd.Status.ExtraResources = statuses
+	sd.Spec.ExtraResources = sd.Spec.ExtraResources[:1]
+	statuses, err = env.r.applyExtraResources(ctx, sd, live, false)
+	if err != nil {
+		t.Fatalf("apply without legacy: %v", err)
+	}
+	if got, want := extraResourceStates(statuses), map[string]apiv1.ExtraResourceState{"ConfigMap/settings": apiv1.ExtraResourceApplied}; !maps.Equal(got, want) {
+		t.Errorf("states: got %v, want %v", got, want)
+	}
+	if err := env.client.Get(ctx, types.NamespacedName{Namespace: "team-a", Name: "legacy"}, &corev1.ConfigMap{}); !k8serrors.IsNotFound(err) {
+		t.Errorf("ConfigMap legacy: got %v, want it deleted", err)
+	}
+	if !hasEvent(env, "Normal ConfigMapDeleted ") {
+		t.Error("no ConfigMapDeleted Event")
+	}
+
+	// Already gone: nothing left to prune
+	sd.Status.ExtraResources = append(statuses, apiv1.ExtraResourceStatus{APIVersion: "v1", Kind: "ConfigMap", Name: "legacy", State: apiv1.ExtraResourceApplied})
+	if _, err := env.r.applyExtraResources(ctx, sd, live, false); err != nil {
+		t.Errorf("prune of a deleted resource: %v", err)
+	}
+}
+
+// TestExtraResourcesOwnedByOther checks that an extra resource controlled by another owner is neither applied nor pruned.
+func TestExtraResourcesOwnedByOther(t *testing.T) {
+	ctx := context.Background()
+	sd := newTestServiceDeployment("team-a", "web")
+	listed, former := ownedConfigMap(sd, "shared", "uid-other"), ownedConfigMap(sd, "former", "uid-other")
+	env := newTestEnv(t, serverSideApply, sd, listed, former)
+
+	sd.Spec.ExtraResources = []runtime.RawExtension{configMapManifest(t, "", "shared", map[string]string{"mode": "fast"})}
+	// former was ours once, then taken over
+	sd.Status.ExtraResources = []apiv1.ExtraResourceStatus{{APIVersion: "v1", Kind: "ConfigMap", Name: "former", State: apiv1.ExtraResourceApplied}}
+	statuses, err := env.r.applyExtraResources(ctx, sd, allowingConfigMaps(env), false)
+	if alreadyOwned := (*controllerutil.AlreadyOwnedError)(nil); !errors.As(err, &alreadyOwned) {
+		t.Errorf("got error %v, want an AlreadyOwnedError", err)
+	}
+	if got, want := extraResourceStates(statuses), map[string]apiv1.ExtraResourceState{"ConfigMap/shared": apiv1.ExtraResourceInvalid}; !maps.Equal(got, want) {
+		t.Errorf("states: got %v, want %v", got, want)
+	}
+	for _, cm := range []*corev1.ConfigMap{listed, former} {
+		var got corev1.ConfigMap
+		if err := env.client.Get(ctx, client.ObjectKeyFromObject(cm), &got); err != nil {
+			t.Fatalf("ConfigMap %s: %v", cm.Name, err)
+		}
+		if got.Data != nil || !metav1.IsControlledBy(&got, &corev1.Secret{ObjectMeta: metav1.ObjectMeta{UID: "uid-other"}}) {
+			t.Errorf("ConfigMap %s was changed: owners %v, data %v", cm.Name, got.OwnerReferences, got.Data)
+		}
+	}
+	if writes := env.takeWrites(); len(writes) != 0 {
+		t.Errorf("writes: got %v, want none", writes)
+	}
+}
+
+func TestExtraResourcesInvalid(t *testing.T) {
+	secret := runtime.RawExtension{Raw: []byte(`{"apiVersion":"v1","kind":"Secret","metadata":{"name":"token"}}`)}
+	tests := []struct {
+		name      string
+		manifests func(t *testing.T) []runtime.RawExtension
+		want      map[string]apiv1.ExtraResourceState
+		wantMsg   string // in the message of the last status
+	}{
+		{
+			name: "listed more than once",
+			manifests: func(t *testing.T) []runtime.RawExtension {
+				return []runtime.RawExtension{configMapManifest(t, "", "settings", nil), configMapManifest(t, "team-a", "settings", map[string]string{"mode": "slow"})}
+			},
+			// The first one is applied
+			want:    map[string]apiv1.ExtraResourceState{"ConfigMap/settings": apiv1.ExtraResourceInvalid},
+			wantMsg: "spec.extraResources[1]: listed more than once",
+		},
+		{
+			name: "other namespace",
+			manifests: func(t *testing.T) []runtime.RawExtension {
+				return []runtime.RawExtension{configMapManifest(t, "team-b", "settings", nil)}
+			},
+			want:    map[string]apiv1.ExtraResourceState{"ConfigMap/settings": apiv1.ExtraResourceInvalid},
+			wantMsg: `spec.extraResources[0]: metadata.namespace: must be the namespace of the ServiceDeployment ("team-a"), got "team-b"`,
+		},
+		{
+			name: "no name",
+			manifests: func(t *testing.T) []runtime.RawExtension {
+				return []runtime.RawExtension{configMapManifest(t, "", "", nil)}
+			},
+			want:    map[string]apiv1.ExtraResourceState{"ConfigMap/": apiv1.ExtraResourceInvalid},
+			wantMsg: "metadata.name: must not be empty",
+		},
+		{
+			name:      "kind not allowed",
+			manifests: func(*testing.T) []runtime.RawExtension { return []runtime.RawExtension{secret} },
+			want:      map[string]apiv1.ExtraResourceState{"Secret/token": apiv1.ExtraResourceNotAllowed},
+			wantMsg:   "Secret is not in the allowedExtraResources of the OperatorConfig",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sd := newTestServiceDeployment("team-a", "web")
+			env := newTestEnv(t, serverSideApply, sd)
+			sd.Spec.ExtraResources = tt.manifests(t)
+
+			statuses, err := env.r.applyExtraResources(context.Background(), sd, allowingConfigMaps(env), false)
+			if err != nil {
+				t.Errorf("got error %v, want none: retrying doesn't help", err)
+			}
+			if got := extraResourceStates(statuses[len(statuses)-1:]); !maps.Equal(got, tt.want) {
+				t.Errorf("state: got %v, want %v", got, tt.want)
+			}
+			if msg := statuses[len(statuses)-1].Message; !strings.Contains(msg, tt.wantMsg) {
+				t.Errorf("message: got %q, want %q", msg, tt.wantMsg)
+			}
+			if writes := env.takeWrites(); len(writes) > len(statuses)-1 {
+				t.Errorf("writes: got %v, want only the valid resources", writes)
+			}
+			if !hasEvent(env, "Warning ") {
+				t.Error("no Warning Event")
+			}
+		})
+	}
+}
+
+// TestExtraResourcesUnchanged checks that an unchanged extra resource isn't written again, unless a field of its manifest was changed.
+func TestExtraResourcesUnchanged(t *testing.T) {
+	ctx := context.Background()
+	sd := newTestServiceDeployment("team-a", "web")
+	env := newTestEnv(t, serverSideApply, sd)
+	live := allowingConfigMaps(env)
+	sd.Spec.ExtraResources = []runtime.RawExtension{configMapManifest(t, "", "settings", map[string]string{"mode": "fast"})}
+	if _, err := env.r.applyExtraResources(ctx, sd, live, false); err != nil {
+		t.Fatal(err)
+	}
+	env.takeWrites()
+
+	if _, err := env.r.applyExtraResources(ctx, sd, live, true); err != nil {
+		t.Fatal(err)
+	}
+	if writes := env.takeWrites(); len(writes) != 0 {
+		t.Errorf("writes: got %v, want none", writes)
+	}
+
+	// Changed outside the operator, a key added by someone else doesn't count
+	var cm corev1.ConfigMap
+	if err := env.client.Get(ctx, types.NamespacedName{Namespace: "team-a", Name: "settings"}, &cm); err != nil {
+		t.Fatal(err)
+	}
+	cm.Data = map[string]string{"mode": "slow", "extra": "1"}
+	if err := env.client.Update(ctx, &cm); err != nil {
+		t.Fatal(err)
+	}
+	configMaps := map[string]string{"kind": "ConfigMap"}
+	before := metricValue(t, "servicedeployment_drift_corrections_total", configMaps)
+	if _, err := env.r.applyExtraResources(ctx, sd, live, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.client.Get(ctx, client.ObjectKeyFromObject(&cm), &cm); err != nil {
+		t.Fatal(err)
+	}
+	if cm.Data["mode"] != "fast" {
+		t.Errorf("data: got %v, want mode corrected to fast", cm.Data)
+	}
+	if got := metricValue(t, "servicedeployment_drift_corrections_total", configMaps) - before; got != 1 {
+		t.Errorf("ConfigMap drift corrections: got %v, want 1", got)
+	}
+
+	// Updated because its manifest changed: not a drift
+	sd.Spec.ExtraResources = []runtime.RawExtension{configMapManifest(t, "", "settings", map[string]string{"mode": "slow"})}
+	before = metricValue(t, "servicedeployment_drift_corrections_total", configMaps)
+	if _, err := env.r.applyExtraResources(ctx, sd, live, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := metricValue(t, "servicedeployment_drift_corrections_total", configMaps) - before; got != 0 {
+		t.Errorf("ConfigMap drift corrections after a change of the manifest: got %v, want 0", got)
+	}
+}
+
+func TestHasFields(t *testing.T) {
+	obj := map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "settings", "uid": "1234"},
+		"data":     map[string]interface{}{"mode": "fast", "extra": "1"},
+		"spec": map[string]interface{}{
+			"ports": []interface{}{
+				map[string]interface{}{"port": int64(80), "protocol": "TCP"},
+				map[string]interface{}{"port": int64(443), "protocol": "TCP"},
+			},
+		},
+	}
+	for _, tt := range []struct {
+		name     string
+		manifest interface{}
+		want     bool
+	}{
+		{name: "empty", manifest: map[string]interface{}{}, want: true},
+		{name: "subset, defaulted fields ignored", manifest: map[string]interface{}{"metadata": map[string]interface{}{"name": "settings"}, "data": map[string]interface{}{"mode": "fast"}}, want: true},
+		{name: "different value", manifest: map[string]interface{}{"data": map[string]interface{}{"mode": "slow"}}},
+		{name: "missing field", manifest: map[string]interface{}{"data": map[string]interface{}{"other": "1"}}},
+		{name: "map where a value is", manifest: map[string]interface{}{"data": map[string]interface{}{"mode": map[string]interface{}{}}}},
+		{
+			name:     "list items by position",
+			manifest: map[string]interface{}{"spec": map[string]interface{}{"ports": []interface{}{map[string]interface{}{"port": int64(80)}, map[string]interface{}{"port": int64(443)}}}},
+			want:     true,
+		},
+		{
+			name:     "list items in another order",
+			manifest: map[string]interface{}{"spec": map[string]interface{}{"ports": []interface{}{map[string]interface{}{"port": int64(443)}, map[string]interface{}{"port": int64(80)}}}},
+		},
+		{
+			name:     "list of another length",
+			manifest: map[string]interface{}{"spec": map[string]interface{}{"ports": []interface{}{map[string]interface{}{"port": int64(80)}}}},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hasFields(obj, tt.manifest); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+// hasEvent reports whether an Event starting with `prefix` was recorded, consuming those recorded so far.
+func hasEvent(env *testEnv, prefix string) bool {
+	found := false
+	for {
+		select {
+		case ev := <-env.events.Events:
+			found = found || strings.HasPrefix(ev, prefix)
+		default:
+			return found
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+)
+
+// Upper bound for a single check, well below the probe's own timeout
+const healthCheckTimeout = 500 * time.Millisecond
+
+// cacheSyncCheck is a readiness check that passes once the informers of every watched kind have synced.
+// Until then the controllers reconcile against an incomplete view of the cluster.
+func cacheSyncCheck(c cache.Cache) healthz.Checker {
+	return func(req *http.Request) error {
+		ctx, cancel := context.WithTimeout(req.Context(), healthCheckTimeout)
+		defer cancel()
+		if !c.WaitForCacheSync(ctx) {
+			return errors.New("informer caches not synced")
+		}
+		return nil
+	}
+}
+
+// apiServerCheck is a readiness check that the API server answers its own `/readyz`.
+// It is deliberately not a liveness check: restarting the operator does not help while the API server is down.
+func apiServerCheck(kube kubernetes.Interface) healthz.Checker {
+	return func(req *http.Request) error {
+		ctx, cancel := context.WithTimeout(req.Context(), healthCheckTimeout)
+		defer cancel()
+		if err := kube.Discovery().RESTClient().Get().AbsPath("/readyz").Do(ctx).Error(); err != nil {
+			return fmt.Errorf("api server not reachable: %w", err)
+		}
+		return nil
+	}
+}
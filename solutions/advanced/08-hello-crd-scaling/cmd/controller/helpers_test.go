@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	apiv1 "github.com/jayantasamaddar/quick-reference-kubernetes/solutions/hello-crd-scaling/api/v1"
+
+	dto "github.com/prometheus/client_model/go"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/events"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// testEnv is a reconciler on a fake client, as wired by main without the optional parts (placement, sharding, ...).
+type testEnv struct {
+	r      *reconciler
+	client client.Client // the fake client itself: its writes are neither counted nor intercepted
+	events *events.FakeRecorder
+
+	mu     sync.Mutex
+	writes map[string]int // creates, updates and patches by the reconciler, by Go type of the object
+}
+
+// testRESTMapper maps the kinds the tests use as extra resources.
+func testRESTMapper() meta.RESTMapper {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(corev1.SchemeGroupVersion.WithKind("ConfigMap"), meta.RESTScopeNamespace)
+	mapper.Add(corev1.SchemeGroupVersion.WithKind("Secret"), meta.RESTScopeNamespace)
+	mapper.Add(corev1.SchemeGroupVersion.WithKind("Namespace"), meta.RESTScopeRoot)
+	return mapper
+}
+
+// newTestEnv returns a testEnv holding `objs`. `funcs` intercept the reconciler's calls, e.g. to make them fail.
+// Created objects get a UID like on a real API server.
+func newTestEnv(t testing.TB, funcs interceptor.Funcs, objs ...client.Object) *testEnv {
+	t.Helper()
+	base := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithRESTMapper(testRESTMapper()).
+		WithObjects(objs...).
+		WithStatusSubresource(&apiv1.ServiceDeployment{}).
+		Build()
+	env := &testEnv{client: base, events: events.NewFakeRecorder(100), writes: map[string]int{}}
+	counted := interceptor.NewClient(base, interceptor.Funcs{
+		Create: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.CreateOption) error {
+			if obj.GetUID() == "" {
+				obj.SetUID(types.UID(fmt.Sprintf("uid-%T-%s-%s", obj, obj.GetNamespace(), obj.GetName())))
+			}
+			env.countWrite(obj)
+			return c.Create(ctx, obj, opts...)
+		},
+		Update: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.UpdateOption) error {
+			env.countWrite(obj)
+			return c.Update(ctx, obj, opts...)
+		},
+		Patch: func(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+			env.countWrite(obj)
+			return c.Patch(ctx, obj, patch, opts...)
+		},
+	})
+
+	live := newLiveConfig(1, nil)
+	live.store(live.defaults())
+	env.r = &reconciler{
+		Client:     interceptor.NewClient(counted.(client.WithWatch), funcs),
+		scheme:     scheme,
+		controller: controllerSelector{isDefault: true},
+		apiReader:  base,
+		live:       live,
+		revisions:  newChildRevisions(),
+	}
+	env.r.recorder = newEventRecorder(eventsConfig{}, env.events, scheme, nil, live)
+	return env
+}
+
+func (e *testEnv) countWrite(obj client.Object) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.writes[fmt.Sprintf("%T", obj)]++
+}
+
+// takeWrites returns the writes counted since the last call.
+func (e *testEnv) takeWrites() map[string]int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	writes := e.writes
+	e.writes = map[string]int{}
+	return writes
+}
+
+func (e *testEnv) reconcile(t testing.TB, sd *apiv1.ServiceDeployment) (ctrl.Result, error) {
+	t.Helper()
+	return e.r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(sd)})
+}
+
+// newTestServiceDeployment returns a ServiceDeployment of one nginx container behind an http Service port.
+func newTestServiceDeployment(namespace, name string) *apiv1.ServiceDeployment {
+	return &apiv1.ServiceDeployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, UID: types.UID("uid-sd-" + namespace + "-" + name), Generation: 1},
+		Spec: apiv1.ServiceDeploymentSpec{
+			Replicas:   2,
+			Containers: []corev1.Container{{Name: "nginx", Image: "nginx:1.27"}},
+			Service: apiv1.ServiceDeploymentSpecService{
+				Type:  corev1.ServiceTypeClusterIP,
+				Ports: []corev1.ServicePort{{Name: "http", Port: 80, TargetPort: intstr.FromInt32(80)}},
+			},
+		},
+	}
+}
+
+// metricValue returns the value of the counter (or the sample count of the histogram) `name` with `labels`
+// in the controller-runtime registry the operator serves, 0 if there is none yet.
+func metricValue(t *testing.T, name string, labels map[string]string) float64 {
+	t.Helper()
+	families, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatalf("gather metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			if !hasLabels(m, labels) {
+				continue
+			}
+			switch {
+			case m.GetCounter() != nil:
+				return m.GetCounter().GetValue()
+			case m.GetHistogram() != nil:
+				return float64(m.GetHistogram().GetSampleCount())
+			case m.GetGauge() != nil:
+				return m.GetGauge().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func hasLabels(m *dto.Metric, labels map[string]string) bool {
+	found := 0
+	for _, pair := range m.GetLabel() {
+		if v, ok := labels[pair.GetName()]; ok {
+			if v != pair.GetValue() {
+				return false
+			}
+			found++
+		}
+	}
+	return found == len(labels)
+}
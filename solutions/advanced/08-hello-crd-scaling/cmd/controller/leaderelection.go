@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+)
+
+// Leader election lets several operator replicas run for availability while only one of them reconciles.
+// The others wait on a Lease (coordination.k8s.io) and take over when the leader stops renewing it.
+type leaderElectionConfig struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// Name of the Lease
+	ID string `json:"id,omitempty"`
+	// Namespace of the Lease. Defaults to the operator's namespace when running in a cluster.
+	Namespace     string          `json:"namespace,omitempty"`
+	LeaseDuration metav1.Duration `json:"leaseDuration,omitzero"`
+	RenewDeadline metav1.Duration `json:"renewDeadline,omitzero"`
+	RetryPeriod   metav1.Duration `json:"retryPeriod,omitzero"`
+}
+
+func (o *leaderElectionConfig) bindFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&o.Enabled, "leader-elect", o.Enabled, "Enable leader election, so only one replica reconciles at a time.")
+	fs.StringVar(&o.ID, "leader-election-id", o.ID, "Name of the Lease used for leader election.")
+	fs.StringVar(&o.Namespace, "leader-election-namespace", o.Namespace, "Namespace of the Lease. Defaults to the operator's namespace when running in a cluster.")
+	fs.DurationVar(&o.LeaseDuration.Duration, "leader-election-lease-duration", o.LeaseDuration.Duration, "How long standby replicas wait before taking over a Lease that is not renewed.")
+	fs.DurationVar(&o.RenewDeadline.Duration, "leader-election-renew-deadline", o.RenewDeadline.Duration, "How long the leader keeps retrying to renew the Lease before giving up leadership.")
+	fs.DurationVar(&o.RetryPeriod.Duration, "leader-election-retry-period", o.RetryPeriod.Duration, "How often replicas try to acquire or renew the Lease.")
+}
+
+func (o *leaderElectionConfig) validate() error {
+	if !o.Enabled {
+		return nil
+	}
+	var errs []error
+	if o.ID == "" {
+		errs = append(errs, errors.New("  leaderElection.id: must not be empty"))
+	}
+	if o.RenewDeadline.Duration >= o.LeaseDuration.Duration {
+		errs = append(errs, fmt.Errorf("  leaderElection.renewDeadline: must be less than leaseDuration (%s), got %s", o.LeaseDuration.Duration, o.RenewDeadline.Duration))
+	}
+	if o.RetryPeriod.Duration <= 0 || o.RetryPeriod.Duration >= o.RenewDeadline.Duration {
+		errs = append(errs, fmt.Errorf("  leaderElection.retryPeriod: must be positive and less than renewDeadline (%s), got %s", o.RenewDeadline.Duration, o.RetryPeriod.Duration))
+	}
+	return errors.Join(errs...)
+}
+
+func (o *leaderElectionConfig) apply(opts *ctrl.Options) {
+	opts.LeaderElection = o.Enabled
+	opts.LeaderElectionID = o.ID
+	opts.LeaderElectionNamespace = o.Namespace
+	opts.LeaseDuration = &o.LeaseDuration.Duration
+	opts.RenewDeadline = &o.RenewDeadline.Duration
+	opts.RetryPeriod = &o.RetryPeriod.Duration
+
+	// Step down as soon as the manager is stopped (SIGTERM), instead of making a standby wait for the Lease to expire.
+	// The manager releases the Lease once all its runnables returned, so everything that writes to the cluster runs as
+	// one, the Events too (see eventSender); after `mgr.Start` returns `main` only flushes traces and closes files.
+	opts.LeaderElectionReleaseOnCancel = true
+}
+
+// leaderCheck is a readiness check that only passes on the replica holding the Lease.
+// Without leader election `mgr.Elected()` is closed as soon as the manager starts, so it always passes.
+// It is served as `/readyz/leader`; the pod's readinessProbe excludes it, otherwise standby replicas would never
+// become Ready and a rolling update of the operator could not make progress.
+func leaderCheck(mgr ctrl.Manager) healthz.Checker {
+	return func(_ *http.Request) error {
+		select {
+		case <-mgr.Elected():
+			return nil
+		default:
+			return errors.New("not the leader")
+		}
+	}
+}
@@ -6,24 +6,38 @@ package main
 // 4. We do this with the help of the sigs.k8s.io/controller-runtime package.
 
 import (
-	"errors"
+	"context"
+	"flag"
+	"fmt"
 	"os"
-	"path/filepath"
+	"time"
 
 	apiv1 "github.com/jayantasamaddar/quick-reference-kubernetes/solutions/hello-crd-scaling/api/v1"
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 
+	"github.com/go-logr/logr"
+	"go.uber.org/zap/zapcore"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/clientcmd"
-	"k8s.io/client-go/util/homedir"
+	"k8s.io/client-go/tools/events"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
 var (
@@ -40,25 +54,33 @@ func init() {
 }
 
 func main() {
-	var (
-		config *rest.Config
-		err    error
-	)
-
-	// Set kube config correctly
-	kubeconfig := filepath.Join(homedir.HomeDir(), ".kube", "config")
-	if _, err := os.Stat(kubeconfig); errors.Is(err, os.ErrNotExist) {
-		// In a cluster use the in-cluster config
-		config, err = rest.InClusterConfig()
-		if err != nil {
-			panic(err.Error())
-		}
-	} else {
-		// Outside the cluster using kubeconfig
-		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
-		if err != nil {
-			panic(err.Error())
-		}
+	// `controller audit ...` queries the audit log instead of running the operator
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		os.Exit(auditQuery(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+	}
+
+	// Resolve the configuration: defaults < `--config` file < flags.
+	// A FlagSet of our own, as controller-runtime already registers `--kubeconfig` on flag.CommandLine.
+	cfg, err := loadConfig(flag.NewFlagSet(os.Args[0], flag.ExitOnError), os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	ctrl.SetLogger(newLogger(cfg.Log)) // Set new logger
+
+	// Set kube config correctly: `--kubeconfig`, $KUBECONFIG or ~/.kube/config outside a cluster, in-cluster config otherwise
+	config, err := cfg.restConfig()
+	if err != nil {
+		setupLog.Error(err, "unable to load kubeconfig", "kubeconfig", cfg.Kubeconfig, "context", cfg.Context)
+		os.Exit(1)
+	}
+
+	// Tracing instruments the transport of `config`, so it goes before any client is created
+	shutdownTracing, err := cfg.Tracing.setup(context.Background(), config)
+	if err != nil {
+		setupLog.Error(err, "unable to set up tracing", "exporter", cfg.Tracing.Exporter)
+		os.Exit(1)
 	}
 
 	// Kubernetes client set
@@ -67,16 +89,219 @@ func main() {
 		panic(err.Error())
 	}
 
-	ctrl.SetLogger(zap.New()) // Set new logger
-
 	// Manager can create controller(s) and `Start` running them until cancelled.
-	mgr, err := ctrl.NewManager(config, ctrl.Options{
-		Scheme: scheme,
-	})
+	// With leader election, controllers only start once this replica holds the Lease.
+	options := ctrl.Options{
+		Scheme:                 scheme,
+		HealthProbeBindAddress: cfg.HealthProbeBindAddress,
+		Metrics:                metricsserver.Options{BindAddress: cfg.MetricsBindAddress},
+	}
+	// Namespace-scoped mode: only cache (and therefore watch) the configured namespaces,
+	// which only needs Roles in those namespaces instead of a ClusterRole.
+	scope := newNamespaceScope(cfg.Namespaces)
+	if scope.restricted() {
+		setupLog.Info("running namespace-scoped; ServiceDeploymentClasses and ServiceDeploymentSets are disabled", "namespaces", scope.String())
+		options.Cache.DefaultNamespaces = make(map[string]cache.Config, len(cfg.Namespaces))
+		for _, ns := range cfg.Namespaces {
+			options.Cache.DefaultNamespaces[ns] = cache.Config{}
+		}
+	}
+	// Operators running side by side (`spec.controllerName`): all but the default one only cache their own ServiceDeployments
+	selector := controllerSelector{name: cfg.ControllerName, isDefault: cfg.DefaultController}
+	selector.applyCache(&options.Cache)
+	setupLog.Info("handling servicedeployments", "controllerName", selector.name, "default", selector.isDefault)
+	// A dry run usually runs next to the real operator: taking part in its leader election would stop that one
+	if cfg.DryRun.Enabled && cfg.LeaderElection.Enabled {
+		setupLog.Info("dry run: leader election disabled")
+		cfg.LeaderElection.Enabled = false
+	}
+	// Likewise, it would take shards away from the real replicas; unsharded, it looks at every ServiceDeployment
+	if cfg.DryRun.Enabled && cfg.Sharding.Enabled {
+		setupLog.Info("dry run: sharding disabled")
+		cfg.Sharding.Enabled = false
+	}
+	// A dry run isn't what the webhook configurations point at, and must not rotate the real certificate either
+	if cfg.DryRun.Enabled && cfg.Webhook.Enabled {
+		setupLog.Info("dry run: webhook server disabled")
+		cfg.Webhook.Enabled = false
+	}
+	// Status updates are dry-run too, so every reconcile would look like a lifecycle transition
+	if cfg.DryRun.Enabled && cfg.Notifications.Enabled {
+		setupLog.Info("dry run: notifications disabled")
+		cfg.Notifications.Enabled = false
+	}
+	// Nothing is changed, so there is nothing to audit: the dry-run report is the audit
+	if cfg.DryRun.Enabled && cfg.Audit.Sink != "" {
+		setupLog.Info("dry run: audit log disabled")
+		cfg.Audit.Sink = ""
+	}
+	// Webhook server, with a certificate managed by the operator itself (see webhookcerts.go)
+	var certs *webhookCerts
+	if cfg.Webhook.Enabled {
+		dyn, err := dynamic.NewForConfig(config)
+		if err != nil {
+			setupLog.Error(err, "unable to set up webhook certificates")
+			os.Exit(1)
+		}
+		certs, err = newWebhookCerts(cfg.Webhook, clientset, dyn)
+		if err != nil {
+			setupLog.Error(err, "unable to set up webhook certificates")
+			os.Exit(1)
+		}
+		options.WebhookServer = certs.server()
+	}
+	cfg.LeaderElection.apply(&options)
+	mgr, err := ctrl.NewManager(config, options)
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
+	// Liveness (`/healthz`) only tells whether the process still serves requests.
+	// Readiness (`/readyz`) also covers what the operator depends on; each check is served as `/readyz/<name>` too.
+	if err := mgr.AddHealthzCheck("ping", healthz.Ping); err != nil {
+		setupLog.Error(err, "unable to set up health check")
+		os.Exit(1)
+	}
+	type readyCheck struct {
+		name    string
+		checker healthz.Checker
+	}
+	readyChecks := []readyCheck{
+		{"cache-sync", cacheSyncCheck(mgr.GetCache())},
+		{"apiserver", apiServerCheck(clientset)},
+		{"leader", leaderCheck(mgr)},
+	}
+	if certs != nil {
+		// `GetWebhookServer` also adds the server to the manager
+		readyChecks = append(readyChecks, readyCheck{"webhook", certs.readyCheck(mgr.GetWebhookServer())})
+		for _, runnable := range []manager.Runnable{webhookCertRotator{certs}, webhookCertReloader{certs}} {
+			if err := mgr.Add(runnable); err != nil {
+				setupLog.Error(err, "unable to set up webhook certificates")
+				os.Exit(1)
+			}
+		}
+	}
+	for _, c := range readyChecks {
+		if err := mgr.AddReadyzCheck(c.name, c.checker); err != nil {
+			setupLog.Error(err, "unable to set up ready check", "check", c.name)
+			os.Exit(1)
+		}
+	}
+
+	// Sharding: every replica reconciles the ServiceDeployments of the shards whose Lease it holds (see sharding.go)
+	var shards *shardManager
+	if cfg.Sharding.Enabled {
+		shards, err = newShardManager(cfg.Sharding, clientset, mgr.GetClient())
+		if err != nil {
+			setupLog.Error(err, "unable to set up sharding")
+			os.Exit(1)
+		}
+		if err := mgr.Add(shards); err != nil {
+			setupLog.Error(err, "unable to set up sharding")
+			os.Exit(1)
+		}
+		setupLog.Info("sharding enabled", "shards", cfg.Sharding.Shards, "identity", shards.identity)
+	}
+
+	// Per-ServiceDeployment replica gauges, read from the cache on every scrape (see metrics.go)
+	metrics.Registry.MustRegister(newServiceDeploymentCollector(mgr.GetClient(), mgr.Elected(), shards, selector))
+
+	r := &reconciler{
+		Client:     mgr.GetClient(),
+		scheme:     mgr.GetScheme(),
+		kubeClient: clientset,
+		clusters:   newClusterClients(mgr.GetScheme()),
+		scope:      scope,
+		requeue:    cfg.Requeue,
+		dryRun:     cfg.DryRun.Enabled,
+		shards:     shards,
+		controller: selector,
+		apiReader:  mgr.GetAPIReader(),
+		revisions:  newChildRevisions(),
+	}
+
+	setR := &setReconciler{
+		Client: mgr.GetClient(),
+		scheme: mgr.GetScheme(),
+		shards: shards,
+	}
+
+	// Events go through the events.k8s.io/v1 API, reported by this operator's `controllerName` (see events.go).
+	// The manager's own recorder, still on core/v1, is only used for leader election.
+	broadcaster := events.NewBroadcaster(&events.EventSinkImpl{Interface: clientset.EventsV1()})
+	var sink events.EventRecorder = broadcaster.NewRecorder(mgr.GetScheme(), cfg.ControllerName)
+
+	// Dry run: the reconcilers run unchanged, on clients that send every write with server-side dry run and report the diff
+	var dryRun *dryRunReporter
+	if cfg.DryRun.Enabled {
+		dryRun, err = newDryRunReporter(cfg.DryRun, sink)
+		if err != nil {
+			setupLog.Error(err, "unable to set up dry run")
+			os.Exit(1)
+		}
+		r.Client, r.clusters.wrap = dryRun.client(r.Client, ""), dryRun.client
+		setR.Client = dryRun.client(setR.Client, "")
+		sink = dryRunRecorder{sink, cfg.DryRun.Report != ""}
+		setupLog.Info("dry run: nothing will be changed in the cluster", "report", cfg.DryRun.Report)
+	}
+
+	// Audit log: the reconcilers' clients record every write they make (see audit.go)
+	var audit *auditLog
+	if cfg.Audit.Sink != "" {
+		audit, err = newAuditLog(cfg.Audit)
+		if err != nil {
+			setupLog.Error(err, "unable to set up audit log")
+			os.Exit(1)
+		}
+		r.Client, r.clusters.wrap, r.audit = audit.client(r.Client, ""), audit.client, audit
+		setR.Client = audit.client(setR.Client, "")
+		setupLog.Info("audit log enabled", "sink", cfg.Audit.Sink, "file", cfg.Audit.File)
+	}
+
+	// Settings changed at runtime through the OperatorConfig (see operatorconfig.go). Cluster-scoped, so not in namespace-scoped mode.
+	live := newLiveConfig(cfg.MaxConcurrentReconciles, cfg.allowedExtraResourceKinds())
+	r.live, setR.live = live, live
+	var configR *operatorConfigReconciler
+	if cfg.OperatorConfigName != "" && !scope.restricted() {
+		configR = newOperatorConfigReconciler(mgr.GetClient(), cfg.OperatorConfigName, live, cfg.DryRun.Enabled)
+		if err := mgr.Add(configR); err != nil {
+			setupLog.Error(err, "unable to set up operatorconfig")
+			os.Exit(1)
+		}
+		setupLog.Info("operatorconfig enabled", "name", cfg.OperatorConfigName)
+	} else {
+		live.store(live.defaults())
+	}
+	if err := mgr.AddMetricsServerExtraHandler("/debug/config", debugConfigHandler(*cfg, live)); err != nil {
+		setupLog.Error(err, "unable to set up debug endpoint")
+		os.Exit(1)
+	}
+
+	// Filtered by the OperatorConfig's verbosity, rate limited per object and reason, and mirrored to the audit log or metrics if configured
+	recorder := newEventRecorder(cfg.Events, sink, mgr.GetScheme(), audit, live)
+	r.recorder, setR.recorder = recorder, recorder
+
+	// Rollout lifecycle notifications, sent in the background (see notifications.go)
+	if cfg.Notifications.Enabled {
+		r.notifier = newNotifier(cfg.Notifications, clientset, live)
+		if err := mgr.Add(r.notifier); err != nil {
+			setupLog.Error(err, "unable to set up notifications")
+			os.Exit(1)
+		}
+		setupLog.Info("notifications enabled", "configMap", cfg.Notifications.ConfigMapName)
+	}
+
+	// Index ServiceDeployments by `spec.className`, so a ServiceDeploymentClass change only requeues its members
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &apiv1.ServiceDeployment{}, classNameIndex, indexClassName); err != nil {
+		setupLog.Error(err, "unable to index servicedeployments by class name")
+		os.Exit(1)
+	}
+
+	// Index ServiceDeployments by their dependencies, so a dependency's status change requeues its dependents
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &apiv1.ServiceDeployment{}, dependsOnIndex, indexDependsOn); err != nil {
+		setupLog.Error(err, "unable to index servicedeployments by dependency")
+		os.Exit(1)
+	}
 
 	// Create a new controller using builder pattern
 	// ---------------------------------------------
@@ -88,28 +313,111 @@ func main() {
 	//				- If it finds an owner of kind ServiceDeployment with controller=true, it enqueues that owner’s {namespace, name}.
 	// 			 Thus, that is how “child changed → reconcile parent” works.
 	//			 Can use custom predicates (optionally).
+	// - `Watches`: Watch a resource that is neither the primary nor owned, mapping its events to the ServiceDeployments to reconcile.
+	//			 ServiceDeploymentClass is cluster-scoped and referenced by name, so owner references can't be used.
+	//			 Cluster-scoped watches need a ClusterRole, so they are skipped in namespace-scoped mode.
 	// - `Complete`: Takes the reconciler and builds the controller.
 	//
 	// Controllers can invoke the Reconcile function once the are running and receive events
-	err = ctrl.NewControllerManagedBy(mgr).
-		For(&apiv1.ServiceDeployment{}, builder.WithPredicates(serviceDeploymentPredicate)).
-		Owns(&appsv1.Deployment{}). // controller-runtime sets up a watch on Deployments
-		Owns(&corev1.Service{}).    // controller-runtime sets up a watch on Services.
-		Complete(&reconciler{
-			Client:     mgr.GetClient(),
-			scheme:     mgr.GetScheme(),
-			kubeClient: clientset,
-			recorder:   mgr.GetEventRecorderFor("servicedeployments-operator"),
-		})
-	if err != nil {
+	sdController := ctrl.NewControllerManagedBy(mgr).
+		For(&apiv1.ServiceDeployment{}, builder.WithPredicates(serviceDeploymentPredicate(selector))).
+		WithOptions(controller.Options{MaxConcurrentReconciles: cfg.MaxConcurrentReconciles, RateLimiter: cfg.Requeue.rateLimiter()})
+	// controller-runtime sets up a watch on every kind of child: Deployments, Services, ... (see children.go)
+	for _, gen := range childGenerators {
+		sdController = sdController.Owns(gen.object())
+	}
+	// Without predicates (unlike `For`): the status changes of a dependency are exactly what its dependents wait for
+	sdController = sdController.Watches(&apiv1.ServiceDeployment{}, handler.EnqueueRequestsFromMapFunc(r.mapDependencyToDependents))
+	if !scope.restricted() {
+		sdController = sdController.Watches(&apiv1.ServiceDeploymentClass{}, handler.EnqueueRequestsFromMapFunc(r.mapClassToServiceDeployments))
+	}
+	// Everything in a shard this replica just acquired, as it may have changed while nobody reconciled it
+	if shards != nil {
+		sdController = sdController.WatchesRawSource(source.Channel(shards.events, &handler.EnqueueRequestForObject{}))
+	}
+	// Everything, after an OperatorConfig change
+	if configR != nil {
+		sdController = sdController.WatchesRawSource(source.Channel(configR.events, &handler.EnqueueRequestForObject{}))
+	}
+	if err = sdController.Complete(r); err != nil {
 		setupLog.Error(err, "Unable to create operator!")
 		os.Exit(1)
 	}
 
+	// A second controller stamps out ServiceDeployments across namespaces (cluster-wide mode and default operator only).
+	// - `Owns`: status changes of its ServiceDeployments update the set's aggregate readiness.
+	// - `Watches`: namespaces coming, going or being relabelled change which namespaces the set targets.
+	if !scope.restricted() && selector.isDefault {
+		setController := ctrl.NewControllerManagedBy(mgr).
+			For(&apiv1.ServiceDeploymentSet{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+			WithOptions(controller.Options{MaxConcurrentReconciles: cfg.MaxConcurrentReconciles, RateLimiter: cfg.Requeue.rateLimiter()}).
+			Owns(&apiv1.ServiceDeployment{}).
+			Watches(&corev1.Namespace{}, handler.EnqueueRequestsFromMapFunc(setR.mapNamespaceToSets))
+		if shards != nil {
+			setController = setController.WatchesRawSource(source.Channel(shards.setEvents, &handler.EnqueueRequestForObject{}))
+		}
+		if configR != nil {
+			configR.setEvents = make(chan event.GenericEvent)
+			setController = setController.WatchesRawSource(source.Channel(configR.setEvents, &handler.EnqueueRequestForObject{}))
+		}
+		if err = setController.Complete(setR); err != nil {
+			setupLog.Error(err, "Unable to create servicedeploymentset controller!")
+			os.Exit(1)
+		}
+	}
+
+	// A third one applies the OperatorConfig. Only the one named `operatorConfigName` is of interest, and its status changes aren't.
+	if configR != nil {
+		err = ctrl.NewControllerManagedBy(mgr).
+			For(&apiv1.OperatorConfig{}, builder.WithPredicates(
+				predicate.NewPredicateFuncs(func(obj client.Object) bool { return obj.GetName() == configR.name }),
+				predicate.GenerationChangedPredicate{},
+			)).
+			WatchesRawSource(source.Channel(configR.initial, &handler.EnqueueRequestForObject{})).
+			Complete(configR)
+		if err != nil {
+			setupLog.Error(err, "Unable to create operatorconfig controller!")
+			os.Exit(1)
+		}
+	}
+
+	if err := mgr.Add(eventSender{broadcaster}); err != nil {
+		setupLog.Error(err, "unable to start recording events")
+		os.Exit(1)
+	}
+
 	// Start all controllers registered with the manager
 	setupLog.Info("Starting manager...")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+	err = mgr.Start(ctrl.SetupSignalHandler())
+
+	// The manager stopped everything that writes to the cluster. What's left goes elsewhere: flush the spans still
+	// buffered, close the dry-run report and the audit log files.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(ctx); err != nil {
+		setupLog.Error(err, "failed to flush traces")
+	}
+	if dryRun != nil {
+		if err := dryRun.Close(); err != nil {
+			setupLog.Error(err, "failed to close dry-run report")
+		}
+	}
+	if audit != nil {
+		if err := audit.Close(); err != nil {
+			setupLog.Error(err, "failed to close audit log")
+		}
+	}
+	if err != nil {
 		setupLog.Error(err, "Error running manager!")
 		os.Exit(1)
 	}
 }
+
+func newLogger(cfg logConfig) logr.Logger {
+	level, _ := zapcore.ParseLevel(cfg.Level) // validated in loadConfig
+	encoder := zap.JSONEncoder()
+	if cfg.Format == "console" {
+		encoder = zap.ConsoleEncoder()
+	}
+	return zap.New(zap.Level(level), encoder)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	apiv1 "github.com/jayantasamaddar/quick-reference-kubernetes/solutions/hello-crd-scaling/api/v1"
+
+	"github.com/prometheus/client_golang/prometheus"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// Custom metrics, served next to controller-runtime's own on the manager's metrics endpoint (`metricsBindAddress`).
+var (
+	reconcileDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "servicedeployment_reconcile_duration_seconds",
+		Help:    "Time taken to reconcile a ServiceDeployment, by outcome (success, requeue or error).",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"outcome"})
+
+	// An update to a child although nothing it is rendered from changed means the child drifted (e.g. `kubectl edit`);
+	// one following a change of the rendered pod template, e.g. by its ServiceDeploymentClass, doesn't count
+	driftCorrections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "servicedeployment_drift_corrections_total",
+		Help: "Children updated back to the rendered state although their ServiceDeployment did not change, by kind.",
+	}, []string{"kind"})
+
+	childApplyFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "servicedeployment_child_apply_failures_total",
+		Help: "Failed creates or updates of children, by kind and API status reason.",
+	}, []string{"kind", "reason"})
+
+	// Writes saved by the spec hash: `skipped` children weren't even compared, `unchanged` ones were but needed no update
+	childApplies = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "servicedeployment_child_applies_total",
+		Help: "Children applied, by kind and result (created, updated, unchanged or skipped).",
+	}, []string{"kind", "result"})
+
+	conflictRequeues = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "servicedeployment_conflict_requeues_total",
+		Help: "Reconciles requeued because a child update conflicted, by kind.",
+	}, []string{"kind"})
+
+	// Only with `events.mirror: [metrics]`
+	eventsRecorded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "servicedeployment_events_total",
+		Help: "Events recorded, by type and reason.",
+	}, []string{"type", "reason"})
+
+	eventsThrottled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "servicedeployment_events_throttled_total",
+		Help: "Events dropped by the per-object rate limit, by reason.",
+	}, []string{"reason"})
+
+	notificationsSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "servicedeployment_notifications_total",
+		Help: "Lifecycle notifications, by sink, event and result (sent, failed, invalid or dropped).",
+	}, []string{"sink", "event", "result"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(reconcileDuration, driftCorrections, childApplyFailures, childApplies, conflictRequeues, eventsRecorded, eventsThrottled, notificationsSent)
+}
+
+// observeReconcile records how long a reconcile took and how it ended.
+func observeReconcile(start time.Time, result ctrl.Result, err error) {
+	outcome := "success"
+	switch {
+	case err != nil:
+		outcome = "error"
+	case result.Requeue || result.RequeueAfter > 0:
+		outcome = "requeue"
+	}
+	reconcileDuration.WithLabelValues(outcome).Observe(time.Since(start).Seconds())
+}
+
+// recordApplyFailure counts a failed child apply under the reason the API server gave, if any.
+func recordApplyFailure(kind string, err error) {
+	reason := string(k8serrors.ReasonForError(err))
+	if reason == "" {
+		reason = "Unknown"
+	}
+	childApplyFailures.WithLabelValues(kind, reason).Inc()
+}
+
+// rendered reports whether the current generation of `sd` was already reconciled once.
+func rendered(sd *apiv1.ServiceDeployment) bool {
+	cond := meta.FindStatusCondition(sd.Status.Conditions, apiv1.ConditionAvailable)
+	return cond != nil && cond.ObservedGeneration == sd.Generation
+}
+
+// serviceDeploymentCollector exports the replica counts of every ServiceDeployment from the informer cache at scrape time,
+// so series of deleted ServiceDeployments disappear without any bookkeeping.
+// Only the leader exports them, otherwise the standby replicas would double every sum.
+// With sharding every replica exports the ServiceDeployments of its own shards.
+// Each operator only exports the ServiceDeployments it handles (`spec.controllerName`).
+type serviceDeploymentCollector struct {
+	client     client.Reader
+	elected    <-chan struct{}
+	shards     *shardManager
+	controller controllerSelector
+}
+
+var (
+	desiredReplicasDesc = prometheus.NewDesc("servicedeployment_desired_replicas",
+		"Replicas requested by the ServiceDeployment (summed over clusters with spec.placement).", []string{"namespace", "name"}, nil)
+	readyReplicasDesc = prometheus.NewDesc("servicedeployment_ready_replicas",
+		"Ready replicas of the ServiceDeployment.", []string{"namespace", "name"}, nil)
+	availableReplicasDesc = prometheus.NewDesc("servicedeployment_available_replicas",
+		"Available replicas of the ServiceDeployment.", []string{"namespace", "name"}, nil)
+	rolloutInProgressDesc = prometheus.NewDesc("servicedeployment_rollout_in_progress",
+		"1 while not every desired replica is updated and available, 0 otherwise.", []string{"namespace", "name"}, nil)
+)
+
+func newServiceDeploymentCollector(c client.Reader, elected <-chan struct{}, shards *shardManager, controller controllerSelector) *serviceDeploymentCollector {
+	return &serviceDeploymentCollector{client: c, elected: elected, shards: shards, controller: controller}
+}
+
+func (c *serviceDeploymentCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- desiredReplicasDesc
+	ch <- readyReplicasDesc
+	ch <- availableReplicasDesc
+	ch <- rolloutInProgressDesc
+}
+
+func (c *serviceDeploymentCollector) Collect(ch chan<- prometheus.Metric) {
+	select {
+	case <-c.elected:
+	default:
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var sds apiv1.ServiceDeploymentList
+	if err := c.client.List(ctx, &sds); err != nil {
+		ctrl.Log.WithName("metrics").Error(err, "failed to list servicedeployments")
+		return
+	}
+	for i := range sds.Items {
+		sd := &sds.Items[i]
+		if !c.controller.claims(sd) || (c.shards != nil && !c.shards.owns(sd)) {
+			continue
+		}
+		status := sd.Status
+		rollout := status.AvailableReplicas < status.DesiredReplicas
+		// Updated replicas are not aggregated over placed clusters
+		if !placed(sd) && status.UpdatedReplicas < status.DesiredReplicas {
+			rollout = true
+		}
+		ch <- prometheus.MustNewConstMetric(desiredReplicasDesc, prometheus.GaugeValue, float64(status.DesiredReplicas), sd.Namespace, sd.Name)
+		ch <- prometheus.MustNewConstMetric(readyReplicasDesc, prometheus.GaugeValue, float64(status.ReadyReplicas), sd.Namespace, sd.Name)
+		ch <- prometheus.MustNewConstMetric(availableReplicasDesc, prometheus.GaugeValue, float64(status.AvailableReplicas), sd.Namespace, sd.Name)
+		ch <- prometheus.MustNewConstMetric(rolloutInProgressDesc, prometheus.GaugeValue, boolToFloat(rollout), sd.Namespace, sd.Name)
+	}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	apiv1 "github.com/jayantasamaddar/quick-reference-kubernetes/solutions/hello-crd-scaling/api/v1"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+// The metrics are global, so every test compares them before and after its own reconciles.
+
+func TestReconcileDurationMetric(t *testing.T) {
+	sd := newTestServiceDeployment("metrics-duration", "web")
+	env := newTestEnv(t, interceptor.Funcs{}, sd)
+
+	success := map[string]string{"outcome": "success"}
+	before := metricValue(t, "servicedeployment_reconcile_duration_seconds", success)
+	if _, err := env.reconcile(t, sd); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if got := metricValue(t, "servicedeployment_reconcile_duration_seconds", success) - before; got != 1 {
+		t.Errorf("reconciles observed with outcome success: got %v, want 1", got)
+	}
+}
+
+func TestDriftCorrectionMetric(t *testing.T) {
+	ctx := context.Background()
+	sd := newTestServiceDeployment("metrics-drift", "web")
+	env := newTestEnv(t, interceptor.Funcs{}, sd)
+	if _, err := env.reconcile(t, sd); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+
+	// The generation was rendered and became Available...
+	markAvailable(t, env, sd)
+	// ...then someone scaled the Deployment by hand
+	var dep appsv1.Deployment
+	if err := env.client.Get(ctx, client.ObjectKey{Namespace: sd.Namespace, Name: sd.Name}, &dep); err != nil {
+		t.Fatal(err)
+	}
+	dep.Spec.Replicas = ptr.To(int32(5))
+	dep.Generation++
+	if err := env.client.Update(ctx, &dep); err != nil {
+		t.Fatal(err)
+	}
+
+	deployments := map[string]string{"kind": "Deployment"}
+	before := metricValue(t, "servicedeployment_drift_corrections_total", deployments)
+	if _, err := env.reconcile(t, sd); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if got := metricValue(t, "servicedeployment_drift_corrections_total", deployments) - before; got != 1 {
+		t.Errorf("Deployment drift corrections: got %v, want 1", got)
+	}
+	if err := env.client.Get(ctx, client.ObjectKeyFromObject(&dep), &dep); err != nil {
+		t.Fatal(err)
+	}
+	if *dep.Spec.Replicas != sd.Spec.Replicas {
+		t.Errorf("replicas: got %d, want %d", *dep.Spec.Replicas, sd.Spec.Replicas)
+	}
+}
+
+// TestDriftCorrectionMetricClassChange checks that children updated after a change of their class aren't counted as drifted.
+func TestDriftCorrectionMetricClassChange(t *testing.T) {
+	ctx := context.Background()
+	sd := newTestServiceDeployment("metrics-class", "web")
+	sd.Spec.ClassName = "gold"
+	class := &apiv1.ServiceDeploymentClass{ObjectMeta: metav1.ObjectMeta{Name: "gold"}}
+	env := newTestEnv(t, interceptor.Funcs{}, sd, class)
+	if _, err := env.reconcile(t, sd); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	markAvailable(t, env, sd)
+
+	// A toleration added to the class changes the pod template of the Deployment
+	class.Spec.Tolerations = []corev1.Toleration{{Key: "dedicated", Operator: corev1.TolerationOpExists}}
+	if err := env.client.Update(ctx, class); err != nil {
+		t.Fatal(err)
+	}
+	deployments := map[string]string{"kind": "Deployment"}
+	before := metricValue(t, "servicedeployment_drift_corrections_total", deployments)
+	if _, err := env.reconcile(t, sd); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	var dep appsv1.Deployment
+	if err := env.client.Get(ctx, client.ObjectKeyFromObject(sd), &dep); err != nil {
+		t.Fatal(err)
+	}
+	if len(dep.Spec.Template.Spec.Tolerations) != 1 {
+		t.Fatalf("tolerations: got %v, want the class's", dep.Spec.Template.Spec.Tolerations)
+	}
+	if got := metricValue(t, "servicedeployment_drift_corrections_total", deployments) - before; got != 0 {
+		t.Errorf("Deployment drift corrections: got %v, want 0", got)
+	}
+}
+
+// markAvailable records that the current generation of `sd` was rendered and became Available.
+func markAvailable(t *testing.T, env *testEnv, sd *apiv1.ServiceDeployment) {
+	t.Helper()
+	ctx := context.Background()
+	if err := env.client.Get(ctx, client.ObjectKeyFromObject(sd), sd); err != nil {
+		t.Fatal(err)
+	}
+	meta.SetStatusCondition(&sd.Status.Conditions, metav1.Condition{Type: apiv1.ConditionAvailable, Status: metav1.ConditionTrue, Reason: "ReplicasAvailable", ObservedGeneration: sd.Generation})
+	if err := env.client.Status().Update(ctx, sd); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// rejectDeployments makes every Deployment create fail like a rejection by the API server's validation.
+var rejectDeployments = interceptor.Funcs{
+	Create: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.CreateOption) error {
+		if _, ok := obj.(*appsv1.Deployment); ok {
+			return k8serrors.NewInvalid(schema.GroupKind{Group: "apps", Kind: "Deployment"}, obj.GetName(),
+				field.ErrorList{field.Invalid(field.NewPath("spec", "replicas"), -1, "must be greater than or equal to 0")})
+		}
+		return c.Create(ctx, obj, opts...)
+	},
+}
+
+func TestApplyFailureMetric(t *testing.T) {
+	sd := newTestServiceDeployment("metrics-failure", "web")
+	env := newTestEnv(t, rejectDeployments, sd)
+
+	invalid := map[string]string{"kind": "Deployment", "reason": string(metav1.StatusReasonInvalid)}
+	failed := map[string]string{"outcome": "error"}
+	beforeFailures := metricValue(t, "servicedeployment_child_apply_failures_total", invalid)
+	beforeErrors := metricValue(t, "servicedeployment_reconcile_duration_seconds", failed)
+	if _, err := env.reconcile(t, sd); err == nil {
+		t.Fatal("reconcile: got no error, want the rejected Deployment")
+	}
+	if got := metricValue(t, "servicedeployment_child_apply_failures_total", invalid) - beforeFailures; got != 1 {
+		t.Errorf("Deployment apply failures with reason Invalid: got %v, want 1", got)
+	}
+	if got := metricValue(t, "servicedeployment_reconcile_duration_seconds", failed) - beforeErrors; got != 1 {
+		t.Errorf("reconciles observed with outcome error: got %v, want 1", got)
+	}
+}
+
+func TestEventMetrics(t *testing.T) {
+	sd := newTestServiceDeployment("metrics-events", "web")
+	env := newTestEnv(t, rejectDeployments, sd)
+	// One Event per object and reason per hour, mirrored to servicedeployment_events_total
+	env.r.recorder = newEventRecorder(eventsConfig{Burst: 1, Interval: metav1.Duration{Duration: time.Hour}, Mirror: []string{"metrics"}}, env.events, scheme, nil, env.r.live)
+
+	recorded := map[string]string{"type": corev1.EventTypeWarning, "reason": "ApplyDeploymentFailed"}
+	throttled := map[string]string{"reason": "ApplyDeploymentFailed"}
+	beforeRecorded := metricValue(t, "servicedeployment_events_total", recorded)
+	beforeThrottled := metricValue(t, "servicedeployment_events_throttled_total", throttled)
+
+	// The second failure within the hour is throttled
+	for range 2 {
+		if _, err := env.reconcile(t, sd); err == nil {
+			t.Fatal("reconcile: got no error, want the rejected Deployment")
+		}
+	}
+	if got := metricValue(t, "servicedeployment_events_total", recorded) - beforeRecorded; got != 1 {
+		t.Errorf("ApplyDeploymentFailed Events recorded: got %v, want 1", got)
+	}
+	if got := metricValue(t, "servicedeployment_events_throttled_total", throttled) - beforeThrottled; got != 1 {
+		t.Errorf("ApplyDeploymentFailed Events throttled: got %v, want 1", got)
+	}
+}
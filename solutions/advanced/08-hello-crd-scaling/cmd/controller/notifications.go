@@ -0,0 +1,571 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	apiv1 "github.com/jayantasamaddar/quick-reference-kubernetes/solutions/hello-crd-scaling/api/v1"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/yaml"
+)
+
+// Lifecycle events of a ServiceDeployment that notifications are sent for
+const (
+	notifyRolloutStarted = "RolloutStarted"
+	notifyAvailable      = "Available"
+	notifyDegraded       = "Degraded"
+	notifyRolledBack     = "RolledBack"
+)
+
+var notificationEvents = []string{notifyRolloutStarted, notifyAvailable, notifyDegraded, notifyRolledBack}
+
+const (
+	// Key of the sinks in the namespace's notifications ConfigMap
+	notificationSinksKey = "sinks"
+	// Key of the URL prefixes the sinks of the annotation may POST to, in the namespace's notifications ConfigMap
+	notificationAllowedURLsKey = "allowedAnnotationURLs"
+	// Notifications sent in parallel
+	notificationWorkers = 4
+)
+
+// First retry delay, doubled on every attempt
+var notificationRetryDelay = time.Second
+
+// Notifications: when a ServiceDeployment starts rolling out, becomes Available, degrades or rolls back,
+// the operator sends it to the sinks configured in its namespace (a ConfigMap) or on the object (an annotation).
+// Anyone who may edit a ServiceDeployment may set the annotation, so its sinks only POST to the URLs the
+// ConfigMap or the OperatorConfig allow, and can't sign with a Secret of the namespace.
+type notificationsConfig struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// ConfigMap in each namespace holding the sinks for its ServiceDeployments, under the `sinks` key
+	ConfigMapName string `json:"configMapName,omitempty"`
+	// Timeout of a single request to a sink
+	Timeout metav1.Duration `json:"timeout,omitzero"`
+	// Notifications waiting to be sent; more are dropped
+	QueueSize int `json:"queueSize,omitempty"`
+}
+
+func (o *notificationsConfig) bindFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&o.Enabled, "notifications", o.Enabled, "Send rollout lifecycle notifications to the sinks configured per namespace or per ServiceDeployment.")
+	fs.StringVar(&o.ConfigMapName, "notifications-configmap", o.ConfigMapName, "ConfigMap in each namespace holding its notification sinks.")
+	fs.DurationVar(&o.Timeout.Duration, "notifications-timeout", o.Timeout.Duration, "Timeout of a single request to a notification sink.")
+	fs.IntVar(&o.QueueSize, "notifications-queue-size", o.QueueSize, "Notifications waiting to be sent; more are dropped.")
+}
+
+func (o *notificationsConfig) validate() error {
+	if !o.Enabled {
+		return nil
+	}
+	var errs []error
+	for _, msg := range validation.IsDNS1123Subdomain(o.ConfigMapName) {
+		errs = append(errs, fmt.Errorf("  notifications.configMapName: %q: %s", o.ConfigMapName, msg))
+	}
+	if o.Timeout.Duration <= 0 {
+		errs = append(errs, fmt.Errorf("  notifications.timeout: must be positive, got %v", o.Timeout.Duration))
+	}
+	if o.QueueSize < 1 {
+		errs = append(errs, fmt.Errorf("  notifications.queueSize: must be at least 1, got %d", o.QueueSize))
+	}
+	return errors.Join(errs...)
+}
+
+// notificationSinkSpec is one entry of the `sinks` list, in the ConfigMap or the annotation.
+type notificationSinkSpec struct {
+	Name string `json:"name"`
+	// Kind of sink, see notificationSinkTypes. Defaults to webhook.
+	Type string `json:"type,omitempty"`
+	// URL the notifications are POSTed to
+	URL string `json:"url"`
+	// Lifecycle events sent to this sink. Defaults to all of them.
+	Events []string `json:"events,omitempty"`
+	// Go template of the request body, executed on the notification (e.g. `{"text": {{ .Summary | json }}}`).
+	// Defaults to the notification as JSON.
+	Body string `json:"body,omitempty"`
+	// Extra request headers, e.g. Authorization
+	Headers map[string]string `json:"headers,omitempty"`
+	// Key in a Secret of the namespace the body is signed with (HMAC-SHA256, in the X-Signature-256 header)
+	SigningSecret *corev1.SecretKeySelector `json:"signingSecret,omitempty"`
+	// Retries after a failed attempt (network error, 429 or 5xx). Defaults to 3.
+	Retries *int `json:"retries,omitempty"`
+}
+
+// notification is what the sinks receive, and what body templates are executed on.
+type notification struct {
+	Event      string    `json:"event"`
+	Namespace  string    `json:"namespace"`
+	Name       string    `json:"name"`
+	Generation int64     `json:"generation"`
+	Ready      string    `json:"ready,omitempty"` // e.g. "3/3"
+	Message    string    `json:"message,omitempty"`
+	Time       time.Time `json:"time"`
+	// One line for chat sinks, e.g. `team-a/web: Available (3/3 replicas available)`
+	Summary string `json:"summary"`
+}
+
+// notificationSink delivers a notification. Sinks are built from their spec by notificationSinkTypes.
+type notificationSink interface {
+	send(ctx context.Context, n notification) error
+}
+
+// notificationSinkTypes builds a sink from its spec, by `type`. `secret` is the signing key, if the spec names one.
+var notificationSinkTypes = map[string]func(spec notificationSinkSpec, secret []byte, client *http.Client) (notificationSink, error){
+	"webhook": newWebhookSink,
+}
+
+// queuedNotification is a notification waiting for the workers, with what's needed to find its sinks.
+type queuedNotification struct {
+	notification
+	annotation string // apiv1.NotificationsAnnotation of the ServiceDeployment
+}
+
+type notifier struct {
+	cfg   notificationsConfig
+	kube  kubernetes.Interface
+	live  *liveConfig // sinks of every namespace, from the OperatorConfig
+	http  *http.Client
+	queue chan queuedNotification
+}
+
+func newNotifier(cfg notificationsConfig, kube kubernetes.Interface, live *liveConfig) *notifier {
+	return &notifier{
+		cfg:   cfg,
+		kube:  kube,
+		live:  live,
+		http:  &http.Client{Timeout: cfg.Timeout.Duration},
+		queue: make(chan queuedNotification, cfg.QueueSize),
+	}
+}
+
+// templateHash returns a short hash of the pod template rendered for `sd`, to tell rollouts and rollbacks apart.
+func templateHash(sd, effective *apiv1.ServiceDeployment, class *apiv1.ServiceDeploymentClass) string {
+	var dep appsv1.Deployment
+	renderDeployment(&dep, sd, effective, class)
+	data, err := json.Marshal(dep.Spec.Template)
+	if err != nil {
+		return ""
+	}
+	h := fnv.New64a()
+	h.Write(data)
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// fillTemplateHash records `hash` in `dst`, keeping the one it replaces.
+func fillTemplateHash(dst *apiv1.ServiceDeploymentStatus, hash string) {
+	if hash == "" || hash == dst.TemplateHash {
+		return
+	}
+	dst.PreviousTemplateHash = dst.TemplateHash
+	dst.TemplateHash = hash
+}
+
+// lifecycleEvents returns the lifecycle events `sd` went through between the `old` and `new` status.
+func lifecycleEvents(old, new *apiv1.ServiceDeploymentStatus) []string {
+	var events []string
+	if new.TemplateHash != old.TemplateHash && new.TemplateHash != "" {
+		if old.PreviousTemplateHash != "" && new.TemplateHash == old.PreviousTemplateHash {
+			events = append(events, notifyRolledBack)
+		} else {
+			events = append(events, notifyRolloutStarted)
+		}
+	}
+	for _, t := range []string{apiv1.ConditionAvailable, apiv1.ConditionDegraded} {
+		if meta.IsStatusConditionTrue(new.Conditions, t) && !meta.IsStatusConditionTrue(old.Conditions, t) {
+			events = append(events, t) // same names as the conditions
+		}
+	}
+	return events
+}
+
+// observe queues a notification for every lifecycle event between the `old` status of `sd` and its current one.
+// Does nothing on a nil notifier. Never blocks: with a full queue the notification is dropped.
+func (n *notifier) observe(ctx context.Context, sd *apiv1.ServiceDeployment, old *apiv1.ServiceDeploymentStatus) {
+	if n == nil {
+		return
+	}
+	for _, event := range lifecycleEvents(old, &sd.Status) {
+		q := queuedNotification{
+			notification: notification{
+				Event:      event,
+				Namespace:  sd.Namespace,
+				Name:       sd.Name,
+				Generation: sd.Generation,
+				Ready:      sd.Status.Ready,
+				Message:    lifecycleMessage(event, sd),
+				Time:       time.Now().UTC(),
+			},
+			annotation: sd.Annotations[apiv1.NotificationsAnnotation],
+		}
+		q.Summary = fmt.Sprintf("%s/%s: %s", sd.Namespace, sd.Name, event)
+		if q.Message != "" {
+			q.Summary += " (" + q.Message + ")"
+		}
+		select {
+		case n.queue <- q:
+		default:
+			notificationsSent.WithLabelValues("", event, "dropped").Inc()
+			log.FromContext(ctx).Info("notification queue full, dropping notification", "event", event)
+		}
+	}
+}
+
+func lifecycleMessage(event string, sd *apiv1.ServiceDeployment) string {
+	switch event {
+	case notifyAvailable:
+		if c := meta.FindStatusCondition(sd.Status.Conditions, apiv1.ConditionAvailable); c != nil {
+			return c.Message
+		}
+	case notifyDegraded:
+		if c := meta.FindStatusCondition(sd.Status.Conditions, apiv1.ConditionDegraded); c != nil {
+			return c.Reason + ": " + c.Message
+		}
+	case notifyRolloutStarted, notifyRolledBack:
+		var images []string
+		for _, c := range sd.Spec.Containers {
+			images = append(images, c.Image)
+		}
+		return strings.Join(images, ", ")
+	}
+	return ""
+}
+
+// Start sends the queued notifications until `ctx` is done. Whichever replica reconciles also notifies.
+func (n *notifier) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("notifications")
+	for range notificationWorkers {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case q := <-n.queue:
+					n.deliver(log.IntoContext(ctx, logger.WithValues("servicedeployment", q.Namespace+"/"+q.Name, "event", q.Event)), q)
+				}
+			}
+		}()
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func (n *notifier) NeedLeaderElection() bool {
+	return false
+}
+
+// deliver sends `q` to every sink of its ServiceDeployment that subscribed to the event.
+func (n *notifier) deliver(ctx context.Context, q queuedNotification) {
+	logger := log.FromContext(ctx)
+	specs, err := n.sinkSpecs(ctx, q)
+	if err != nil {
+		notificationsSent.WithLabelValues("", q.Event, "invalid").Inc()
+		logger.Error(err, "invalid notification sinks")
+	}
+	for _, spec := range specs {
+		if len(spec.Events) > 0 && !slices.Contains(spec.Events, q.Event) {
+			continue
+		}
+		sink, err := n.sink(ctx, q.Namespace, spec)
+		if err != nil {
+			notificationsSent.WithLabelValues(spec.Name, q.Event, "invalid").Inc()
+			logger.Error(err, "invalid notification sink", "sink", spec.Name)
+			continue
+		}
+		if err := sink.send(ctx, q.notification); err != nil {
+			notificationsSent.WithLabelValues(spec.Name, q.Event, "failed").Inc()
+			logger.Error(err, "failed to send notification", "sink", spec.Name)
+			continue
+		}
+		notificationsSent.WithLabelValues(spec.Name, q.Event, "sent").Inc()
+		logger.V(1).Info("notification sent", "sink", spec.Name)
+	}
+}
+
+// sinkSpecs returns the sinks of the OperatorConfig, then those of the namespace's ConfigMap, then the allowed ones of the annotation.
+// Read on demand, so the operator doesn't have to cache every ConfigMap in the cluster.
+func (n *notifier) sinkSpecs(ctx context.Context, q queuedNotification) ([]notificationSinkSpec, error) {
+	live := n.live.load()
+	specs := slices.Clone(live.NotificationSinks)
+	allowed := slices.Clone(live.AllowedNotificationURLs)
+	var errs []error
+	cm, err := n.kube.CoreV1().ConfigMaps(q.Namespace).Get(ctx, n.cfg.ConfigMapName, metav1.GetOptions{})
+	switch {
+	case k8serrors.IsNotFound(err):
+	case err != nil:
+		errs = append(errs, fmt.Errorf("get configmap %q: %w", n.cfg.ConfigMapName, err))
+	default:
+		parsed, err := parseNotificationSinks(cm.Data[notificationSinksKey])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("configmap %q: %w", n.cfg.ConfigMapName, err))
+		}
+		specs = append(specs, parsed...)
+		prefixes, err := parseURLPrefixes(cm.Data[notificationAllowedURLsKey])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("configmap %q: %s: %w", n.cfg.ConfigMapName, notificationAllowedURLsKey, err))
+		}
+		allowed = append(allowed, prefixes...)
+	}
+	parsed, err := parseNotificationSinks(q.annotation)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("annotation %s: %w", apiv1.NotificationsAnnotation, err))
+	}
+	for _, spec := range parsed {
+		switch {
+		case spec.SigningSecret != nil:
+			errs = append(errs, fmt.Errorf("annotation %s: %s: signingSecret is only allowed in the ConfigMap", apiv1.NotificationsAnnotation, spec.Name))
+		case !urlAllowed(spec.URL, allowed):
+			errs = append(errs, fmt.Errorf("annotation %s: %s: url not in %s of the ConfigMap nor allowedNotificationURLs of the OperatorConfig",
+				apiv1.NotificationsAnnotation, spec.Name, notificationAllowedURLsKey))
+		default:
+			specs = append(specs, spec)
+		}
+	}
+	return specs, errors.Join(errs...)
+}
+
+// parseURLPrefixes parses a YAML list of URL prefixes and validates them.
+func parseURLPrefixes(data string) ([]string, error) {
+	if strings.TrimSpace(data) == "" {
+		return nil, nil
+	}
+	var prefixes []string
+	if err := yaml.UnmarshalStrict([]byte(data), &prefixes); err != nil {
+		return nil, err
+	}
+	var errs []error
+	valid := prefixes[:0]
+	for i, prefix := range prefixes {
+		if err := validateURLPrefix(prefix); err != nil {
+			errs = append(errs, fmt.Errorf("[%d]: %w", i, err))
+			continue
+		}
+		valid = append(valid, prefix)
+	}
+	return valid, errors.Join(errs...)
+}
+
+// validateURLPrefix checks an entry of the allowed URLs: an http(s) URL with a host, and maybe a path.
+func validateURLPrefix(prefix string) error {
+	u, err := url.Parse(prefix)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%q must be http or https", prefix)
+	}
+	if u.Host == "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("%q must be a scheme, a host and maybe a path", prefix)
+	}
+	return nil
+}
+
+// urlAllowed reports whether `raw` is below one of the `prefixes`: the same scheme and host, and a path
+// starting with the prefix's path at a segment boundary. URLs with credentials or dot segments never are.
+func urlAllowed(raw string, prefixes []string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.User != nil || slices.ContainsFunc(strings.Split(u.Path, "/"), func(seg string) bool { return seg == "." || seg == ".." }) {
+		return false
+	}
+	return slices.ContainsFunc(prefixes, func(prefix string) bool {
+		p, err := url.Parse(prefix)
+		if err != nil || p.Scheme != u.Scheme || !strings.EqualFold(p.Host, u.Host) {
+			return false
+		}
+		dir := strings.TrimSuffix(p.Path, "/")
+		return u.Path == dir || strings.HasPrefix(u.Path, dir+"/")
+	})
+}
+
+// parseNotificationSinks parses a YAML list of sinks and validates them.
+func parseNotificationSinks(data string) ([]notificationSinkSpec, error) {
+	if strings.TrimSpace(data) == "" {
+		return nil, nil
+	}
+	var specs []notificationSinkSpec
+	if err := yaml.UnmarshalStrict([]byte(data), &specs); err != nil {
+		return nil, err
+	}
+	var errs []error
+	valid := specs[:0]
+	for i, spec := range specs {
+		if err := spec.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("sinks[%d]: %w", i, err))
+			continue
+		}
+		valid = append(valid, spec)
+	}
+	return valid, errors.Join(errs...)
+}
+
+func (s *notificationSinkSpec) validate() error {
+	if s.Name == "" {
+		return errors.New("name must be set")
+	}
+	if _, ok := notificationSinkTypes[s.sinkType()]; !ok {
+		return fmt.Errorf("%s: unknown type %q", s.Name, s.Type)
+	}
+	for _, e := range s.Events {
+		if !slices.Contains(notificationEvents, e) {
+			return fmt.Errorf("%s: unknown event %q, must be one of %s", s.Name, e, strings.Join(notificationEvents, ", "))
+		}
+	}
+	if s.Retries != nil && *s.Retries < 0 {
+		return fmt.Errorf("%s: retries must not be negative", s.Name)
+	}
+	return nil
+}
+
+func (s *notificationSinkSpec) sinkType() string {
+	if s.Type == "" {
+		return "webhook"
+	}
+	return s.Type
+}
+
+// sink builds the sink of `spec`, reading its signing key from a Secret in `namespace`. The Secret must be labeled
+// as a signing key: the operator may read every Secret, those who write the ConfigMap may not.
+func (n *notifier) sink(ctx context.Context, namespace string, spec notificationSinkSpec) (notificationSink, error) {
+	var secret []byte
+	if ref := spec.SigningSecret; ref != nil {
+		s, err := n.kube.CoreV1().Secrets(namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("get signing secret: %w", err)
+		}
+		if s.Labels[apiv1.NotificationSigningKeyLabel] != "true" {
+			return nil, fmt.Errorf("signing secret %q is not labeled %s=true", ref.Name, apiv1.NotificationSigningKeyLabel)
+		}
+		var ok bool
+		if secret, ok = s.Data[ref.Key]; !ok {
+			return nil, fmt.Errorf("signing secret %q has no key %q", ref.Name, ref.Key)
+		}
+	}
+	return notificationSinkTypes[spec.sinkType()](spec, secret, n.http)
+}
+
+// webhookSink POSTs the notification to a URL.
+type webhookSink struct {
+	url     string
+	body    *template.Template // nil: the notification as JSON
+	headers map[string]string
+	secret  []byte
+	retries int
+	client  *http.Client
+}
+
+func newWebhookSink(spec notificationSinkSpec, secret []byte, client *http.Client) (notificationSink, error) {
+	if !strings.HasPrefix(spec.URL, "http://") && !strings.HasPrefix(spec.URL, "https://") {
+		return nil, fmt.Errorf("url %q must be http or https", spec.URL)
+	}
+	s := &webhookSink{url: spec.URL, headers: spec.Headers, secret: secret, retries: 3, client: client}
+	if spec.Retries != nil {
+		s.retries = *spec.Retries
+	}
+	if spec.Body != "" {
+		t, err := template.New(spec.Name).Funcs(template.FuncMap{"json": templateJSON}).Option("missingkey=error").Parse(spec.Body)
+		if err != nil {
+			return nil, fmt.Errorf("parse body: %w", err)
+		}
+		s.body = t
+	}
+	return s, nil
+}
+
+// templateJSON encodes `v` as JSON, so body templates can embed strings safely.
+func templateJSON(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+func (s *webhookSink) send(ctx context.Context, n notification) error {
+	var body []byte
+	if s.body == nil {
+		var err error
+		if body, err = json.Marshal(n); err != nil {
+			return err
+		}
+	} else {
+		var buf bytes.Buffer
+		if err := s.body.Execute(&buf, n); err != nil {
+			return fmt.Errorf("render body: %w", err)
+		}
+		body = buf.Bytes()
+	}
+
+	var lastErr error
+	delay := notificationRetryDelay
+	for attempt := 0; attempt <= s.retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return errors.Join(lastErr, ctx.Err())
+			case <-time.After(wait.Jitter(delay, 0.1)):
+			}
+			delay *= 2
+		}
+		retry, err := s.post(ctx, body)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		if !retry {
+			break
+		}
+	}
+	return lastErr
+}
+
+// post sends one request. It reports whether a failure is worth retrying.
+func (s *webhookSink) post(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "servicedeployments-operator")
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+	if s.secret != nil {
+		mac := hmac.New(sha256.New, s.secret)
+		mac.Write(body)
+		req.Header.Set("X-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		// Without the URL, which often embeds a token (e.g. Slack incoming webhooks)
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return true, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("sink responded %s", resp.Status)
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	apiv1 "github.com/jayantasamaddar/quick-reference-kubernetes/solutions/hello-crd-scaling/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+// sinkServer is a local webhook receiver answering with `statuses` in turn, then 200.
+type sinkServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	requests []sinkRequest
+}
+
+type sinkRequest struct {
+	path   string
+	header http.Header
+	body   string
+}
+
+func newSinkServer(t *testing.T, statuses ...int) *sinkServer {
+	t.Helper()
+	s := &sinkServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.requests = append(s.requests, sinkRequest{path: r.URL.Path, header: r.Header.Clone(), body: string(body)})
+		if len(s.statuses) > 0 {
+			w.WriteHeader(s.statuses[0])
+			s.statuses = s.statuses[1:]
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *sinkServer) received() []sinkRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.requests)
+}
+
+// fastRetries shortens the delay between attempts for the duration of the test.
+func fastRetries(t *testing.T) {
+	delay := notificationRetryDelay
+	notificationRetryDelay = time.Millisecond
+	t.Cleanup(func() { notificationRetryDelay = delay })
+}
+
+var testNotification = notification{
+	Event:      notifyAvailable,
+	Namespace:  "team-a",
+	Name:       "web",
+	Generation: 3,
+	Ready:      "2/2",
+	Time:       time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+	Summary:    `team-a/web: Available ("2/2")`,
+}
+
+func TestWebhookSinkBody(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{
+			name: "templated",
+			body: `{"text": {{ .Summary | json }}, "generation": {{ .Generation }}}`,
+			want: `{"text": "team-a/web: Available (\"2/2\")", "generation": 3}`,
+		},
+		{
+			name: "default",
+			want: `{"event":"Available","namespace":"team-a","name":"web","generation":3,"ready":"2/2","time":"2026-01-02T03:04:05Z","summary":"team-a/web: Available (\"2/2\")"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newSinkServer(t)
+			spec := notificationSinkSpec{Name: "chat", URL: srv.URL + "/hook", Body: tt.body, Headers: map[string]string{"Authorization": "Bearer abc"}}
+			sink, err := newWebhookSink(spec, nil, srv.Client())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := sink.send(context.Background(), testNotification); err != nil {
+				t.Fatalf("send: %v", err)
+			}
+			requests := srv.received()
+			if len(requests) != 1 {
+				t.Fatalf("got %d requests, want 1", len(requests))
+			}
+			req := requests[0]
+			if req.body != tt.want {
+				t.Errorf("body:\n got %s\nwant %s", req.body, tt.want)
+			}
+			if got := req.header.Get("Authorization"); got != "Bearer abc" {
+				t.Errorf("Authorization header: got %q", got)
+			}
+			if got := req.header.Get("X-Signature-256"); got != "" {
+				t.Errorf("X-Signature-256 without a signing secret: got %q", got)
+			}
+		})
+	}
+}
+
+func TestWebhookSinkSignature(t *testing.T) {
+	srv := newSinkServer(t)
+	secret := []byte("s3cret")
+	sink, err := newWebhookSink(notificationSinkSpec{Name: "incidents", URL: srv.URL}, secret, srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.send(context.Background(), testNotification); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	req := srv.received()[0]
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(req.body))
+	if got, want := req.header.Get("X-Signature-256"), "sha256="+hex.EncodeToString(mac.Sum(nil)); got != want {
+		t.Errorf("X-Signature-256: got %q, want %q", got, want)
+	}
+}
+
+func TestWebhookSinkRetries(t *testing.T) {
+	fastRetries(t)
+	tests := []struct {
+		name         string
+		statuses     []int
+		retries      int
+		wantAttempts int
+		wantErr      bool
+	}{
+		{name: "5xx and 429 are retried", statuses: []int{500, 429, 503}, retries: 3, wantAttempts: 4},
+		{name: "until the retries run out", statuses: []int{502, 502, 502}, retries: 2, wantAttempts: 3, wantErr: true},
+		{name: "4xx is not retried", statuses: []int{400}, retries: 3, wantAttempts: 1, wantErr: true},
+		{name: "404 is not retried", statuses: []int{404}, retries: 3, wantAttempts: 1, wantErr: true},
+		{name: "no retries", statuses: []int{500}, retries: 0, wantAttempts: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newSinkServer(t, tt.statuses...)
+			sink, err := newWebhookSink(notificationSinkSpec{Name: "hook", URL: srv.URL, Retries: &tt.retries}, nil, srv.Client())
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = sink.send(context.Background(), testNotification)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("send: got error %v, want error %t", err, tt.wantErr)
+			}
+			if got := len(srv.received()); got != tt.wantAttempts {
+				t.Errorf("got %d attempts, want %d", got, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+// newTestNotifier returns a notifier reading the ConfigMaps and Secrets in `objs`, with the OperatorConfig settings `live`.
+func newTestNotifier(live *liveSettings, objs ...runtime.Object) *notifier {
+	cfg := notificationsConfig{Enabled: true, ConfigMapName: "servicedeployment-notifications", Timeout: metav1.Duration{Duration: 5 * time.Second}, QueueSize: 10}
+	lc := newLiveConfig(1, nil)
+	if live != nil {
+		lc.store(live)
+	} else {
+		lc.store(lc.defaults())
+	}
+	return newNotifier(cfg, kubefake.NewClientset(objs...), lc)
+}
+
+func notificationsConfigMap(data map[string]string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "servicedeployment-notifications"}, Data: data}
+}
+
+func TestDeliverEventsFilter(t *testing.T) {
+	srv := newSinkServer(t)
+	n := newTestNotifier(nil, notificationsConfigMap(map[string]string{
+		"sinks": `
+- name: degraded-only
+  url: ` + srv.URL + `/degraded
+  events: [Degraded]
+- name: all
+  url: ` + srv.URL + `/all
+`,
+	}))
+
+	for _, tt := range []struct {
+		event string
+		want  []string
+	}{
+		{event: notifyAvailable, want: []string{"/all"}},
+		{event: notifyDegraded, want: []string{"/degraded", "/all"}},
+	} {
+		t.Run(tt.event, func(t *testing.T) {
+			before := len(srv.received())
+			q := queuedNotification{notification: testNotification}
+			q.Event = tt.event
+			n.deliver(context.Background(), q)
+
+			var paths []string
+			for _, req := range srv.received()[before:] {
+				paths = append(paths, req.path)
+			}
+			if !slices.Equal(paths, tt.want) {
+				t.Errorf("sinks sent to: got %v, want %v", paths, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnnotationSinks(t *testing.T) {
+	tests := []struct {
+		name         string
+		configMap    map[string]string
+		operatorURLs []string
+		annotation   string
+		wantSinks    []string
+		wantErr      string
+	}{
+		{
+			name:       "not allowed anywhere",
+			annotation: "- name: mine\n  url: https://hooks.example.com/a",
+			wantErr:    "url not in allowedAnnotationURLs",
+		},
+		{
+			name:       "allowed by the ConfigMap",
+			configMap:  map[string]string{"allowedAnnotationURLs": "- https://hooks.example.com/team-a/"},
+			annotation: "- name: mine\n  url: https://hooks.example.com/team-a/web",
+			wantSinks:  []string{"mine"},
+		},
+		{
+			name:         "allowed by the OperatorConfig",
+			operatorURLs: []string{"https://hooks.example.com"},
+			annotation:   "- name: mine\n  url: https://hooks.example.com/any/path",
+			wantSinks:    []string{"mine"},
+		},
+		{
+			name:         "another host",
+			operatorURLs: []string{"https://hooks.example.com"},
+			annotation:   "- name: metadata\n  url: http://169.254.169.254/latest/meta-data\n- name: suffix\n  url: https://hooks.example.com.evil.test/a",
+			wantErr:      "url not in allowedAnnotationURLs",
+		},
+		{
+			name:         "another scheme",
+			operatorURLs: []string{"https://hooks.example.com"},
+			annotation:   "- name: mine\n  url: http://hooks.example.com/a",
+			wantErr:      "url not in allowedAnnotationURLs",
+		},
+		{
+			name:       "outside the prefix path",
+			configMap:  map[string]string{"allowedAnnotationURLs": "- https://hooks.example.com/team-a"},
+			annotation: "- name: sibling\n  url: https://hooks.example.com/team-ab/web\n- name: dots\n  url: https://hooks.example.com/team-a/../team-b",
+			wantErr:    "url not in allowedAnnotationURLs",
+		},
+		{
+			name:         "with a signing secret",
+			operatorURLs: []string{"https://hooks.example.com"},
+			annotation:   "- name: mine\n  url: https://hooks.example.com/a\n  signingSecret: {name: other-team, key: token}",
+			wantErr:      "signingSecret is only allowed in the ConfigMap",
+		},
+		{
+			name:       "invalid prefix in the ConfigMap",
+			configMap:  map[string]string{"allowedAnnotationURLs": "- hooks.example.com"},
+			annotation: "- name: mine\n  url: https://hooks.example.com/a",
+			wantErr:    "must be http or https",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var objs []runtime.Object
+			if tt.configMap != nil {
+				objs = append(objs, notificationsConfigMap(tt.configMap))
+			}
+			live := newLiveConfig(1, nil).defaults()
+			live.AllowedNotificationURLs = tt.operatorURLs
+			n := newTestNotifier(live, objs...)
+
+			specs, err := n.sinkSpecs(context.Background(), queuedNotification{notification: testNotification, annotation: tt.annotation})
+			var names []string
+			for _, spec := range specs {
+				names = append(names, spec.Name)
+			}
+			if !slices.Equal(names, tt.wantSinks) {
+				t.Errorf("sinks: got %v, want %v", names, tt.wantSinks)
+			}
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("got error %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("got error %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSigningSecretLabel(t *testing.T) {
+	secret := func(name string, labels map[string]string) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: name, Labels: labels},
+			Data:       map[string][]byte{"key": []byte("s3cret")},
+		}
+	}
+	n := newTestNotifier(nil,
+		secret("labeled", map[string]string{apiv1.NotificationSigningKeyLabel: "true"}),
+		secret("database", nil),
+	)
+	for _, tt := range []struct {
+		secret  string
+		wantErr bool
+	}{
+		{secret: "labeled"},
+		{secret: "database", wantErr: true},
+	} {
+		t.Run(tt.secret, func(t *testing.T) {
+			spec := notificationSinkSpec{Name: "hook", URL: "https://hooks.example.com", SigningSecret: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: tt.secret}, Key: "key",
+			}}
+			_, err := n.sink(context.Background(), "team-a", spec)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
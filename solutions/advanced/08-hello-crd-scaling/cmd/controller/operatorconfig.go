@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	apiv1 "github.com/jayantasamaddar/quick-reference-kubernetes/solutions/hello-crd-scaling/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Feature gates an OperatorConfig can turn on or off, with their defaults
+const (
+	// Hold the Deployment at zero replicas until every `spec.dependsOn` entry is Available
+	featureDependencies = "Dependencies"
+	// Expand `spec.probes` into container probes
+	featureProbesShorthand = "ProbesShorthand"
+)
+
+var featureGates = map[string]bool{
+	featureDependencies:    true,
+	featureProbesShorthand: true,
+}
+
+// liveSettings is what the OperatorConfig sets, with the defaults filled in.
+// Never modified once stored: a change of the OperatorConfig replaces it as a whole.
+type liveSettings struct {
+	// OperatorConfig the settings come from, and the generation applied. Empty: there is none, these are the defaults.
+	Source     string `json:"source,omitempty"`
+	Generation int64  `json:"generation,omitempty"`
+
+	DefaultClassName        string                 `json:"defaultClassName,omitempty"`
+	Paused                  bool                   `json:"paused"`
+	DriftPolicy             apiv1.DriftPolicy      `json:"driftPolicy"`
+	MaxConcurrentReconciles int                    `json:"maxConcurrentReconciles"`
+	EventVerbosity          apiv1.EventVerbosity   `json:"eventVerbosity"`
+	NotificationSinks       []notificationSinkSpec `json:"notificationSinks,omitempty"`
+	AllowedNotificationURLs []string               `json:"allowedNotificationURLs,omitempty"`
+	FeatureGates            map[string]bool        `json:"featureGates"`
+	// Kinds `spec.extraResources` may hold: the OperatorConfig's, else the operator's own
+	AllowedExtraResources []metav1.GroupVersionKind `json:"allowedExtraResources,omitempty"`
+}
+
+func (s *liveSettings) enabled(gate string) bool {
+	return s.FeatureGates[gate]
+}
+
+// allowsExtraResource reports whether `spec.extraResources` may hold objects of `gvk`.
+func (s *liveSettings) allowsExtraResource(gvk schema.GroupVersionKind) bool {
+	return slices.ContainsFunc(s.AllowedExtraResources, func(allowed metav1.GroupVersionKind) bool {
+		return allowed.Group == gvk.Group && allowed.Kind == gvk.Kind && (allowed.Version == "" || allowed.Version == gvk.Version)
+	})
+}
+
+// records reports whether Events of `eventtype` are recorded at the configured verbosity.
+func (s *liveSettings) records(eventtype string) bool {
+	switch s.EventVerbosity {
+	case apiv1.EventVerbosityNone:
+		return false
+	case apiv1.EventVerbosityWarnings:
+		return eventtype == corev1.EventTypeWarning
+	}
+	return true
+}
+
+// redacted returns a copy safe to show: sink URLs and headers often hold tokens.
+func (s *liveSettings) redacted() *liveSettings {
+	out := *s
+	out.NotificationSinks = make([]notificationSinkSpec, len(s.NotificationSinks))
+	for i, sink := range s.NotificationSinks {
+		if u, err := url.Parse(sink.URL); err == nil {
+			sink.URL = (&url.URL{Scheme: u.Scheme, Host: u.Host}).String()
+		} else {
+			sink.URL = "<redacted>"
+		}
+		headers := make(map[string]string, len(sink.Headers))
+		for k := range sink.Headers {
+			headers[k] = "<redacted>"
+		}
+		sink.Headers = headers
+		out.NotificationSinks[i] = sink
+	}
+	return &out
+}
+
+// liveConfig holds the settings in effect, read by the reconcilers, the event recorder and the notifier on every use.
+type liveConfig struct {
+	current       atomic.Pointer[liveSettings]
+	loaded        chan struct{} // closed once the settings were stored for the first time
+	loadedOnce    sync.Once
+	maxConcurrent int                       // the operator's own `maxConcurrentReconciles`, the ceiling of the OperatorConfig's
+	allowedExtra  []metav1.GroupVersionKind // the operator's own `allowedExtraResources`
+	limiter       concurrencyLimiter
+}
+
+func newLiveConfig(maxConcurrent int, allowedExtra []metav1.GroupVersionKind) *liveConfig {
+	c := &liveConfig{loaded: make(chan struct{}), maxConcurrent: maxConcurrent, allowedExtra: allowedExtra}
+	c.current.Store(c.defaults())
+	c.limiter.wake = make(chan struct{})
+	return c
+}
+
+// defaults are the settings without an OperatorConfig: the operator behaves as configured by its flags.
+func (c *liveConfig) defaults() *liveSettings {
+	return &liveSettings{
+		DriftPolicy:             apiv1.DriftPolicyCorrect,
+		MaxConcurrentReconciles: c.maxConcurrent,
+		EventVerbosity:          apiv1.EventVerbosityAll,
+		FeatureGates:            maps.Clone(featureGates),
+		AllowedExtraResources:   c.allowedExtra,
+	}
+}
+
+func (c *liveConfig) load() *liveSettings {
+	return c.current.Load()
+}
+
+// store puts `s` in effect and returns the settings it replaces. Reconciles waiting for the first settings proceed.
+func (c *liveConfig) store(s *liveSettings) *liveSettings {
+	old := c.current.Swap(s)
+	c.limiter.setLimit(s.MaxConcurrentReconciles)
+	c.markLoaded()
+	return old
+}
+
+// markLoaded lets the reconciles waiting for the first settings proceed with those in effect.
+func (c *liveConfig) markLoaded() {
+	c.loadedOnce.Do(func() { close(c.loaded) })
+}
+
+func (c *liveConfig) isLoaded() bool {
+	select {
+	case <-c.loaded:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait waits for the first settings.
+func (c *liveConfig) wait(ctx context.Context) error {
+	select {
+	case <-c.loaded:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// acquire waits for the first settings, then for a reconcile slot. Every successful acquire needs a release.
+func (c *liveConfig) acquire(ctx context.Context) error {
+	if err := c.wait(ctx); err != nil {
+		return err
+	}
+	return c.limiter.acquire(ctx)
+}
+
+func (c *liveConfig) release() {
+	c.limiter.release()
+}
+
+// concurrencyLimiter is a semaphore whose size can change while it is held.
+// controller-runtime fixes the number of workers at start; this holds back the ones above the current limit.
+type concurrencyLimiter struct {
+	mu     sync.Mutex
+	limit  int // 0: no limit
+	active int
+	wake   chan struct{} // closed (and replaced) whenever a slot may have become free
+}
+
+func (l *concurrencyLimiter) acquire(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		if l.limit <= 0 || l.active < l.limit {
+			l.active++
+			l.mu.Unlock()
+			return nil
+		}
+		wake := l.wake
+		l.mu.Unlock()
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (l *concurrencyLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	l.broadcast()
+}
+
+func (l *concurrencyLimiter) setLimit(limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = limit
+	l.broadcast()
+}
+
+func (l *concurrencyLimiter) broadcast() {
+	close(l.wake)
+	l.wake = make(chan struct{})
+}
+
+// operatorConfigReconciler applies the OperatorConfig named `name` to `live`, and reports in its status whether it is valid.
+// An invalid OperatorConfig leaves the last valid settings in effect.
+type operatorConfigReconciler struct {
+	client.Client
+	name   string
+	live   *liveConfig
+	dryRun bool // don't write the status
+
+	// Every ServiceDeployment (and ServiceDeploymentSet) is requeued after a change, e.g. to pick up a new default class
+	events    chan event.GenericEvent
+	setEvents chan event.GenericEvent // nil without the ServiceDeploymentSet controller
+	// The first reconcile, even if there is no OperatorConfig to trigger it (see Start)
+	initial chan event.GenericEvent
+}
+
+func newOperatorConfigReconciler(c client.Client, name string, live *liveConfig, dryRun bool) *operatorConfigReconciler {
+	return &operatorConfigReconciler{
+		Client:  c,
+		name:    name,
+		live:    live,
+		dryRun:  dryRun,
+		events:  make(chan event.GenericEvent),
+		initial: make(chan event.GenericEvent),
+	}
+}
+
+// Start enqueues the OperatorConfig once, so the defaults are put in effect when it doesn't exist.
+// Until then the reconcilers wait. Leader elected like the controllers, so it runs wherever they do.
+func (r *operatorConfigReconciler) Start(ctx context.Context) error {
+	select {
+	case r.initial <- event.GenericEvent{Object: &apiv1.OperatorConfig{ObjectMeta: metav1.ObjectMeta{Name: r.name}}}:
+	case <-ctx.Done():
+	}
+	return nil
+}
+
+func (r *operatorConfigReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx).WithValues("operatorconfig", req.Name)
+
+	var oc apiv1.OperatorConfig
+	if err := r.Get(ctx, req.NamespacedName, &oc); err != nil {
+		if client.IgnoreNotFound(err) != nil {
+			return ctrl.Result{}, fmt.Errorf("get operatorconfig: %w", err)
+		}
+		// None (anymore): back to the defaults
+		r.apply(ctx, r.live.defaults())
+		return ctrl.Result{}, nil
+	}
+
+	settings, err := r.resolve(&oc)
+	if err != nil {
+		logger.Error(err, "invalid operatorconfig, keeping the settings in effect", "generation", oc.Generation)
+		r.live.markLoaded()
+	} else {
+		r.apply(ctx, settings)
+	}
+	return ctrl.Result{}, r.syncStatus(ctx, &oc, err)
+}
+
+// apply puts `settings` in effect and, unless they are the same, requeues everything they may change.
+func (r *operatorConfigReconciler) apply(ctx context.Context, settings *liveSettings) {
+	// Nothing was reconciled before the first settings
+	first := !r.live.isLoaded()
+	old := r.live.store(settings)
+	if first || reflect.DeepEqual(old, settings) {
+		return
+	}
+	log.FromContext(ctx).Info("operatorconfig applied", "operatorconfig", settings.Source, "generation", settings.Generation, "paused", settings.Paused)
+	r.requeueAll(ctx)
+}
+
+// resolve validates the spec of `oc` and returns the settings it makes. The errors name the offending fields.
+func (r *operatorConfigReconciler) resolve(oc *apiv1.OperatorConfig) (*liveSettings, error) {
+	spec := &oc.Spec
+	s := r.live.defaults()
+	s.Source, s.Generation = oc.Name, oc.Generation
+	var errs []string
+
+	if spec.DefaultClassName != "" {
+		for _, msg := range validation.IsDNS1123Subdomain(spec.DefaultClassName) {
+			errs = append(errs, fmt.Sprintf("spec.defaultClassName: %s", msg))
+		}
+		s.DefaultClassName = spec.DefaultClassName
+	}
+	s.Paused = spec.Paused
+	switch spec.DriftPolicy {
+	case "":
+	case apiv1.DriftPolicyCorrect, apiv1.DriftPolicyReport:
+		s.DriftPolicy = spec.DriftPolicy
+	default:
+		errs = append(errs, fmt.Sprintf("spec.driftPolicy: %q: must be Correct or Report", spec.DriftPolicy))
+	}
+	switch {
+	case spec.MaxConcurrentReconciles < 0:
+		errs = append(errs, fmt.Sprintf("spec.maxConcurrentReconciles: must not be negative, got %d", spec.MaxConcurrentReconciles))
+	case spec.MaxConcurrentReconciles > r.live.maxConcurrent:
+		errs = append(errs, fmt.Sprintf("spec.maxConcurrentReconciles: must be at most %d (the operator's maxConcurrentReconciles), got %d", r.live.maxConcurrent, spec.MaxConcurrentReconciles))
+	case spec.MaxConcurrentReconciles > 0:
+		s.MaxConcurrentReconciles = spec.MaxConcurrentReconciles
+	}
+	switch spec.EventVerbosity {
+	case "":
+	case apiv1.EventVerbosityAll, apiv1.EventVerbosityWarnings, apiv1.EventVerbosityNone:
+		s.EventVerbosity = spec.EventVerbosity
+	default:
+		errs = append(errs, fmt.Sprintf("spec.eventVerbosity: %q: must be All, Warnings or None", spec.EventVerbosity))
+	}
+	for i, sink := range spec.NotificationSinks {
+		sinkSpec := notificationSinkFromAPI(sink)
+		if err := sinkSpec.validate(); err != nil {
+			errs = append(errs, fmt.Sprintf("spec.notificationSinks[%d]: %v", i, err))
+			continue
+		}
+		s.NotificationSinks = append(s.NotificationSinks, sinkSpec)
+	}
+	for i, prefix := range spec.AllowedNotificationURLs {
+		if err := validateURLPrefix(prefix); err != nil {
+			errs = append(errs, fmt.Sprintf("spec.allowedNotificationURLs[%d]: %v", i, err))
+			continue
+		}
+		s.AllowedNotificationURLs = append(s.AllowedNotificationURLs, prefix)
+	}
+	for _, gate := range slices.Sorted(maps.Keys(spec.FeatureGates)) {
+		if _, ok := featureGates[gate]; !ok {
+			errs = append(errs, fmt.Sprintf("spec.featureGates: unknown feature gate %q, must be one of %s", gate, strings.Join(slices.Sorted(maps.Keys(featureGates)), ", ")))
+			continue
+		}
+		s.FeatureGates[gate] = spec.FeatureGates[gate]
+	}
+	if len(spec.AllowedExtraResources) > 0 {
+		s.AllowedExtraResources = nil
+	}
+	for i, gvk := range spec.AllowedExtraResources {
+		if gvk.Kind == "" {
+			errs = append(errs, fmt.Sprintf("spec.allowedExtraResources[%d].kind: must not be empty", i))
+			continue
+		}
+		s.AllowedExtraResources = append(s.AllowedExtraResources, gvk)
+	}
+
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return s, nil
+}
+
+func (r *operatorConfigReconciler) syncStatus(ctx context.Context, oc *apiv1.OperatorConfig, invalid error) error {
+	if r.dryRun {
+		return nil
+	}
+	desired := *oc.Status.DeepCopy()
+	desired.ObservedGeneration = oc.Generation
+	cond := metav1.Condition{
+		Type:               apiv1.ConditionValid,
+		Status:             metav1.ConditionTrue,
+		Reason:             "Applied",
+		Message:            "The settings are in effect",
+		ObservedGeneration: oc.Generation,
+	}
+	if invalid != nil {
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = "Invalid"
+		cond.Message = invalid.Error()
+		if applied := r.live.load(); applied.Source == oc.Name {
+			cond.Message += fmt.Sprintf(" (generation %d is still in effect)", applied.Generation)
+		}
+	}
+	meta.SetStatusCondition(&desired.Conditions, cond)
+
+	if equality.Semantic.DeepEqual(oc.Status, desired) {
+		return nil
+	}
+	orig := oc.DeepCopy()
+	oc.Status = desired
+	return r.Status().Patch(ctx, oc, client.MergeFrom(orig))
+}
+
+// requeueAll enqueues every ServiceDeployment and ServiceDeploymentSet; those this operator doesn't handle are filtered out as usual.
+func (r *operatorConfigReconciler) requeueAll(ctx context.Context) {
+	var sds apiv1.ServiceDeploymentList
+	if err := r.List(ctx, &sds); err != nil {
+		log.FromContext(ctx).Error(err, "failed to list servicedeployments to requeue")
+	}
+	for i := range sds.Items {
+		select {
+		case r.events <- event.GenericEvent{Object: &sds.Items[i]}:
+		case <-ctx.Done():
+			return
+		}
+	}
+	if r.setEvents == nil {
+		return
+	}
+	var sets apiv1.ServiceDeploymentSetList
+	if err := r.List(ctx, &sets); err != nil {
+		log.FromContext(ctx).Error(err, "failed to list servicedeploymentsets to requeue")
+	}
+	for i := range sets.Items {
+		select {
+		case r.setEvents <- event.GenericEvent{Object: &sets.Items[i]}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func notificationSinkFromAPI(sink apiv1.NotificationSink) notificationSinkSpec {
+	var in apiv1.NotificationSink
+	sink.DeepCopyInto(&in)
+	return notificationSinkSpec{
+		Name:          in.Name,
+		Type:          in.Type,
+		URL:           in.URL,
+		Events:        in.Events,
+		Body:          in.Body,
+		Headers:       in.Headers,
+		SigningSecret: in.SigningSecret,
+		Retries:       in.Retries,
+	}
+}
+
+// errDriftReported stops the update of a drifted child under `driftPolicy: Report`
+var errDriftReported = errors.New("child was changed outside the operator")
+
+// driftGuard wraps the mutate function of an existing child's createOrUpdate. Under `driftPolicy: Report`, if nothing the
+// child is rendered from changed since it was last rendered (`unchanged`) and yet it differs, the update fails with errDriftReported.
+func driftGuard(live *liveSettings, unchanged bool, obj client.Object, f controllerutil.MutateFn) controllerutil.MutateFn {
+	if live.DriftPolicy != apiv1.DriftPolicyReport || !unchanged {
+		return f
+	}
+	return func() error {
+		if obj.GetResourceVersion() == "" {
+			return f() // being created
+		}
+		before := obj.DeepCopyObject()
+		if err := f(); err != nil {
+			return err
+		}
+		if !equality.Semantic.DeepEqual(before, obj) {
+			return errDriftReported
+		}
+		return nil
+	}
+}
+
+// debugConfigHandler serves the configuration in effect: the operator's own (defaults < `--config` file < flags)
+// and the settings of its OperatorConfig.
+func debugConfigHandler(cfg operatorConfig, live *liveConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(struct {
+			Config         operatorConfig `json:"config"`
+			OperatorConfig *liveSettings  `json:"operatorConfig"`
+		}{cfg, live.load().redacted()})
+	})
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	apiv1 "github.com/jayantasamaddar/quick-reference-kubernetes/solutions/hello-crd-scaling/api/v1"
+
+	"github.com/google/go-cmp/cmp"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestResolveOperatorConfig(t *testing.T) {
+	operatorAllowed := []metav1.GroupVersionKind{{Version: "v1", Kind: "ConfigMap"}}
+	tests := []struct {
+		name    string
+		spec    apiv1.OperatorConfigSpec
+		want    func(s *liveSettings) // applied to the defaults
+		wantErr []string              // every part expected in the error
+	}{
+		{
+			name: "empty: the defaults",
+			want: func(*liveSettings) {},
+		},
+		{
+			name: "every field",
+			spec: apiv1.OperatorConfigSpec{
+				DefaultClassName:        "gold",
+				Paused:                  true,
+				DriftPolicy:             apiv1.DriftPolicyReport,
+				MaxConcurrentReconciles: 2,
+				EventVerbosity:          apiv1.EventVerbosityWarnings,
+				NotificationSinks:       []apiv1.NotificationSink{{Name: "chat", URL: "https://chat.example.com/hook"}},
+				AllowedNotificationURLs: []string{"https://hooks.example.com/team-a/"},
+				FeatureGates:            map[string]bool{featureDependencies: false},
+				AllowedExtraResources:   []metav1.GroupVersionKind{{Group: "policy", Kind: "PodDisruptionBudget"}},
+			},
+			want: func(s *liveSettings) {
+				s.DefaultClassName = "gold"
+				s.Paused = true
+				s.DriftPolicy = apiv1.DriftPolicyReport
+				s.MaxConcurrentReconciles = 2
+				s.EventVerbosity = apiv1.EventVerbosityWarnings
+				s.NotificationSinks = []notificationSinkSpec{{Name: "chat", URL: "https://chat.example.com/hook"}}
+				s.AllowedNotificationURLs = []string{"https://hooks.example.com/team-a/"}
+				s.FeatureGates[featureDependencies] = false
+				// Instead of the operator's own
+				s.AllowedExtraResources = []metav1.GroupVersionKind{{Group: "policy", Kind: "PodDisruptionBudget"}}
+			},
+		},
+		{
+			name: "maxConcurrentReconciles 0: the operator's",
+			spec: apiv1.OperatorConfigSpec{MaxConcurrentReconciles: 0},
+			want: func(*liveSettings) {},
+		},
+		{
+			name:    "maxConcurrentReconciles above the operator's",
+			spec:    apiv1.OperatorConfigSpec{MaxConcurrentReconciles: 5},
+			wantErr: []string{"spec.maxConcurrentReconciles: must be at most 4 (the operator's maxConcurrentReconciles), got 5"},
+		},
+		{
+			name: "invalid values, all reported",
+			spec: apiv1.OperatorConfigSpec{
+				DefaultClassName:        "Gold",
+				DriftPolicy:             "Ignore",
+				MaxConcurrentReconciles: -1,
+				EventVerbosity:          "Some",
+				NotificationSinks:       []apiv1.NotificationSink{{URL: "https://chat.example.com/hook"}},
+				AllowedNotificationURLs: []string{"ftp://files.example.com"},
+				FeatureGates:            map[string]bool{"Teleport": true},
+				AllowedExtraResources:   []metav1.GroupVersionKind{{Version: "v1"}},
+			},
+			wantErr: []string{
+				"spec.defaultClassName: ",
+				`spec.driftPolicy: "Ignore": must be Correct or Report`,
+				"spec.maxConcurrentReconciles: must not be negative, got -1",
+				`spec.eventVerbosity: "Some": must be All, Warnings or None`,
+				"spec.notificationSinks[0]: name must be set",
+				`spec.allowedNotificationURLs[0]: "ftp://files.example.com" must be http or https`,
+				`spec.featureGates: unknown feature gate "Teleport"`,
+				"spec.allowedExtraResources[0].kind: must not be empty",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newOperatorConfigReconciler(nil, "default", newLiveConfig(4, operatorAllowed), false)
+			oc := &apiv1.OperatorConfig{ObjectMeta: metav1.ObjectMeta{Name: "default", Generation: 3}, Spec: tt.spec}
+
+			got, err := r.resolve(oc)
+			if len(tt.wantErr) > 0 {
+				if err == nil {
+					t.Fatal("got no error")
+				}
+				for _, want := range tt.wantErr {
+					if !strings.Contains(err.Error(), want) {
+						t.Errorf("error %q doesn't contain %q", err, want)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			want := r.live.defaults()
+			want.Source, want.Generation = "default", 3
+			tt.want(want)
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("settings (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestOperatorConfigReconcile checks that an invalid OperatorConfig leaves the last valid settings in effect,
+// and that the defaults are back once it is deleted.
+func TestOperatorConfigReconcile(t *testing.T) {
+	ctx := context.Background()
+	oc := &apiv1.OperatorConfig{ObjectMeta: metav1.ObjectMeta{Name: "default", Generation: 1}, Spec: apiv1.OperatorConfigSpec{Paused: true}}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(oc).WithStatusSubresource(&apiv1.OperatorConfig{}).Build()
+	live := newLiveConfig(4, nil)
+	r := newOperatorConfigReconciler(c, "default", live, false)
+	req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(oc)}
+	reconcile := func() {
+		t.Helper()
+		if _, err := r.Reconcile(ctx, req); err != nil {
+			t.Fatalf("reconcile: %v", err)
+		}
+		if err := c.Get(ctx, req.NamespacedName, oc); client.IgnoreNotFound(err) != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reconcile()
+	if !live.isLoaded() || !live.load().Paused || live.load().Generation != 1 {
+		t.Fatalf("settings in effect: got %+v, want generation 1, paused", live.load())
+	}
+	if cond := meta.FindStatusCondition(oc.Status.Conditions, apiv1.ConditionValid); cond == nil || cond.Status != metav1.ConditionTrue {
+		t.Errorf("Valid condition: got %+v, want True", cond)
+	}
+
+	oc.Spec.DriftPolicy, oc.Generation = "Ignore", 2
+	if err := c.Update(ctx, oc); err != nil {
+		t.Fatal(err)
+	}
+	reconcile()
+	if got := live.load(); got.Generation != 1 || !got.Paused {
+		t.Errorf("settings in effect: got generation %d, paused %t; want generation 1 still, paused", got.Generation, got.Paused)
+	}
+	cond := meta.FindStatusCondition(oc.Status.Conditions, apiv1.ConditionValid)
+	if cond == nil || cond.Status != metav1.ConditionFalse || cond.ObservedGeneration != 2 || !strings.HasSuffix(cond.Message, "(generation 1 is still in effect)") {
+		t.Errorf("Valid condition: got %+v, want False for generation 2, generation 1 still in effect", cond)
+	}
+
+	if err := c.Delete(ctx, oc); err != nil {
+		t.Fatal(err)
+	}
+	reconcile()
+	if diff := cmp.Diff(live.defaults(), live.load()); diff != "" {
+		t.Errorf("settings without OperatorConfig (-defaults +got):\n%s", diff)
+	}
+}
+
+// TestConcurrencyLimiter changes the limit while reconciles hold slots.
+func TestConcurrencyLimiter(t *testing.T) {
+	live := newLiveConfig(3, nil)
+	settings := func(limit int) *liveSettings {
+		s := live.defaults()
+		s.MaxConcurrentReconciles = limit
+		return s
+	}
+	// acquire returns the outcome of an acquire, once it returns
+	acquire := func(ctx context.Context) <-chan error {
+		done := make(chan error, 1)
+		go func() { done <- live.acquire(ctx) }()
+		return done
+	}
+	const blocked = 50 * time.Millisecond
+	expectBlocked := func(done <-chan error) {
+		t.Helper()
+		select {
+		case err := <-done:
+			t.Fatalf("acquired a slot (%v), want it held back", err)
+		case <-time.After(blocked):
+		}
+	}
+	expectAcquired := func(done <-chan error) {
+		t.Helper()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("acquire: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("still held back")
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Nothing runs before the first settings
+	first := acquire(ctx)
+	expectBlocked(first)
+	live.store(settings(2))
+	expectAcquired(first)
+	expectAcquired(acquire(ctx))
+	third := acquire(ctx)
+	expectBlocked(third)
+
+	// Raised: the one waiting proceeds
+	live.store(settings(3))
+	expectAcquired(third)
+
+	// Lowered below the slots in use: none is taken back, the next waits until all three are released
+	live.store(settings(1))
+	next := acquire(ctx)
+	live.release()
+	expectBlocked(next)
+	live.release()
+	expectBlocked(next)
+	live.release()
+	expectAcquired(next)
+
+	// A cancelled reconcile stops waiting
+	waitCtx, stop := context.WithCancel(ctx)
+	waiting := acquire(waitCtx)
+	expectBlocked(waiting)
+	stop()
+	if err := <-waiting; !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+	live.release()
+	expectAcquired(acquire(ctx))
+}
+
+func TestDriftGuard(t *testing.T) {
+	correct, report := &liveSettings{DriftPolicy: apiv1.DriftPolicyCorrect}, &liveSettings{DriftPolicy: apiv1.DriftPolicyReport}
+	tests := []struct {
+		name      string
+		live      *liveSettings
+		unchanged bool
+		existing  bool
+		drifted   bool // the mutate function changes the object
+		wantErr   error
+	}{
+		{name: "correct", live: correct, unchanged: true, existing: true, drifted: true},
+		{name: "report, drifted", live: report, unchanged: true, existing: true, drifted: true, wantErr: errDriftReported},
+		{name: "report, as rendered", live: report, unchanged: true, existing: true},
+		{name: "report, inputs changed", live: report, existing: true, drifted: true},
+		{name: "report, being created", live: report, unchanged: true, drifted: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dep := &appsv1.Deployment{Spec: appsv1.DeploymentSpec{Replicas: ptr.To[int32](2)}}
+			if tt.existing {
+				dep.ResourceVersion = "7"
+			}
+			called := false
+			err := driftGuard(tt.live, tt.unchanged, dep, func() error {
+				called = true
+				if tt.drifted {
+					dep.Spec.Replicas = ptr.To[int32](3)
+				}
+				return nil
+			})()
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+			if !called {
+				t.Error("the mutate function wasn't called")
+			}
+		})
+	}
+
+	failed := errors.New("render failed")
+	if err := driftGuard(report, true, &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "7"}}, func() error { return failed })(); !errors.Is(err, failed) {
+		t.Errorf("got error %v, want the one of the mutate function", err)
+	}
+}
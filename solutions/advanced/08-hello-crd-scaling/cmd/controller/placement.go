@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	apiv1 "github.com/jayantasamaddar/quick-reference-kubernetes/solutions/hello-crd-scaling/api/v1"
+
+	"go.opentelemetry.io/otel/attribute"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// Children placed in other clusters can't be garbage collected through owner references,
+	// so this finalizer keeps the ServiceDeployment around until they are deleted.
+	placementFinalizer = "k8s.example.com/placement"
+
+	// Remote children are not watched, so their status is refreshed by requeueing
+	placementResyncPeriod = 30 * time.Second
+
+	// Labels on remote children pointing back at the ServiceDeployment (in place of an ownerReference)
+	placedByNameLabel      = "servicedeployment.k8s.example.com/name"
+	placedByNamespaceLabel = "servicedeployment.k8s.example.com/namespace"
+
+	defaultKubeconfigKey = "kubeconfig"
+)
+
+var errMissingKubeconfig = errors.New("kubeconfig not found in secret")
+
+// clusterClients caches one client per kubeconfig Secret, rebuilt whenever the Secret changes and dropped once the
+// Secret is gone or no ServiceDeployment places children with it anymore (see retain).
+type clusterClients struct {
+	mu      sync.Mutex
+	scheme  *runtime.Scheme
+	clients map[types.NamespacedName]cachedClusterClient
+	// Optional wrapper around the clients handed out, e.g. for dry-run mode
+	wrap func(c client.Client, cluster string) client.Client
+}
+
+type cachedClusterClient struct {
+	resourceVersion string
+	key             string
+	client          client.Client
+	http            *http.Client // of `client`, to close its connections once dropped
+	users           map[types.NamespacedName]bool
+}
+
+func newClusterClients(scheme *runtime.Scheme) *clusterClients {
+	return &clusterClients{
+		scheme:  scheme,
+		clients: make(map[types.NamespacedName]cachedClusterClient),
+	}
+}
+
+// get returns a client for the target cluster of the ServiceDeployment `sd`, reading the kubeconfig Secret from its namespace.
+// The Secret is read straight from the API server, so the operator does not need to cache every Secret in the cluster.
+func (c *clusterClients) get(ctx context.Context, kube kubernetes.Interface, sd types.NamespacedName, target apiv1.PlacementCluster) (client.Client, error) {
+	id := types.NamespacedName{Namespace: sd.Namespace, Name: target.SecretName}
+	secret, err := kube.CoreV1().Secrets(sd.Namespace).Get(ctx, target.SecretName, metav1.GetOptions{})
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			c.mu.Lock()
+			c.evict(id)
+			c.mu.Unlock()
+		}
+		return nil, err
+	}
+	key := target.Key
+	if key == "" {
+		key = defaultKubeconfigKey
+	}
+	kubeconfig, ok := secret.Data[key]
+	if !ok {
+		return nil, fmt.Errorf("%w: secret %q, key %q", errMissingKubeconfig, target.SecretName, key)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, ok := c.clients[id]
+	if ok && cached.resourceVersion == secret.ResourceVersion && cached.key == key {
+		cached.users[sd] = true
+		return c.wrapped(cached.client, target.Name), nil
+	}
+	// A changed Secret (e.g. rotated credentials or another cluster) replaces the client
+	users := map[types.NamespacedName]bool{sd: true}
+	if ok {
+		for user := range cached.users {
+			users[user] = true
+		}
+		c.evict(id)
+	}
+	config, err := restConfigFromSecret(kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("secret %q, key %q: %w", target.SecretName, key, err)
+	}
+	httpClient, err := rest.HTTPClientFor(config)
+	if err != nil {
+		return nil, err
+	}
+	cl, err := client.New(config, client.Options{Scheme: c.scheme, HTTPClient: httpClient})
+	if err != nil {
+		return nil, err
+	}
+	c.clients[id] = cachedClusterClient{resourceVersion: secret.ResourceVersion, key: key, client: cl, http: httpClient, users: users}
+	return c.wrapped(cl, target.Name), nil
+}
+
+// restConfigFromSecret parses a kubeconfig written by a tenant. It only accepts inline credentials: an exec or
+// auth-provider plugin would run in the operator's pod, and a file path would read the operator's own files
+// (e.g. its ServiceAccount token).
+func restConfigFromSecret(kubeconfig []byte) (*rest.Config, error) {
+	config, err := clientcmd.Load(kubeconfig)
+	if err != nil {
+		return nil, invalidError("InvalidKubeconfig", fmt.Errorf("parse kubeconfig: %w", err))
+	}
+	var fields []string
+	for name, user := range config.AuthInfos {
+		for field, set := range map[string]bool{
+			"exec":               user.Exec != nil,
+			"auth-provider":      user.AuthProvider != nil,
+			"tokenFile":          user.TokenFile != "",
+			"client-certificate": user.ClientCertificate != "",
+			"client-key":         user.ClientKey != "",
+		} {
+			if set {
+				fields = append(fields, fmt.Sprintf("users[%q].user.%s", name, field))
+			}
+		}
+	}
+	for name, cluster := range config.Clusters {
+		if cluster.CertificateAuthority != "" {
+			fields = append(fields, fmt.Sprintf("clusters[%q].cluster.certificate-authority", name))
+		}
+	}
+	if len(fields) > 0 {
+		slices.Sort(fields)
+		return nil, invalidError("InvalidKubeconfig", fmt.Errorf("kubeconfig: only inline credentials (token and *-data fields) are allowed, found %s", strings.Join(fields, ", ")))
+	}
+	return clientcmd.NewDefaultClientConfig(*config, &clientcmd.ConfigOverrides{}).ClientConfig()
+}
+
+// retain records that the ServiceDeployment `sd` only uses the kubeconfig Secrets `secretNames` (none once it is
+// deleted or no longer placed), and drops the clients no ServiceDeployment uses anymore.
+func (c *clusterClients) retain(sd types.NamespacedName, secretNames ...string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, cached := range c.clients {
+		if id.Namespace != sd.Namespace || slices.Contains(secretNames, id.Name) {
+			continue
+		}
+		delete(cached.users, sd)
+		if len(cached.users) == 0 {
+			c.evict(id)
+		}
+	}
+}
+
+// evict drops the client of the Secret `id`. Requires `mu`.
+func (c *clusterClients) evict(id types.NamespacedName) {
+	if cached, ok := c.clients[id]; ok {
+		cached.http.CloseIdleConnections()
+		delete(c.clients, id)
+	}
+}
+
+// size returns the number of cached clients.
+func (c *clusterClients) size() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.clients)
+}
+
+func (c *clusterClients) wrapped(cl client.Client, cluster string) client.Client {
+	if c.wrap == nil {
+		return cl
+	}
+	return c.wrap(cl, cluster)
+}
+
+func placed(sd *apiv1.ServiceDeployment) bool {
+	return sd.Spec.Placement != nil && len(sd.Spec.Placement.Clusters) > 0
+}
+
+// reconcilePlacement renders the children in every target cluster instead of the local one
+// and aggregates their readiness into the status.
+func (r *reconciler) reconcilePlacement(ctx context.Context, sd, effective *apiv1.ServiceDeployment, class *apiv1.ServiceDeploymentClass, templateHash string, conds ...metav1.Condition) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	// Children rendered locally before the ServiceDeployment switched to placement are not wanted anymore
+	if err := r.deleteLocalChildren(ctx, sd); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	wanted := make(map[string]bool, len(sd.Spec.Placement.Clusters))
+	statuses := make([]apiv1.ClusterStatus, 0, len(sd.Spec.Placement.Clusters))
+	for _, target := range sd.Spec.Placement.Clusters {
+		wanted[target.Name] = true
+		status := apiv1.ClusterStatus{PlacementCluster: target}
+
+		children, err := r.applyToCluster(ctx, sd, effective, class, target)
+		if err != nil {
+			// One unreachable cluster must not block the others
+			log.Error(err, "failed to place children", "cluster", target.Name)
+			r.eventf(ctx, sd, nil, corev1.EventTypeWarning, "PlacementFailed", "Place", "Failed to apply children in cluster %q: %v", target.Name, err)
+			status.Message = err.Error()
+		} else {
+			for i, gen := range childGenerators {
+				gen.fillClusterStatus(&status, children[i])
+			}
+		}
+		status.Ready = fmt.Sprintf("%d/%d", status.ReadyReplicas, sd.Spec.Replicas)
+		statuses = append(statuses, status)
+	}
+
+	// Remove the children from clusters that were dropped from the placement
+	if err := r.cleanupPlacement(ctx, sd, wanted); err != nil {
+		return ctrl.Result{}, err
+	}
+	r.clusters.retain(client.ObjectKeyFromObject(sd), placementSecrets(sd)...)
+
+	if err := r.syncPlacementStatus(ctx, sd, effective, statuses, templateHash, conds...); err != nil {
+		return ctrl.Result{}, fmt.Errorf("sync status: %w", err)
+	}
+
+	log.Info("reconciled", "clusters", len(statuses))
+	return ctrl.Result{RequeueAfter: placementResyncPeriod}, nil
+}
+
+// applyToCluster creates or updates the children in the target cluster and returns them, one per childGenerators entry.
+func (r *reconciler) applyToCluster(ctx context.Context, sd, effective *apiv1.ServiceDeployment, class *apiv1.ServiceDeploymentClass, target apiv1.PlacementCluster) ([]client.Object, error) {
+	remote, err := r.clusters.get(ctx, r.kubeClient, client.ObjectKeyFromObject(sd), target)
+	if err != nil {
+		return nil, err
+	}
+
+	// The namespace may not exist yet in the target cluster
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: sd.Namespace}}
+	if err := remote.Create(ctx, ns); err != nil && !k8serrors.IsAlreadyExists(err) {
+		return nil, fmt.Errorf("create namespace: %w", err)
+	}
+
+	cluster := attribute.String("cluster", target.Name)
+	children := make([]client.Object, len(childGenerators))
+	for i, gen := range childGenerators {
+		desired := newChild(gen, sd.Namespace, sd.Name)
+		gen.render(desired, sd, effective, class)
+		setPlacedByLabels(desired, sd)
+		obj := newChild(gen, sd.Namespace, sd.Name)
+		if _, err := r.applyRendered(ctx, remote, target.Name, gen, obj, desired, func() error {
+			gen.render(obj, sd, effective, class)
+			setPlacedByLabels(obj, sd)
+			return nil
+		}, cluster); err != nil {
+			recordApplyFailure(gen.kind(), err)
+			return nil, fmt.Errorf("apply %s: %w", strings.ToLower(gen.kind()), err)
+		}
+		children[i] = obj
+	}
+	return children, nil
+}
+
+// placementSecrets returns the names of the kubeconfig Secrets of the placement of `sd`.
+func placementSecrets(sd *apiv1.ServiceDeployment) []string {
+	if sd.Spec.Placement == nil {
+		return nil
+	}
+	names := make([]string, 0, len(sd.Spec.Placement.Clusters))
+	for _, target := range sd.Spec.Placement.Clusters {
+		names = append(names, target.SecretName)
+	}
+	return names
+}
+
+func setPlacedByLabels(obj client.Object, sd *apiv1.ServiceDeployment) {
+	labels := obj.GetLabels()
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	labels[placedByNameLabel] = sd.Name
+	labels[placedByNamespaceLabel] = sd.Namespace
+	obj.SetLabels(labels)
+}
+
+// cleanupPlacement deletes the children from every cluster the ServiceDeployment was (or is) placed in, except `keep`.
+// A cluster whose kubeconfig Secret is gone is skipped: there is no way to reach it anymore.
+func (r *reconciler) cleanupPlacement(ctx context.Context, sd *apiv1.ServiceDeployment, keep map[string]bool) error {
+	targets := map[string]apiv1.PlacementCluster{}
+	for _, c := range sd.Status.Clusters {
+		targets[c.Name] = c.PlacementCluster
+	}
+	if sd.Spec.Placement != nil {
+		for _, c := range sd.Spec.Placement.Clusters {
+			targets[c.Name] = c
+		}
+	}
+
+	var errs []error
+	for name, target := range targets {
+		if keep[name] {
+			continue
+		}
+		remote, err := r.clusters.get(ctx, r.kubeClient, client.ObjectKeyFromObject(sd), target)
+		if err != nil {
+			if k8serrors.IsNotFound(err) || errors.Is(err, errMissingKubeconfig) {
+				log.FromContext(ctx).Info("kubeconfig secret gone, skipping cleanup", "cluster", name)
+				continue
+			}
+			errs = append(errs, fmt.Errorf("cluster %q: %w", name, err))
+			continue
+		}
+		for _, gen := range slices.Backward(childGenerators) {
+			if err := remote.Delete(ctx, newChild(gen, sd.Namespace, sd.Name)); client.IgnoreNotFound(err) != nil {
+				errs = append(errs, fmt.Errorf("cluster %q: delete %s: %w", name, strings.ToLower(gen.kind()), err))
+			}
+		}
+		r.revisions.forget(name, sd.Namespace, sd.Name)
+	}
+	return errors.Join(errs...)
+}
+
+// deleteLocalChildren removes the children and extra resources from the local cluster, if they are ours.
+func (r *reconciler) deleteLocalChildren(ctx context.Context, sd *apiv1.ServiceDeployment) error {
+	for _, gen := range childGenerators {
+		obj := gen.object()
+		if err := r.Get(ctx, types.NamespacedName{Namespace: sd.Namespace, Name: gen.name(sd.Name)}, obj); err != nil {
+			if k8serrors.IsNotFound(err) {
+				continue
+			}
+			return err
+		}
+		if !metav1.IsControlledBy(obj, sd) {
+			continue
+		}
+		if err := r.Delete(ctx, obj); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	r.revisions.forget("", sd.Namespace, sd.Name)
+	// Extra resources aren't placed (the CRD doesn't allow both), only pruned
+	for _, st := range sd.Status.ExtraResources {
+		if err := r.pruneExtraResource(ctx, sd, st); err != nil {
+			return fmt.Errorf("delete %s %q: %w", st.Kind, st.Name, err)
+		}
+	}
+	return nil
+}
+
+func (r *reconciler) syncPlacementStatus(ctx context.Context, sd, effective *apiv1.ServiceDeployment, clusters []apiv1.ClusterStatus, templateHash string, conds ...metav1.Condition) (err error) {
+	ctx, span := tracer.Start(ctx, "SyncStatus")
+	defer func() { endSpan(span, err) }()
+
+	desired := *sd.Status.DeepCopy()
+	desired.Clusters = clusters
+	desired.ExtraResources = nil // pruned by deleteLocalChildren
+
+	// Top-level numbers are the sum over all clusters
+	desired.DesiredReplicas = sd.Spec.Replicas * int32(len(clusters))
+	desired.ReadyReplicas, desired.AvailableReplicas, desired.UpdatedReplicas = 0, 0, 0
+	for _, c := range clusters {
+		desired.ReadyReplicas += c.ReadyReplicas
+		desired.AvailableReplicas += c.AvailableReplicas
+	}
+	desired.Ready = fmt.Sprintf("%d/%d", desired.ReadyReplicas, desired.DesiredReplicas)
+	desired.Selector = fmt.Sprintf("app=%s", sd.Name)
+
+	// Cluster IPs are per cluster and meaningless here
+	svc := &corev1.Service{Spec: corev1.ServiceSpec{Type: effective.Spec.Service.Type, Ports: effective.Spec.Service.Ports}}
+	fillFromServiceStatus(&desired, svc)
+	fillTemplateHash(&desired, templateHash)
+	r.shards.fillStatus(&desired, sd)
+	r.controller.fillStatus(&desired, sd)
+	setConditions(&desired, sd, conds...)
+
+	// If there are no changes, do nothing
+	if equality.Semantic.DeepEqual(sd.Status, desired) {
+		return nil
+	}
+	orig := sd.DeepCopy()
+	sd.Status = desired
+	if err := r.Status().Patch(ctx, sd, client.MergeFrom(orig)); err != nil {
+		return err
+	}
+	r.notifier.observe(ctx, sd, &orig.Status)
+	return nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	apiv1 "github.com/jayantasamaddar/quick-reference-kubernetes/solutions/hello-crd-scaling/api/v1"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/events"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+)
+
+func kubeconfigSecret(name, resourceVersion, server string) *corev1.Secret {
+	kubeconfig := fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters: [{name: target, cluster: {server: %q}}]
+users: [{name: operator, user: {token: abc}}]
+contexts: [{name: target, context: {cluster: target, user: operator}}]
+current-context: target
+`, server)
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: name, ResourceVersion: resourceVersion},
+		Data:       map[string][]byte{defaultKubeconfigKey: []byte(kubeconfig)},
+	}
+}
+
+func TestClusterClientsEviction(t *testing.T) {
+	ctx := context.Background()
+	kube := kubefake.NewClientset(kubeconfigSecret("east", "1", "https://east.example.com"))
+	clients := newClusterClients(scheme)
+	east := apiv1.PlacementCluster{Name: "east", SecretName: "east"}
+	web, api := types.NamespacedName{Namespace: "team-a", Name: "web"}, types.NamespacedName{Namespace: "team-a", Name: "api"}
+
+	first, err := clients.get(ctx, kube, web, east)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := clients.get(ctx, kube, api, east); err != nil || again != first {
+		t.Errorf("second get of an unchanged Secret: got a new client (%v), want the cached one", err)
+	}
+
+	// A rotated kubeconfig replaces the client
+	if _, err := kube.CoreV1().Secrets("team-a").Update(ctx, kubeconfigSecret("east", "2", "https://east-2.example.com"), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := clients.get(ctx, kube, web, east)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated == first {
+		t.Error("get after the Secret changed: got the cached client, want a new one")
+	}
+	if got := clients.size(); got != 1 {
+		t.Errorf("cached clients after the Secret changed: got %d, want 1", got)
+	}
+
+	// Dropped once neither ServiceDeployment uses it
+	clients.retain(web)
+	if got := clients.size(); got != 1 {
+		t.Errorf("cached clients while api still uses it: got %d, want 1", got)
+	}
+	clients.retain(api, "west")
+	if got := clients.size(); got != 0 {
+		t.Errorf("cached clients once unused: got %d, want 0", got)
+	}
+
+	// And once the Secret is gone
+	if _, err := clients.get(ctx, kube, web, east); err != nil {
+		t.Fatal(err)
+	}
+	if err := kube.CoreV1().Secrets("team-a").Delete(ctx, "east", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clients.get(ctx, kube, web, east); !k8serrors.IsNotFound(err) {
+		t.Errorf("get after the Secret was deleted: got error %v, want NotFound", err)
+	}
+	if got := clients.size(); got != 0 {
+		t.Errorf("cached clients once the Secret is gone: got %d, want 0", got)
+	}
+}
+
+func TestKubeconfigRestrictions(t *testing.T) {
+	const prefix = `apiVersion: v1
+kind: Config
+current-context: target
+contexts: [{name: target, context: {cluster: target, user: operator}}]
+`
+	tests := []struct {
+		name       string
+		kubeconfig string
+		wantErr    string // empty if accepted
+	}{
+		{
+			name:       "inline token",
+			kubeconfig: prefix + "clusters: [{name: target, cluster: {server: https://east.example.com}}]\nusers: [{name: operator, user: {token: abc}}]\n",
+		},
+		{
+			name:       "exec plugin",
+			kubeconfig: prefix + "clusters: [{name: target, cluster: {server: https://east.example.com}}]\nusers: [{name: operator, user: {exec: {apiVersion: client.authentication.k8s.io/v1, command: sh, args: [-c, id], interactiveMode: Never}}}]\n",
+			wantErr:    `users["operator"].user.exec`,
+		},
+		{
+			name:       "token file",
+			kubeconfig: prefix + "clusters: [{name: target, cluster: {server: https://east.example.com}}]\nusers: [{name: operator, user: {tokenFile: /var/run/secrets/kubernetes.io/serviceaccount/token}}]\n",
+			wantErr:    `users["operator"].user.tokenFile`,
+		},
+		{
+			name:       "auth provider",
+			kubeconfig: prefix + "clusters: [{name: target, cluster: {server: https://east.example.com}}]\nusers: [{name: operator, user: {auth-provider: {name: oidc}}}]\n",
+			wantErr:    `users["operator"].user.auth-provider`,
+		},
+		{
+			name:       "client certificate files",
+			kubeconfig: prefix + "clusters: [{name: target, cluster: {server: https://east.example.com}}]\nusers: [{name: operator, user: {client-certificate: /etc/tls.crt, client-key: /etc/tls.key}}]\n",
+			wantErr:    `users["operator"].user.client-certificate, users["operator"].user.client-key`,
+		},
+		{
+			name:       "certificate authority file",
+			kubeconfig: prefix + "clusters: [{name: target, cluster: {server: https://east.example.com, certificate-authority: /var/run/secrets/kubernetes.io/serviceaccount/ca.crt}}]\nusers: [{name: operator, user: {token: abc}}]\n",
+			wantErr:    `clusters["target"].cluster.certificate-authority`,
+		},
+		{
+			name:       "unused user with a token file",
+			kubeconfig: prefix + "clusters: [{name: target, cluster: {server: https://east.example.com}}]\nusers: [{name: operator, user: {token: abc}}, {name: other, user: {tokenFile: /etc/token}}]\n",
+			wantErr:    `users["other"].user.tokenFile`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "east", ResourceVersion: "1"},
+				Data:       map[string][]byte{defaultKubeconfigKey: []byte(tt.kubeconfig)},
+			}
+			clients := newClusterClients(scheme)
+			sd := types.NamespacedName{Namespace: "team-a", Name: "web"}
+			_, err := clients.get(context.Background(), kubefake.NewClientset(secret), sd, apiv1.PlacementCluster{Name: "east", SecretName: "east"})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("got error %v, want none", err)
+				}
+				return
+			}
+			if class, reason := classify(err); class != errorInvalid || reason != "InvalidKubeconfig" {
+				t.Errorf("got error %v classified %s/%s, want invalid/InvalidKubeconfig", err, class, reason)
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want it to name %s", err, tt.wantErr)
+			}
+			if got := clients.size(); got != 0 {
+				t.Errorf("cached clients: got %d, want 0", got)
+			}
+		})
+	}
+}
+
+// startAPIServer starts an envtest API server (and etcd) with the operator's CRDs, skipping the test
+// without the binaries (see `setup-envtest`).
+func startAPIServer(t *testing.T) (*envtest.Environment, *envtest.AuthenticatedUser) {
+	t.Helper()
+	if os.Getenv("KUBEBUILDER_ASSETS") == "" {
+		t.Skip("KUBEBUILDER_ASSETS not set: no envtest binaries")
+	}
+	env := &envtest.Environment{CRDInstallOptions: envtest.CRDInstallOptions{Paths: []string{"../../k8s/crds.yaml"}}}
+	if _, err := env.Start(); err != nil {
+		t.Fatalf("start envtest: %v", err)
+	}
+	t.Cleanup(func() { _ = env.Stop() })
+	user, err := env.AddUser(envtest.User{Name: "operator", Groups: []string{"system:masters"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return env, user
+}
+
+// TestPlacementAcrossAPIServers places a ServiceDeployment of one API server in two others, moves it from one to the
+// other by rotating its kubeconfig Secret, and checks the cached clients are dropped once it is deleted.
+func TestPlacementAcrossAPIServers(t *testing.T) {
+	ctx := context.Background()
+	_, local := startAPIServer(t)
+	_, east := startAPIServer(t)
+	_, west := startAPIServer(t)
+
+	c, err := client.New(local.Config(), client.Options{Scheme: scheme})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kube, err := kubernetes.NewForConfig(local.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	live := newLiveConfig(1, nil)
+	live.store(live.defaults())
+	r := &reconciler{
+		Client:     c,
+		scheme:     scheme,
+		controller: controllerSelector{isDefault: true},
+		apiReader:  c,
+		kubeClient: kube,
+		clusters:   newClusterClients(scheme),
+		live:       live,
+		revisions:  newChildRevisions(),
+	}
+	r.recorder = newEventRecorder(eventsConfig{}, &events.FakeRecorder{}, scheme, nil, live)
+
+	secret := func(user *envtest.AuthenticatedUser) *corev1.Secret {
+		kubeconfig, err := user.KubeConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "target"},
+			Data:       map[string][]byte{defaultKubeconfigKey: kubeconfig},
+		}
+	}
+	sd := newTestServiceDeployment("team-a", "web")
+	sd.UID, sd.Generation = "", 0
+	sd.Spec.Placement = &apiv1.ServiceDeploymentPlacement{Clusters: []apiv1.PlacementCluster{{Name: "target", SecretName: "target"}}}
+	for _, obj := range []client.Object{
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}},
+		secret(east),
+		sd,
+	} {
+		if err := c.Create(ctx, obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reconcile := func() {
+		t.Helper()
+		if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(sd)}); err != nil {
+			t.Fatalf("reconcile: %v", err)
+		}
+	}
+	hasDeployment := func(user *envtest.AuthenticatedUser) bool {
+		t.Helper()
+		remote, err := client.New(user.Config(), client.Options{Scheme: scheme})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = remote.Get(ctx, client.ObjectKey{Namespace: "team-a", Name: "web"}, &appsv1.Deployment{})
+		if err != nil && !k8serrors.IsNotFound(err) {
+			t.Fatal(err)
+		}
+		return err == nil
+	}
+
+	reconcile()
+	if !hasDeployment(east) {
+		t.Fatal("no Deployment in the east API server")
+	}
+
+	// Pointing the Secret at another cluster must not keep using the cached client of the first
+	var current corev1.Secret
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "team-a", Name: "target"}, &current); err != nil {
+		t.Fatal(err)
+	}
+	current.Data = secret(west).Data
+	if err := c.Update(ctx, &current); err != nil {
+		t.Fatal(err)
+	}
+	reconcile()
+	if !hasDeployment(west) {
+		t.Fatal("no Deployment in the west API server after rotating the Secret")
+	}
+
+	if err := c.Delete(ctx, sd); err != nil {
+		t.Fatal(err)
+	}
+	reconcile() // runs the placement finalizer
+	if hasDeployment(west) {
+		t.Error("Deployment still in the west API server after deleting the ServiceDeployment")
+	}
+	if got := r.clusters.size(); got != 0 {
+		t.Errorf("cached clients after deleting the ServiceDeployment: got %d, want 0", got)
+	}
+}
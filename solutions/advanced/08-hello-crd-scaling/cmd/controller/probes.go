@@ -0,0 +1,96 @@
+package main
+
+import (
+	apiv1 "github.com/jayantasamaddar/quick-reference-kubernetes/solutions/hello-crd-scaling/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// applyProbes expands `spec.probes` into readiness, liveness and startup probes on the container that serves
+// the Service port's targetPort. Probes the user specified on the container are never overridden.
+// `effective` is expected to be a copy (see applyClass), as its containers are modified in place.
+func applyProbes(effective *apiv1.ServiceDeployment) {
+	probes := effective.Spec.Probes
+	if probes == nil || (probes.HTTPPath == "" && !probes.TCP) {
+		return
+	}
+	servicePort, ok := probedServicePort(effective.Spec.Service.Ports, probes.Port)
+	if !ok {
+		return
+	}
+
+	// targetPort defaults to port
+	target := servicePort.TargetPort
+	if target.Type == intstr.Int && target.IntVal == 0 {
+		target = intstr.FromInt32(servicePort.Port)
+	}
+
+	for i := range effective.Spec.Containers {
+		c := &effective.Spec.Containers[i]
+		if !servesPort(c, target) {
+			continue
+		}
+
+		if c.ReadinessProbe == nil {
+			c.ReadinessProbe = newProbe(probes, target, 10, 3)
+		}
+		if c.LivenessProbe == nil {
+			c.LivenessProbe = newProbe(probes, target, 20, 3)
+		}
+		// Gives slow starters up to 5 minutes before the liveness probe kicks in
+		if c.StartupProbe == nil {
+			c.StartupProbe = newProbe(probes, target, 10, 30)
+		}
+		return
+	}
+}
+
+// probedServicePort returns the Service port selected by name or number, or the first one if `selector` is empty.
+func probedServicePort(ports []corev1.ServicePort, selector intstr.IntOrString) (corev1.ServicePort, bool) {
+	if len(ports) == 0 {
+		return corev1.ServicePort{}, false
+	}
+	if selector.Type == intstr.Int && selector.IntVal == 0 {
+		return ports[0], true
+	}
+	for _, p := range ports {
+		if (selector.Type == intstr.String && p.Name == selector.StrVal) ||
+			(selector.Type == intstr.Int && p.Port == selector.IntVal) {
+			return p, true
+		}
+	}
+	return corev1.ServicePort{}, false
+}
+
+// servesPort reports whether the container exposes the targetPort, by containerPort number or by port name.
+// A numeric targetPort on a container without any declared ports is still considered served: declaring ports is optional.
+func servesPort(c *corev1.Container, target intstr.IntOrString) bool {
+	if target.Type == intstr.Int && len(c.Ports) == 0 {
+		return true
+	}
+	for _, p := range c.Ports {
+		if (target.Type == intstr.String && p.Name == target.StrVal) ||
+			(target.Type == intstr.Int && p.ContainerPort == target.IntVal) {
+			return true
+		}
+	}
+	return false
+}
+
+// newProbe fills in the fields the API server would default as well,
+// otherwise every reconcile would see a difference with the stored Deployment and update it.
+func newProbe(probes *apiv1.ServiceDeploymentProbes, port intstr.IntOrString, period, failureThreshold int32) *corev1.Probe {
+	probe := &corev1.Probe{
+		PeriodSeconds:    period,
+		FailureThreshold: failureThreshold,
+		TimeoutSeconds:   1,
+		SuccessThreshold: 1,
+	}
+	if probes.HTTPPath != "" {
+		probe.HTTPGet = &corev1.HTTPGetAction{Path: probes.HTTPPath, Port: port, Scheme: corev1.URISchemeHTTP}
+	} else {
+		probe.TCPSocket = &corev1.TCPSocketAction{Port: port}
+	}
+	return probe
+}
@@ -2,20 +2,24 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"slices"
 	"strings"
+	"time"
 
 	apiv1 "github.com/jayantasamaddar/quick-reference-kubernetes/solutions/hello-crd-scaling/api/v1"
 
-	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
@@ -27,181 +31,310 @@ type reconciler struct {
 	client.Client
 	scheme     *runtime.Scheme
 	kubeClient *kubernetes.Clientset
-	recorder   record.EventRecorder
+	recorder   *eventRecorder
+	clusters   *clusterClients // clients for `spec.placement` target clusters
+	scope      namespaceScope  // namespaces the operator is restricted to, if any
+	requeue    requeueConfig   // what happens after a failed reconcile, by class of error (see requeue.go)
+	dryRun     bool            // `Client` and `clusters` take care of dry run themselves; only `kubeClient` needs to be told
+	shards     *shardManager   // with sharding, which ServiceDeployments this replica reconciles; nil otherwise
+	controller controllerSelector
+	apiReader  client.Reader   // uncached, to tell apart a deleted ServiceDeployment and one outside a filtered cache
+	audit      *auditLog       // records the deletes made through `kubeClient`; nil without an audit log
+	notifier   *notifier       // lifecycle notifications; nil if disabled
+	live       *liveConfig     // settings of the OperatorConfig, changed at runtime
+	revisions  *childRevisions // children known to be up to date, skipped until they change (see children.go)
 }
 
 // Implements a Kubernetes API for a specific Resource by Creating, Updating or Deleting Kubernetes objects,
 // or by making changes to systems external to the cluster
-func (r *reconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+func (r *reconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, err error) {
+	// Waits for the OperatorConfig to be read, then for a slot under its `maxConcurrentReconciles`
+	if err := r.live.acquire(ctx); err != nil {
+		return ctrl.Result{}, err
+	}
+	defer r.live.release()
+
+	ctx, span := tracer.Start(ctx, "Reconcile ServiceDeployment", trace.WithNewRoot(), trace.WithAttributes(
+		attribute.String("k8s.namespace.name", req.Namespace),
+		attribute.String("servicedeployment.name", req.Name),
+	))
+	// Lets the logs of this reconcile be matched with its trace
+	if span.SpanContext().IsSampled() {
+		ctx = log.IntoContext(ctx, log.FromContext(ctx).WithValues("traceID", span.SpanContext().TraceID().String()))
+	}
+	defer func(start time.Time) {
+		observeReconcile(start, result, err)
+		span.SetAttributes(attribute.Bool("requeue", result.Requeue || result.RequeueAfter > 0))
+		endSpan(span, err)
+	}(time.Now())
+
+	result, err = r.reconcile(ctx, req)
+	if err != nil {
+		return r.handleError(ctx, req, err)
+	}
+	return result, nil
+}
+
+// eventf records an Event on the ServiceDeployment, in a span of its own.
+// `related` is the child the Event is about, if any.
+func (r *reconciler) eventf(ctx context.Context, sd *apiv1.ServiceDeployment, related client.Object, eventtype, reason, action, messageFmt string, args ...interface{}) {
+	ctx, span := tracer.Start(ctx, "Event "+reason, trace.WithAttributes(attribute.String("event.type", eventtype)))
+	defer span.End()
+	r.recorder.eventf(ctx, sd, related, eventtype, reason, action, messageFmt, args...)
+}
+
+func (r *reconciler) reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	log := log.FromContext(ctx).WithValues("servicedeployment", req.NamespacedName)
 	log.Info("Reconciling servicedeployment...")
 
-	// Create ServiceDeployment if not exists
-	depClient := r.kubeClient.AppsV1().Deployments(req.Namespace)
-	svcClient := r.kubeClient.CoreV1().Services(req.Namespace)
-	svcName := fmt.Sprintf("%s-svc", req.Name)
+	// Requests can only come from outside the scope through a mapping (e.g. a cross-namespace dependency).
+	// The cache can't even read such an object, so refuse it right away.
+	if !r.scope.contains(req.Namespace) {
+		log.Info("refusing servicedeployment", "reason", errOutOfScope, "namespaces", r.scope.String())
+		return ctrl.Result{}, nil
+	}
+	// A paused operator changes nothing. Unpausing requeues every ServiceDeployment.
+	live := r.live.load()
+	if live.Paused {
+		log.V(1).Info("operator paused, skipping servicedeployment", "operatorconfig", live.Source)
+		return ctrl.Result{}, nil
+	}
 
 	// 1) Load the primary CR
 	var sd apiv1.ServiceDeployment
-	err := r.Get(ctx, req.NamespacedName, &sd)
-	// If there is an error, it means ServiceDeployment got deleted, therefore delete underlying resources
+	getCtx, span := tracer.Start(ctx, "Get ServiceDeployment")
+	err := r.Get(getCtx, req.NamespacedName, &sd)
+	endSpan(span, client.IgnoreNotFound(err))
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int64("servicedeployment.generation", sd.Generation))
+	if client.IgnoreNotFound(err) != nil {
+		return ctrl.Result{}, fmt.Errorf("get servicedeployment: %w", err)
+	}
+	// Every change made from here on is audited as caused by this generation (0 once deleted)
+	ctx = withAuditOwner(ctx, auditOwner{Kind: apiv1.Kind, Namespace: req.Namespace, Name: req.Name, Generation: sd.Generation})
+
+	// With sharding, only the replica holding the shard reconciles. A deleted ServiceDeployment has no labels left,
+	// so the failsafe deletion below runs on the owner of the shard of its namespace.
+	var shard int32
+	if r.shards != nil {
+		shard = shardOf(req.Namespace, sd.Labels, r.shards.cfg.Shards)
+		if !r.shards.begin(shard) {
+			log.V(1).Info("skipping servicedeployment of a shard owned by another replica", "shard", shard)
+			return ctrl.Result{}, nil
+		}
+		defer r.shards.done(shard)
+	}
+
+	// If it is NotFound, the ServiceDeployment got deleted, therefore delete underlying resources
 	if err != nil {
-		if k8serrors.IsNotFound(err) {
-			// Manual failsafe deletion of resources.
-			// We already provide OwnerReferences below via controllerutil.SetControllerReference for Service and Deployment so,
-			// Kubernetes Garbage Collector is supposed to delete these resources automatically.
-			// This is a failsafe, for any edge cases that may arise due to any unforseen circumstances.
-			err = svcClient.Delete(ctx, svcName, metav1.DeleteOptions{})
-			if err != nil {
-				return ctrl.Result{}, fmt.Errorf("couldn't delete service: %s", err)
+		// Unless our cache only holds the ServiceDeployments we handle: the children of the others are cached,
+		// and their events enqueue owners we can't read
+		if r.controller.filtersCache() {
+			if err := r.apiReader.Get(ctx, req.NamespacedName, &apiv1.ServiceDeployment{}); !k8serrors.IsNotFound(err) {
+				return ctrl.Result{}, client.IgnoreNotFound(err)
 			}
-			err = depClient.Delete(ctx, req.Name, metav1.DeleteOptions{})
-			if err != nil {
-				return ctrl.Result{}, fmt.Errorf("couldn't delete deployment: %s", err)
+		}
+		// Manual failsafe deletion of resources.
+		// We already provide OwnerReferences below via controllerutil.SetControllerReference for Service and Deployment so,
+		// Kubernetes Garbage Collector is supposed to delete these resources automatically.
+		// This is a failsafe, for any edge cases that may arise due to any unforseen circumstances.
+		// Usually the Garbage Collector was first, so children that are already gone are fine.
+		opts := metav1.DeleteOptions{}
+		if r.dryRun {
+			opts.DryRun = []string{metav1.DryRunAll}
+		}
+		for _, gen := range slices.Backward(childGenerators) {
+			name := gen.name(req.Name)
+			err = gen.delete(ctx, r.kubeClient, req.Namespace, name, opts)
+			if client.IgnoreNotFound(err) != nil {
+				return ctrl.Result{}, fmt.Errorf("couldn't delete %s: %w", strings.ToLower(gen.kind()), err)
+			}
+			if err == nil {
+				r.audit.deleted(ctx, gen.kind(), req.Namespace, name)
 			}
-			return ctrl.Result{}, nil
 		}
+		r.revisions.forget("", req.Namespace, req.Name)
+		r.clusters.retain(req.NamespacedName)
+		return ctrl.Result{}, nil
 	}
 
-	// 2) Ensure child Deployment
-	dep := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{
-		Name:      sd.Name,
-		Namespace: sd.Namespace,
-	}}
-	result, err := controllerutil.CreateOrUpdate(ctx, r.Client, dep, func() error {
-		// Set Labels
-		if dep.Labels == nil {
-			dep.Labels = make(map[string]string)
+	// Handled by another operator (`spec.controllerName`): at most report that none claimed it
+	if !r.controller.claims(&sd) {
+		if r.controller.isDefault {
+			return r.reportUnclaimed(ctx, &sd)
 		}
-		dep.Labels["app"] = sd.Name
+		return ctrl.Result{}, nil
+	}
 
-		// Set Replicas
-		replicas := sd.Spec.Replicas
-		dep.Spec.Replicas = &replicas
+	// Children placed in other clusters can't be garbage collected via owner references, hence the finalizer.
+	if !sd.DeletionTimestamp.IsZero() {
+		if controllerutil.ContainsFinalizer(&sd, placementFinalizer) {
+			if err := r.cleanupPlacement(ctx, &sd, nil); err != nil {
+				return ctrl.Result{}, fmt.Errorf("cleanup placement: %w", err)
+			}
+			r.clusters.retain(req.NamespacedName)
+			controllerutil.RemoveFinalizer(&sd, placementFinalizer)
+			return ctrl.Result{}, r.Update(ctx, &sd)
+		}
+		return ctrl.Result{}, nil
+	}
 
-		// Set Selector
-		dep.Spec.Selector = &metav1.LabelSelector{
-			MatchLabels: map[string]string{"app": sd.Name},
+	// 2) Merge the ServiceDeploymentClass defaults (if any) into the spec we render from.
+	// `sd` itself stays untouched: it is the owner of the children and the object whose status we sync.
+	class, err := r.resolveClass(ctx, &sd)
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			// The class watch will requeue this ServiceDeployment once the class gets created.
+			r.eventf(ctx, &sd, nil, corev1.EventTypeWarning, "ClassNotFound", "ResolveClass", "ServiceDeploymentClass %q not found", r.className(&sd))
+			return ctrl.Result{}, waitingError("ClassNotFound", err)
+		}
+		if errors.Is(err, errClassesUnavailable) {
+			return ctrl.Result{}, invalidError("ClassUnavailable", fmt.Errorf("cannot use ServiceDeploymentClass %q: %w", sd.Spec.ClassName, err))
 		}
+		return ctrl.Result{}, fmt.Errorf("resolve class: %w", err)
+	}
+	effective := applyClass(&sd, class)
+	if err := validateService(&effective.Spec.Service); err != nil {
+		return ctrl.Result{}, invalidError("InvalidService", fmt.Errorf("spec.service: %w", err))
+	}
+	if !placed(&sd) {
+		key := client.ObjectKey{Namespace: sd.Namespace, Name: serviceName(sd.Name)}
+		if err := checkHeadless(ctx, r.Client, key, &effective.Spec.Service); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	if live.enabled(featureProbesShorthand) {
+		applyProbes(effective)
+	}
+	// Tells a new rollout from a rollback to the previous pod template (see notifications.go)
+	hash := templateHash(&sd, effective, class)
 
-		// Set Template
-		if dep.Spec.Template.ObjectMeta.Name == "" {
-			dep.Spec.Template.ObjectMeta.Name = sd.Name
+	// 3) Hold the Deployment at zero replicas until every `spec.dependsOn` entry is Available.
+	// Dependencies are watched (see main), so there is no need to requeue while waiting.
+	var waiting []string
+	if live.enabled(featureDependencies) {
+		waiting, err = r.checkDependencies(ctx, &sd)
+	}
+	if err != nil && !errors.Is(err, errDependencyCycle) && !errors.Is(err, errOutOfScope) {
+		return ctrl.Result{}, fmt.Errorf("check dependencies: %w", err)
+	}
+	dependencies := dependenciesCondition(&sd, waiting, err)
+	if !live.enabled(featureDependencies) && len(sd.Spec.DependsOn) > 0 {
+		dependencies.Reason, dependencies.Message = "DependenciesDisabled", "The Dependencies feature gate is off"
+	}
+	if dependencies.Status == metav1.ConditionTrue {
+		if errors.Is(err, errDependencyCycle) {
+			r.eventf(ctx, &sd, nil, corev1.EventTypeWarning, "DependencyCycle", "CheckDependencies", "%v", err)
+		}
+		if errors.Is(err, errOutOfScope) {
+			r.eventf(ctx, &sd, nil, corev1.EventTypeWarning, "DependencyOutOfScope", "CheckDependencies", "%v", err)
 		}
-		dep.Spec.Template.ObjectMeta.Labels = map[string]string{"app": sd.Name}
-		dep.Spec.Template.Spec.Containers = sd.Spec.Containers
+		log.Info("waiting for dependencies", "reason", dependencies.Reason, "message", dependencies.Message)
+		effective.Spec.Replicas = 0
+	}
 
-		// [Very Important]: Set controller `ownerReferences` for GC + Owns()
-		// It sets the OwnerReference on the Deployment object, pointing to ServiceDeployment (CR).
-		return controllerutil.SetControllerReference(&sd, dep, r.scheme)
-	})
-	if err != nil {
-		// Optimistic-concurrency conflict:
-		// Sometimes the Deployment’s metadata.resourceVersion changed between your read and your write
-		// (e.g., defaults/managedFields/status updates or two reconciles racing), so the API rejected your update once;
-		// the next attempt used the latest object and succeeded—hence the subsequent “Updated” events.
-		//
-		// This is a benign race condition and we can treat it as transient and requeu without spamming as a Warning Event.
-		if k8serrors.IsConflict(err) {
-			log.Info("deployment update conflicted, will retry")
-			return ctrl.Result{Requeue: true}, nil
-		}
-		// Record a Warning tied to the CR
-		r.recorder.Eventf(&sd, corev1.EventTypeWarning, "ApplyDeploymentFailed", "Failed to apply Deployment %q: %v", dep.Name, err)
-		return ctrl.Result{}, fmt.Errorf("apply deployment: %w", err)
-	}
-	// Record Normal event for created/updated/noop
-	switch result {
-	case controllerutil.OperationResultCreated:
-		r.recorder.Eventf(&sd, corev1.EventTypeNormal, "DeploymentCreated", "Created Deployment %q", dep.Name)
-	case controllerutil.OperationResultUpdated:
-		r.recorder.Eventf(&sd, corev1.EventTypeNormal, "DeploymentUpdated", "Updated Deployment %q", dep.Name)
-	default:
-		// No change; keep noise low—skip or log a verbose message
-	}
-
-	// 3) Ensure child Service
-	svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{
-		Name:      svcName,
-		Namespace: sd.Namespace,
-	}}
-	result, err = controllerutil.CreateOrUpdate(ctx, r.Client, svc, func() error {
-		// Keep ClusterIP if it already exists (immutable for ClusterIP services)
-		// CreateOrUpdate will load existing svc into object for us.
-		svc.Labels = map[string]string{"app": sd.Name}
-
-		svc.Spec.Selector = map[string]string{"app": sd.Name}
-		svc.Spec.Type = sd.Spec.Service.Type
-
-		// Preserve clusterIP on updates when Type == ClusterIP
-		if svc.Spec.ClusterIP != "" {
-			// leave as is
-		}
-		svc.Spec.Ports = sd.Spec.Service.Ports
-
-		// [Very Important]: Set controller `ownerReferences` for GC + Owns()
-		// It sets the OwnerReference on the Service object, pointing to ServiceDeployment (CR).
-		return controllerutil.SetControllerReference(&sd, svc, r.scheme)
-	})
-	if err != nil {
-		// Record a Warning tied to the CR
-		r.recorder.Eventf(&sd, corev1.EventTypeWarning, "ApplyServiceFailed", "Failed to apply Service %q: %v", svc.Name, err)
-		return ctrl.Result{}, fmt.Errorf("apply service: %w", err)
-	}
-	// Record Normal event for created/updated/noop
-	switch result {
-	case controllerutil.OperationResultCreated:
-		r.recorder.Eventf(&sd, corev1.EventTypeNormal, "ServiceCreated", "Created Service %q", svc.Name)
-	case controllerutil.OperationResultUpdated:
-		r.recorder.Eventf(&sd, corev1.EventTypeNormal, "ServiceUpdated", "Updated Service %q", svc.Name)
-	default:
-		// No change; keep noise low—skip or log a verbose message
-	}
-
-	// 4) Sync Status
-	err = r.SyncStatus(ctx, &sd, dep, svc)
-	if err != nil {
-		log.Error(err, "failed to sync status with deployment or service")
+	// With `driftPolicy: Report`, children that differ although this generation and pod template were already rendered
+	// are left alone (see driftGuard)
+	unchanged := rendered(&sd) && sd.Status.TemplateHash == hash
+
+	// The shard label may have changed since the ServiceDeployment was read, and the new owner may be reconciling it
+	// already. Check again right before writing to the children.
+	if owned, err := r.shards.stillOwns(ctx, r.apiReader, &sd, shard); err != nil || !owned {
+		if err == nil {
+			log.V(1).Info("servicedeployment moved to a shard owned by another replica, leaving it", "shard", shard)
+		}
+		return ctrl.Result{}, err
 	}
 
-	log.Info("reconciled", "deployment", dep.Name, "service", svc.Name)
-	return ctrl.Result{}, nil
-}
+	// With a placement the children live in the target clusters, not in this one.
+	if placed(&sd) {
+		if controllerutil.AddFinalizer(&sd, placementFinalizer) {
+			if err := r.Update(ctx, &sd); err != nil {
+				return ctrl.Result{}, fmt.Errorf("add placement finalizer: %w", err)
+			}
+		}
+		return r.reconcilePlacement(ctx, &sd, effective, class, hash, dependencies)
+	}
+	if controllerutil.ContainsFinalizer(&sd, placementFinalizer) {
+		// Placement was removed: take the children out of the former target clusters and render them here again
+		if err := r.cleanupPlacement(ctx, &sd, nil); err != nil {
+			return ctrl.Result{}, fmt.Errorf("cleanup placement: %w", err)
+		}
+		r.clusters.retain(req.NamespacedName)
+		controllerutil.RemoveFinalizer(&sd, placementFinalizer)
+		if err := r.Update(ctx, &sd); err != nil {
+			return ctrl.Result{}, fmt.Errorf("remove placement finalizer: %w", err)
+		}
+	}
 
-func fillFromDeploymentStatus(dst *apiv1.ServiceDeploymentStatus, sd *apiv1.ServiceDeployment, dep *appsv1.Deployment) {
-	dst.DesiredReplicas = sd.Spec.Replicas
-	dst.ReadyReplicas = dep.Status.ReadyReplicas
-	dst.UpdatedReplicas = dep.Status.UpdatedReplicas
-	dst.AvailableReplicas = dep.Status.AvailableReplicas
-	dst.Ready = fmt.Sprintf("%d/%d", dep.Status.ReadyReplicas, sd.Spec.Replicas)
+	// 4) Apply the extra resources first: the pods may need them (e.g. a ConfigMap or ServiceAccount).
+	// Their failures are in the status, which is synced before they are returned (see extraresources.go)
+	extras, extrasErr := r.applyExtraResources(ctx, &sd, live, unchanged)
 
-	// Build the selector string for the scale subresource
-	if dep.Spec.Selector != nil {
-		if sel, err := metav1.LabelSelectorAsSelector(dep.Spec.Selector); err == nil {
-			dst.Selector = sel.String() // e.g. "app=nginx"
+	// 5) Ensure the children: Deployment, Service, ... (see children.go)
+	children := make([]client.Object, len(childGenerators))
+	for i, gen := range childGenerators {
+		if children[i], err = r.applyChild(ctx, gen, &sd, effective, class, live, unchanged); err != nil {
+			return ctrl.Result{}, err
 		}
 	}
+
+	// 6) Sync Status
+	if err := r.SyncStatus(ctx, &sd, children, extras, hash, dependencies); err != nil {
+		return ctrl.Result{}, fmt.Errorf("sync status: %w", err)
+	}
+	if extrasErr != nil {
+		return ctrl.Result{}, fmt.Errorf("extra resources: %w", extrasErr)
+	}
+
+	keysAndValues := make([]interface{}, 0, 2*len(children))
+	for i, gen := range childGenerators {
+		keysAndValues = append(keysAndValues, strings.ToLower(gen.kind()), children[i].GetName())
+	}
+	log.Info("reconciled", keysAndValues...)
+	return ctrl.Result{}, nil
 }
 
-func fillFromServiceStatus(dst *apiv1.ServiceDeploymentStatus, svc *corev1.Service) {
-	dst.ServiceType = string(svc.Spec.Type)
-	dst.ClusterIP = svc.Spec.ClusterIP
-	dst.ExternalIPs = strings.Join(svc.Spec.ExternalIPs, ",")
-	var parts []string
-	for _, p := range svc.Spec.Ports {
-		proto := p.Protocol
-		if proto == "" {
-			proto = corev1.ProtocolTCP
-		}
-		parts = append(parts, fmt.Sprintf("%d/%s", p.Port, proto))
+// setConditions sets the Available condition from the replica counts, plus any conditions computed during the reconcile.
+func setConditions(dst *apiv1.ServiceDeploymentStatus, sd *apiv1.ServiceDeployment, conds ...metav1.Condition) {
+	available := metav1.Condition{
+		Type:               apiv1.ConditionAvailable,
+		Status:             metav1.ConditionFalse,
+		Reason:             "ReplicasNotAvailable",
+		Message:            fmt.Sprintf("%d/%d replicas available", dst.AvailableReplicas, dst.DesiredReplicas),
+		ObservedGeneration: sd.Generation,
+	}
+	if dst.DesiredReplicas > 0 && dst.AvailableReplicas >= dst.DesiredReplicas {
+		available.Status = metav1.ConditionTrue
+		available.Reason = "ReplicasAvailable"
+	}
+	meta.SetStatusCondition(&dst.Conditions, available)
+	// Only called once a reconcile went through, which ends any earlier permanent error
+	meta.SetStatusCondition(&dst.Conditions, metav1.Condition{
+		Type:               apiv1.ConditionDegraded,
+		Status:             metav1.ConditionFalse,
+		Reason:             "Reconciled",
+		ObservedGeneration: sd.Generation,
+	})
+	for _, c := range conds {
+		meta.SetStatusCondition(&dst.Conditions, c)
 	}
-	dst.Ports = strings.Join(parts, ",")
 }
 
-func (r *reconciler) SyncStatus(ctx context.Context, sd *apiv1.ServiceDeployment, dep *appsv1.Deployment, svc *corev1.Service) error {
-	desired := sd.Status
-	fillFromDeploymentStatus(&desired, sd, dep)
-	fillFromServiceStatus(&desired, svc)
+// SyncStatus updates the status of `sd` from its `children`, one per childGenerators entry, and its `extras` resources.
+func (r *reconciler) SyncStatus(ctx context.Context, sd *apiv1.ServiceDeployment, children []client.Object, extras []apiv1.ExtraResourceStatus, templateHash string, conds ...metav1.Condition) (err error) {
+	ctx, span := tracer.Start(ctx, "SyncStatus")
+	defer func() { endSpan(span, err) }()
+
+	desired := *sd.Status.DeepCopy()
+	for i, gen := range childGenerators {
+		gen.fillStatus(&desired, sd, children[i])
+	}
+	desired.Clusters = nil // only used with `spec.placement`
+	desired.ExtraResources = extras
+	fillTemplateHash(&desired, templateHash)
+	r.shards.fillStatus(&desired, sd)
+	r.controller.fillStatus(&desired, sd)
+	setConditions(&desired, sd, conds...)
 
 	// If there are no changes, do nothing
 	if equality.Semantic.DeepEqual(sd.Status, desired) {
@@ -209,5 +342,9 @@ func (r *reconciler) SyncStatus(ctx context.Context, sd *apiv1.ServiceDeployment
 	}
 	orig := sd.DeepCopy()
 	sd.Status = desired
-	return r.Status().Patch(ctx, sd, client.MergeFrom(orig))
+	if err := r.Status().Patch(ctx, sd, client.MergeFrom(orig)); err != nil {
+		return err
+	}
+	r.notifier.observe(ctx, sd, &orig.Status)
+	return nil
 }
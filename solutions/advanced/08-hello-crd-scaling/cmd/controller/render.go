@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+
+	apiv1 "github.com/jayantasamaddar/quick-reference-kubernetes/solutions/hello-crd-scaling/api/v1"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// The render functions write the desired state of a child into the (possibly already existing) object.
+// They are used as the body of `CreateOrUpdate` mutate functions, both for the local cluster and for placement targets,
+// so they must not set anything cluster-specific such as owner references.
+//
+// - `sd`: the ServiceDeployment as stored, used for names and labels.
+// - `effective`: `sd` with the class defaults merged in, used for everything rendered from the spec.
+// - `class`: the class itself (may be nil), for pod- and metadata-level defaults.
+
+func renderDeployment(dep *appsv1.Deployment, sd, effective *apiv1.ServiceDeployment, class *apiv1.ServiceDeploymentClass) {
+	classLabels, classAnnotations := classMetadata(class)
+	previous := readManagedKeys(dep)
+	var managed managedKeys
+
+	// Set Labels and Annotations: the class ones but for "app", next to those of others
+	dep.Labels, managed.Labels = syncManaged(dep.Labels, previous.Labels, withApp(classLabels, sd.Name))
+	dep.Annotations, managed.Annotations = syncManaged(dep.Annotations, previous.Annotations, classAnnotations)
+
+	// Set Replicas (from `effective`: held at zero while waiting for dependencies)
+	replicas := effective.Spec.Replicas
+	dep.Spec.Replicas = &replicas
+
+	// Set Selector
+	dep.Spec.Selector = &metav1.LabelSelector{
+		MatchLabels: map[string]string{"app": sd.Name},
+	}
+
+	// Set Template
+	if dep.Spec.Template.ObjectMeta.Name == "" {
+		dep.Spec.Template.ObjectMeta.Name = sd.Name
+	}
+	dep.Spec.Template.ObjectMeta.Labels = withApp(classLabels, sd.Name)
+	// Annotations of others (e.g. `kubectl rollout restart`) stay
+	dep.Spec.Template.ObjectMeta.Annotations, managed.TemplateAnnotations = syncManaged(dep.Spec.Template.ObjectMeta.Annotations, previous.TemplateAnnotations, classAnnotations)
+	dep.Spec.Template.Spec.Containers = effective.Spec.Containers
+	applyClassToPodTemplate(&dep.Spec.Template, class)
+	managed.write(dep)
+}
+
+func renderService(svc *corev1.Service, sd, effective *apiv1.ServiceDeployment, class *apiv1.ServiceDeploymentClass) {
+	spec := &effective.Spec.Service
+	classLabels, classAnnotations := classMetadata(class)
+	previous := readManagedKeys(svc)
+	var managed managedKeys
+
+	// The spec's labels win over the class ones, and "app" over both
+	labels := maps.Clone(classLabels)
+	if labels == nil {
+		labels = make(map[string]string, len(spec.Labels)+1)
+	}
+	maps.Copy(labels, spec.Labels)
+	svc.Labels = withApp(labels, sd.Name)
+	// Annotations of others (e.g. a cloud load balancer controller) stay; ours are removed once they leave the spec and class
+	annotations := maps.Clone(classAnnotations)
+	if annotations == nil {
+		annotations = make(map[string]string, len(spec.Annotations))
+	}
+	maps.Copy(annotations, spec.Annotations)
+	svc.Annotations, managed.Annotations = syncManaged(svc.Annotations, previous.Annotations, annotations)
+	managed.write(svc)
+
+	svc.Spec.Type = spec.Type
+	svc.Spec.Ports = servicePorts(spec.Ports, svc.Spec.Ports, svc.Spec.Type)
+	svc.Spec.PublishNotReadyAddresses = spec.PublishNotReadyAddresses
+	svc.Spec.SessionAffinity = spec.SessionAffinity
+	if svc.Spec.SessionAffinity == "" {
+		svc.Spec.SessionAffinity = corev1.ServiceAffinityNone
+	}
+	if svc.Spec.SessionAffinity == corev1.ServiceAffinityNone {
+		svc.Spec.SessionAffinityConfig = nil
+	}
+
+	svc.Spec.ExternalName = spec.ExternalName
+	if svc.Spec.Type == corev1.ServiceTypeExternalName {
+		// A DNS alias: no selector, no cluster IP, no traffic policies
+		svc.Spec.Selector = nil
+		svc.Spec.ClusterIP, svc.Spec.ClusterIPs = "", nil
+		svc.Spec.IPFamilies, svc.Spec.IPFamilyPolicy = nil, nil
+		svc.Spec.InternalTrafficPolicy = nil
+	} else {
+		svc.Spec.Selector = map[string]string{"app": sd.Name}
+		// clusterIP(s) and ipFamilies are allocated by the API server and immutable (but for the secondary family of a
+		// dual-stack Service): never rendered, so an update keeps those of the existing Service.
+		if spec.Headless {
+			svc.Spec.ClusterIP = corev1.ClusterIPNone
+		}
+		if spec.IPFamilyPolicy != "" {
+			policy := spec.IPFamilyPolicy
+			svc.Spec.IPFamilyPolicy = &policy
+		}
+		internal := spec.InternalTrafficPolicy
+		if internal == "" {
+			internal = corev1.ServiceInternalTrafficPolicyCluster
+		}
+		svc.Spec.InternalTrafficPolicy = &internal
+	}
+
+	// The fields only some types may have are dropped when the type changes to one without them, else the API server
+	// rejects the update (e.g. LoadBalancer -> ClusterIP with a healthCheckNodePort).
+	if hasNodePorts(svc.Spec.Type) {
+		svc.Spec.ExternalTrafficPolicy = spec.ExternalTrafficPolicy
+		if svc.Spec.ExternalTrafficPolicy == "" {
+			svc.Spec.ExternalTrafficPolicy = corev1.ServiceExternalTrafficPolicyCluster
+		}
+	} else {
+		svc.Spec.ExternalTrafficPolicy = ""
+	}
+	if svc.Spec.Type != corev1.ServiceTypeLoadBalancer || svc.Spec.ExternalTrafficPolicy != corev1.ServiceExternalTrafficPolicyLocal {
+		svc.Spec.HealthCheckNodePort = 0
+	}
+	if svc.Spec.Type == corev1.ServiceTypeLoadBalancer {
+		// Immutable once set, so an unset one keeps the class the Service got
+		if spec.LoadBalancerClass != "" {
+			lbClass := spec.LoadBalancerClass
+			svc.Spec.LoadBalancerClass = &lbClass
+		}
+		svc.Spec.LoadBalancerSourceRanges = slices.Clone(spec.LoadBalancerSourceRanges)
+	} else {
+		svc.Spec.AllocateLoadBalancerNodePorts = nil
+		svc.Spec.LoadBalancerClass = nil
+		svc.Spec.LoadBalancerSourceRanges = nil
+	}
+}
+
+// servicePorts returns the ports of the spec, with what the API server would default filled in (protocol, targetPort)
+// and the nodePort the API server allocated to the port of the same name in `existing` kept, unless the spec sets one.
+// Assigning the spec ports as they are would release and reallocate every nodePort on each update.
+func servicePorts(spec, existing []corev1.ServicePort, svcType corev1.ServiceType) []corev1.ServicePort {
+	allocated := make(map[string]int32, len(existing))
+	if hasNodePorts(svcType) {
+		for _, p := range existing {
+			allocated[p.Name] = p.NodePort
+		}
+	}
+	ports := make([]corev1.ServicePort, len(spec))
+	for i, p := range spec {
+		if p.Protocol == "" {
+			p.Protocol = corev1.ProtocolTCP
+		}
+		if p.TargetPort.Type == intstr.Int && p.TargetPort.IntVal == 0 {
+			p.TargetPort = intstr.FromInt32(p.Port)
+		}
+		if p.NodePort == 0 {
+			p.NodePort = allocated[p.Name]
+		}
+		ports[i] = p
+	}
+	return ports
+}
+
+// hasNodePorts reports whether Services of type `t` are exposed on node ports (LoadBalancer ones by default).
+func hasNodePorts(t corev1.ServiceType) bool {
+	return t == corev1.ServiceTypeNodePort || t == corev1.ServiceTypeLoadBalancer
+}
+
+// Name of the child Service
+func serviceName(name string) string {
+	return fmt.Sprintf("%s-svc", name)
+}
+
+// classMetadata returns the labels and annotations of `class`, nil without one.
+func classMetadata(class *apiv1.ServiceDeploymentClass) (labels, annotations map[string]string) {
+	if class == nil {
+		return nil, nil
+	}
+	return class.Spec.Labels, class.Spec.Annotations
+}
+
+// withApp returns a copy of `labels` with the "app" label of the ServiceDeployment `sdName`, which nothing overrides.
+func withApp(labels map[string]string, sdName string) map[string]string {
+	out := make(map[string]string, len(labels)+1)
+	maps.Copy(out, labels)
+	out["app"] = sdName
+	return out
+}
+
+// managedKeys are the keys of the labels and annotations the last render set on a child, recorded in its
+// apiv1.ManagedMetadataAnnotation. Children also carry those of others (e.g. `deployment.kubernetes.io/revision`),
+// so a key the render no longer sets is only removed if it is one of these.
+type managedKeys struct {
+	Labels              []string `json:"labels,omitempty"`
+	Annotations         []string `json:"annotations,omitempty"`
+	TemplateAnnotations []string `json:"templateAnnotations,omitempty"`
+}
+
+// readManagedKeys returns the keys recorded on `obj`, none if there are none or they don't parse.
+func readManagedKeys(obj metav1.Object) managedKeys {
+	var keys managedKeys
+	if data, ok := obj.GetAnnotations()[apiv1.ManagedMetadataAnnotation]; ok {
+		_ = json.Unmarshal([]byte(data), &keys)
+	}
+	return keys
+}
+
+// write records the keys on `obj`, or removes the record if there are none.
+func (k managedKeys) write(obj metav1.Object) {
+	annotations := obj.GetAnnotations()
+	if len(k.Labels)+len(k.Annotations)+len(k.TemplateAnnotations) == 0 {
+		delete(annotations, apiv1.ManagedMetadataAnnotation)
+		obj.SetAnnotations(annotations)
+		return
+	}
+	data, err := json.Marshal(k)
+	if err != nil {
+		return
+	}
+	if annotations == nil {
+		annotations = make(map[string]string, 1)
+	}
+	annotations[apiv1.ManagedMetadataAnnotation] = string(data)
+	obj.SetAnnotations(annotations)
+}
+
+// syncManaged sets `desired` in `m` and removes the `previous` keys no longer in it. It returns `m` (allocated if
+// needed, nil if left empty) and the sorted keys of `desired`, to record for the next render.
+func syncManaged(m map[string]string, previous []string, desired map[string]string) (map[string]string, []string) {
+	for _, k := range previous {
+		if _, ok := desired[k]; !ok {
+			delete(m, k)
+		}
+	}
+	if len(desired) > 0 && m == nil {
+		m = make(map[string]string, len(desired))
+	}
+	maps.Copy(m, desired)
+	if len(m) == 0 {
+		m = nil
+	}
+	return m, slices.Sorted(maps.Keys(desired))
+}
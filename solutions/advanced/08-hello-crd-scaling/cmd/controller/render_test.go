@@ -0,0 +1,257 @@
+package main
+
+import (
+	"maps"
+	"testing"
+
+	apiv1 "github.com/jayantasamaddar/quick-reference-kubernetes/solutions/hello-crd-scaling/api/v1"
+
+	"github.com/google/go-cmp/cmp"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/utils/ptr"
+)
+
+func TestServicePorts(t *testing.T) {
+	allocated := []corev1.ServicePort{
+		{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80, TargetPort: intstr.FromInt32(8080), NodePort: 30080},
+		{Name: "metrics", Protocol: corev1.ProtocolTCP, Port: 9090, TargetPort: intstr.FromInt32(9090), NodePort: 30090},
+	}
+	tests := []struct {
+		name     string
+		spec     []corev1.ServicePort
+		existing []corev1.ServicePort
+		svcType  corev1.ServiceType
+		want     []corev1.ServicePort
+	}{
+		{
+			name:    "defaults protocol and targetPort like the API server",
+			spec:    []corev1.ServicePort{{Name: "http", Port: 80}},
+			svcType: corev1.ServiceTypeClusterIP,
+			want:    []corev1.ServicePort{{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80, TargetPort: intstr.FromInt32(80)}},
+		},
+		{
+			name:     "keeps allocated nodePorts by port name",
+			spec:     []corev1.ServicePort{{Name: "metrics", Port: 9090}, {Name: "http", Port: 80, TargetPort: intstr.FromInt32(8080)}},
+			existing: allocated,
+			svcType:  corev1.ServiceTypeNodePort,
+			want: []corev1.ServicePort{
+				{Name: "metrics", Protocol: corev1.ProtocolTCP, Port: 9090, TargetPort: intstr.FromInt32(9090), NodePort: 30090},
+				{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80, TargetPort: intstr.FromInt32(8080), NodePort: 30080},
+			},
+		},
+		{
+			name:     "renamed port gets a new nodePort",
+			spec:     []corev1.ServicePort{{Name: "web", Port: 80, TargetPort: intstr.FromInt32(8080)}},
+			existing: allocated,
+			svcType:  corev1.ServiceTypeNodePort,
+			want:     []corev1.ServicePort{{Name: "web", Protocol: corev1.ProtocolTCP, Port: 80, TargetPort: intstr.FromInt32(8080)}},
+		},
+		{
+			name:     "explicit nodePort wins over the allocated one",
+			spec:     []corev1.ServicePort{{Name: "http", Port: 80, TargetPort: intstr.FromInt32(8080), NodePort: 30500}},
+			existing: allocated,
+			svcType:  corev1.ServiceTypeLoadBalancer,
+			want:     []corev1.ServicePort{{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80, TargetPort: intstr.FromInt32(8080), NodePort: 30500}},
+		},
+		{
+			name:     "no nodePorts for ClusterIP",
+			spec:     []corev1.ServicePort{{Name: "http", Port: 80, TargetPort: intstr.FromInt32(8080)}},
+			existing: allocated,
+			svcType:  corev1.ServiceTypeClusterIP,
+			want:     []corev1.ServicePort{{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80, TargetPort: intstr.FromInt32(8080)}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := append([]corev1.ServicePort(nil), tt.spec...)
+			got := servicePorts(tt.spec, tt.existing, tt.svcType)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("ports (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(spec, tt.spec); diff != "" {
+				t.Errorf("the spec ports were modified (-before +after):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRenderServiceTypeTransitions(t *testing.T) {
+	port := corev1.ServicePort{Name: "http", Port: 80, TargetPort: intstr.FromInt32(8080)}
+	withNodePort := func(nodePort int32) []corev1.ServicePort {
+		p := port
+		p.Protocol, p.NodePort = corev1.ProtocolTCP, nodePort
+		return []corev1.ServicePort{p}
+	}
+	// As the API server stores each type once allocated and defaulted
+	live := map[corev1.ServiceType]corev1.ServiceSpec{
+		corev1.ServiceTypeClusterIP: {
+			Type: corev1.ServiceTypeClusterIP, ClusterIP: "10.96.0.10", ClusterIPs: []string{"10.96.0.10"},
+			Ports: withNodePort(0),
+		},
+		corev1.ServiceTypeNodePort: {
+			Type: corev1.ServiceTypeNodePort, ClusterIP: "10.96.0.10", ClusterIPs: []string{"10.96.0.10"},
+			Ports: withNodePort(30080), ExternalTrafficPolicy: corev1.ServiceExternalTrafficPolicyCluster,
+		},
+		corev1.ServiceTypeLoadBalancer: {
+			Type: corev1.ServiceTypeLoadBalancer, ClusterIP: "10.96.0.10", ClusterIPs: []string{"10.96.0.10"},
+			Ports: withNodePort(30080), ExternalTrafficPolicy: corev1.ServiceExternalTrafficPolicyLocal, HealthCheckNodePort: 32000,
+			AllocateLoadBalancerNodePorts: ptr.To(true), LoadBalancerClass: ptr.To("example.com/lb"),
+		},
+	}
+	tests := []struct {
+		name                  string
+		from, to              corev1.ServiceType
+		externalTrafficPolicy corev1.ServiceExternalTrafficPolicy
+		wantNodePort          int32
+		wantTrafficPolicy     corev1.ServiceExternalTrafficPolicy
+		wantHealthCheckPort   int32
+		wantLoadBalancerClass *string
+	}{
+		{
+			name: "ClusterIP to NodePort", from: corev1.ServiceTypeClusterIP, to: corev1.ServiceTypeNodePort,
+			wantNodePort: 0, wantTrafficPolicy: corev1.ServiceExternalTrafficPolicyCluster,
+		},
+		{
+			name: "NodePort to LoadBalancer", from: corev1.ServiceTypeNodePort, to: corev1.ServiceTypeLoadBalancer,
+			wantNodePort: 30080, wantTrafficPolicy: corev1.ServiceExternalTrafficPolicyCluster,
+		},
+		{
+			name: "LoadBalancer to ClusterIP", from: corev1.ServiceTypeLoadBalancer, to: corev1.ServiceTypeClusterIP,
+			wantNodePort: 0, wantTrafficPolicy: "", wantHealthCheckPort: 0,
+		},
+		{
+			name: "LoadBalancer to NodePort", from: corev1.ServiceTypeLoadBalancer, to: corev1.ServiceTypeNodePort,
+			externalTrafficPolicy: corev1.ServiceExternalTrafficPolicyLocal,
+			wantNodePort:          30080,
+			wantTrafficPolicy:     corev1.ServiceExternalTrafficPolicyLocal,
+		},
+		{
+			name: "LoadBalancer unchanged", from: corev1.ServiceTypeLoadBalancer, to: corev1.ServiceTypeLoadBalancer,
+			externalTrafficPolicy: corev1.ServiceExternalTrafficPolicyLocal,
+			wantNodePort:          30080,
+			wantTrafficPolicy:     corev1.ServiceExternalTrafficPolicyLocal,
+			wantHealthCheckPort:   32000,
+			wantLoadBalancerClass: ptr.To("example.com/lb"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sd := newTestServiceDeployment("default", "web")
+			sd.Spec.Service.Type = tt.to
+			sd.Spec.Service.Ports = []corev1.ServicePort{port}
+			sd.Spec.Service.ExternalTrafficPolicy = tt.externalTrafficPolicy
+			from := live[tt.from]
+			svc := &corev1.Service{Spec: *from.DeepCopy()}
+
+			renderService(svc, sd, sd, nil)
+
+			if svc.Spec.Type != tt.to {
+				t.Errorf("type: got %q, want %q", svc.Spec.Type, tt.to)
+			}
+			if got := svc.Spec.Ports[0].NodePort; got != tt.wantNodePort {
+				t.Errorf("nodePort: got %d, want %d", got, tt.wantNodePort)
+			}
+			if svc.Spec.ClusterIP != "10.96.0.10" || len(svc.Spec.ClusterIPs) != 1 {
+				t.Errorf("clusterIP(s): got %q %v, want the allocated 10.96.0.10 kept", svc.Spec.ClusterIP, svc.Spec.ClusterIPs)
+			}
+			if svc.Spec.ExternalTrafficPolicy != tt.wantTrafficPolicy {
+				t.Errorf("externalTrafficPolicy: got %q, want %q", svc.Spec.ExternalTrafficPolicy, tt.wantTrafficPolicy)
+			}
+			if svc.Spec.HealthCheckNodePort != tt.wantHealthCheckPort {
+				t.Errorf("healthCheckNodePort: got %d, want %d", svc.Spec.HealthCheckNodePort, tt.wantHealthCheckPort)
+			}
+			if diff := cmp.Diff(tt.wantLoadBalancerClass, svc.Spec.LoadBalancerClass); diff != "" {
+				t.Errorf("loadBalancerClass (-want +got):\n%s", diff)
+			}
+			if tt.to != corev1.ServiceTypeLoadBalancer && svc.Spec.AllocateLoadBalancerNodePorts != nil {
+				t.Errorf("allocateLoadBalancerNodePorts: got %v, want unset", *svc.Spec.AllocateLoadBalancerNodePorts)
+			}
+		})
+	}
+}
+
+func TestRenderClassMetadata(t *testing.T) {
+	sd := newTestServiceDeployment("default", "web")
+	class := func(labels, annotations map[string]string) *apiv1.ServiceDeploymentClass {
+		return &apiv1.ServiceDeploymentClass{Spec: apiv1.ServiceDeploymentClassSpec{Labels: labels, Annotations: annotations}}
+	}
+	before := class(map[string]string{"team": "a", "tier": "web", "app": "other"}, map[string]string{"owner": "team-a", "docs": "https://docs"})
+	after := class(map[string]string{"team": "b"}, map[string]string{"owner": "team-b"})
+
+	var dep appsv1.Deployment
+	renderDeployment(&dep, sd, applyClass(sd, before), before)
+	// Set by others meanwhile
+	dep.Labels["backup"] = "daily"
+	dep.Annotations["deployment.kubernetes.io/revision"] = "3"
+	dep.Spec.Template.Annotations["kubectl.kubernetes.io/restartedAt"] = "2026-01-01T00:00:00Z"
+	renderDeployment(&dep, sd, applyClass(sd, after), after)
+
+	wantLabels := map[string]string{"app": "web", "team": "b", "backup": "daily"}
+	if diff := cmp.Diff(wantLabels, dep.Labels); diff != "" {
+		t.Errorf("Deployment labels (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(map[string]string{"owner": "team-b", "deployment.kubernetes.io/revision": "3"}, withoutManaged(dep.Annotations)); diff != "" {
+		t.Errorf("Deployment annotations (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(map[string]string{"app": "web", "team": "b"}, dep.Spec.Template.Labels); diff != "" {
+		t.Errorf("pod template labels (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(map[string]string{"owner": "team-b", "kubectl.kubernetes.io/restartedAt": "2026-01-01T00:00:00Z"}, dep.Spec.Template.Annotations); diff != "" {
+		t.Errorf("pod template annotations (-want +got):\n%s", diff)
+	}
+
+	var svc corev1.Service
+	renderService(&svc, sd, applyClass(sd, before), before)
+	svc.Annotations["cloud.example.com/lb-id"] = "lb-1"
+	renderService(&svc, sd, applyClass(sd, after), after)
+	if diff := cmp.Diff(map[string]string{"app": "web", "team": "b"}, svc.Labels); diff != "" {
+		t.Errorf("Service labels (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(map[string]string{"owner": "team-b", "cloud.example.com/lb-id": "lb-1"}, withoutManaged(svc.Annotations)); diff != "" {
+		t.Errorf("Service annotations (-want +got):\n%s", diff)
+	}
+
+	// Without a class, nothing of it is left
+	renderDeployment(&dep, sd, applyClass(sd, nil), nil)
+	if diff := cmp.Diff(map[string]string{"app": "web", "backup": "daily"}, dep.Labels); diff != "" {
+		t.Errorf("Deployment labels without a class (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(managedKeys{Labels: []string{"app"}}, readManagedKeys(&dep)); diff != "" {
+		t.Errorf("keys recorded without a class (-want +got):\n%s", diff)
+	}
+}
+
+func withoutManaged(annotations map[string]string) map[string]string {
+	out := maps.Clone(annotations)
+	delete(out, apiv1.ManagedMetadataAnnotation)
+	return out
+}
+
+func TestRenderServiceAnnotations(t *testing.T) {
+	sd := newTestServiceDeployment("default", "web")
+	class := &apiv1.ServiceDeploymentClass{Spec: apiv1.ServiceDeploymentClassSpec{Annotations: map[string]string{"owner": "team-a", "scheme": "internet-facing"}}}
+	sd.Spec.Service.Annotations = map[string]string{"scheme": "internal", "idle-timeout": "60"}
+
+	var svc corev1.Service
+	renderService(&svc, sd, applyClass(sd, class), class)
+	if diff := cmp.Diff(map[string]string{"owner": "team-a", "scheme": "internal", "idle-timeout": "60"}, withoutManaged(svc.Annotations)); diff != "" {
+		t.Errorf("annotations (-want +got):\n%s", diff)
+	}
+
+	// Set by a load balancer controller meanwhile
+	svc.Annotations["cloud.example.com/lb-id"] = "lb-1"
+	sd.Spec.Service.Annotations = map[string]string{"idle-timeout": "120"}
+	renderService(&svc, sd, applyClass(sd, class), class)
+	want := map[string]string{"owner": "team-a", "scheme": "internet-facing", "idle-timeout": "120", "cloud.example.com/lb-id": "lb-1"}
+	if diff := cmp.Diff(want, withoutManaged(svc.Annotations)); diff != "" {
+		t.Errorf("annotations after removing from the spec (-want +got):\n%s", diff)
+	}
+
+	sd.Spec.Service.Annotations = nil
+	renderService(&svc, sd, applyClass(sd, nil), nil)
+	if diff := cmp.Diff(map[string]string{"cloud.example.com/lb-id": "lb-1"}, withoutManaged(svc.Annotations)); diff != "" {
+		t.Errorf("annotations without spec and class (-want +got):\n%s", diff)
+	}
+}
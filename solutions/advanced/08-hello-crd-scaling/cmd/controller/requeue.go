@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	apiv1 "github.com/jayantasamaddar/quick-reference-kubernetes/solutions/hello-crd-scaling/api/v1"
+
+	"golang.org/x/time/rate"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/workqueue"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// errorClass decides what happens to a ServiceDeployment after its reconcile failed.
+type errorClass string
+
+const (
+	// Anything that may work on a retry (API server unavailable, timeouts, ...): retried with exponential backoff
+	errorTransient errorClass = "transient"
+	// The object changed between read and write. The cache catches up quickly, so requeue after a short fixed delay.
+	errorConflict errorClass = "conflict"
+	// Retrying the same spec fails the same way: surfaced as the Degraded condition, retried once the spec changes
+	errorInvalid errorClass = "invalid"
+	// Something the ServiceDeployment needs doesn't exist yet: requeued after a longer fixed delay, on top of the watches
+	errorWaiting errorClass = "waiting"
+)
+
+// reconcileError forces the class of an error that the API status alone can't tell, with the reason used on the condition.
+type reconcileError struct {
+	class  errorClass
+	reason string
+	err    error
+}
+
+func (e *reconcileError) Error() string { return e.err.Error() }
+func (e *reconcileError) Unwrap() error { return e.err }
+
+func invalidError(reason string, err error) error {
+	return &reconcileError{class: errorInvalid, reason: reason, err: err}
+}
+
+func waitingError(reason string, err error) error {
+	return &reconcileError{class: errorWaiting, reason: reason, err: err}
+}
+
+// classify returns the class of `err` and a reason for the Degraded condition.
+func classify(err error) (errorClass, string) {
+	var re *reconcileError
+	if errors.As(err, &re) {
+		return re.class, re.reason
+	}
+	var owned *controllerutil.AlreadyOwnedError
+	switch {
+	case errors.As(err, &owned):
+		return errorInvalid, "ChildOwnedByOther"
+	case k8serrors.IsConflict(err):
+		return errorConflict, "Conflict"
+	case k8serrors.IsInvalid(err), k8serrors.IsBadRequest(err), k8serrors.IsRequestEntityTooLargeError(err):
+		return errorInvalid, "Invalid"
+	}
+	return errorTransient, "Error"
+}
+
+// Requeue policy of the ServiceDeployment controller, and the rate limiter of its work queue.
+type requeueConfig struct {
+	// Delay before retrying after a conflict
+	ConflictDelay metav1.Duration `json:"conflictDelay,omitzero"`
+	// Delay before checking again on something that doesn't exist yet (e.g. a ServiceDeploymentClass)
+	WaitingDelay metav1.Duration `json:"waitingDelay,omitzero"`
+	// Exponential backoff of transient errors, per ServiceDeployment
+	BaseDelay metav1.Duration `json:"baseDelay,omitzero"`
+	MaxDelay  metav1.Duration `json:"maxDelay,omitzero"`
+	// Overall rate of reconciles, across all ServiceDeployments
+	QPS   float64 `json:"qps,omitempty"`
+	Burst int     `json:"burst,omitempty"`
+}
+
+func (o *requeueConfig) bindFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&o.ConflictDelay.Duration, "requeue-conflict-delay", o.ConflictDelay.Duration, "Delay before retrying a reconcile that hit a conflict.")
+	fs.DurationVar(&o.WaitingDelay.Duration, "requeue-waiting-delay", o.WaitingDelay.Duration, "Delay before retrying a reconcile waiting for an object that doesn't exist yet.")
+	fs.DurationVar(&o.BaseDelay.Duration, "requeue-base-delay", o.BaseDelay.Duration, "First backoff delay after a transient error, doubled on every further failure.")
+	fs.DurationVar(&o.MaxDelay.Duration, "requeue-max-delay", o.MaxDelay.Duration, "Upper bound of the backoff delay after transient errors.")
+	fs.Float64Var(&o.QPS, "requeue-qps", o.QPS, "Overall reconciles per second allowed by the rate limiter.")
+	fs.IntVar(&o.Burst, "requeue-burst", o.Burst, "Burst of reconciles allowed above requeue-qps.")
+}
+
+func (o *requeueConfig) validate() error {
+	var errs []error
+	for name, d := range map[string]time.Duration{"conflictDelay": o.ConflictDelay.Duration, "waitingDelay": o.WaitingDelay.Duration, "baseDelay": o.BaseDelay.Duration} {
+		if d <= 0 {
+			errs = append(errs, fmt.Errorf("  requeue.%s: must be positive, got %s", name, d))
+		}
+	}
+	if o.MaxDelay.Duration < o.BaseDelay.Duration {
+		errs = append(errs, fmt.Errorf("  requeue.maxDelay: must be at least baseDelay (%s), got %s", o.BaseDelay.Duration, o.MaxDelay.Duration))
+	}
+	if o.QPS <= 0 {
+		errs = append(errs, fmt.Errorf("  requeue.qps: must be positive, got %v", o.QPS))
+	}
+	if o.Burst < 1 {
+		errs = append(errs, fmt.Errorf("  requeue.burst: must be at least 1, got %d", o.Burst))
+	}
+	return errors.Join(errs...)
+}
+
+// rateLimiter is controller-runtime's default limiter (per-item exponential backoff and an overall token bucket), with our numbers.
+func (o *requeueConfig) rateLimiter() workqueue.TypedRateLimiter[reconcile.Request] {
+	return workqueue.NewTypedMaxOfRateLimiter(
+		workqueue.NewTypedItemExponentialFailureRateLimiter[reconcile.Request](o.BaseDelay.Duration, o.MaxDelay.Duration),
+		&workqueue.TypedBucketRateLimiter[reconcile.Request]{Limiter: rate.NewLimiter(rate.Limit(o.QPS), o.Burst)},
+	)
+}
+
+// handleError applies the requeue policy of the class of `err`.
+// Invalid errors are final until the spec changes: they are recorded on the ServiceDeployment and not retried.
+func (r *reconciler) handleError(ctx context.Context, req ctrl.Request, err error) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+	class, reason := classify(err)
+	switch class {
+	case errorConflict:
+		log.Info("conflict, will retry", "error", err.Error(), "after", r.requeue.ConflictDelay.Duration)
+		return ctrl.Result{RequeueAfter: r.requeue.ConflictDelay.Duration}, nil
+	case errorWaiting:
+		log.Info("waiting, will retry", "reason", reason, "error", err.Error(), "after", r.requeue.WaitingDelay.Duration)
+		return ctrl.Result{RequeueAfter: r.requeue.WaitingDelay.Duration}, nil
+	case errorInvalid:
+		if derr := r.setDegraded(ctx, req, reason, err); derr != nil {
+			// Without the condition nobody would notice; retry until it is recorded
+			return ctrl.Result{}, fmt.Errorf("%w (recording the Degraded condition failed: %v)", err, derr)
+		}
+		return ctrl.Result{}, reconcile.TerminalError(err)
+	}
+	return ctrl.Result{}, err
+}
+
+// setDegraded records a permanent error on the ServiceDeployment as a Warning Event and the Degraded condition.
+// The next successful reconcile clears the condition (see setConditions).
+func (r *reconciler) setDegraded(ctx context.Context, req ctrl.Request, reason string, err error) error {
+	var sd apiv1.ServiceDeployment
+	if err := r.Get(ctx, req.NamespacedName, &sd); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	r.eventf(ctx, &sd, nil, corev1.EventTypeWarning, reason, "Reconcile", "%v", err)
+
+	orig := sd.DeepCopy()
+	meta.SetStatusCondition(&sd.Status.Conditions, metav1.Condition{
+		Type:               apiv1.ConditionDegraded,
+		Status:             metav1.ConditionTrue,
+		Reason:             reason,
+		Message:            err.Error(),
+		ObservedGeneration: sd.Generation,
+	})
+	if err := r.Status().Patch(ctx, &sd, client.MergeFrom(orig)); err != nil {
+		return err
+	}
+	r.notifier.observe(ctx, &sd, &orig.Status)
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	apiv1 "github.com/jayantasamaddar/quick-reference-kubernetes/solutions/hello-crd-scaling/api/v1"
+
+	appsv1 "k8s.io/api/apps/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+var errorCases = []struct {
+	name       string
+	err        error
+	wantClass  errorClass
+	wantReason string
+}{
+	{name: "plain error", err: errors.New("connection refused"), wantClass: errorTransient, wantReason: "Error"},
+	{name: "unavailable", err: k8serrors.NewServiceUnavailable("etcd"), wantClass: errorTransient, wantReason: "Error"},
+	{name: "timeout", err: k8serrors.NewTimeoutError("slow", 1), wantClass: errorTransient, wantReason: "Error"},
+	{
+		name:      "conflict",
+		err:       fmt.Errorf("sync status: %w", k8serrors.NewConflict(schema.GroupResource{Resource: "servicedeployments"}, "web", errors.New("modified"))),
+		wantClass: errorConflict, wantReason: "Conflict",
+	},
+	{
+		name:      "invalid",
+		err:       k8serrors.NewInvalid(schema.GroupKind{Kind: "Deployment"}, "web", field.ErrorList{field.Required(field.NewPath("spec"), "")}),
+		wantClass: errorInvalid, wantReason: "Invalid",
+	},
+	{name: "bad request", err: k8serrors.NewBadRequest("no"), wantClass: errorInvalid, wantReason: "Invalid"},
+	{name: "too large", err: k8serrors.NewRequestEntityTooLargeError("too large"), wantClass: errorInvalid, wantReason: "Invalid"},
+	{
+		name:      "child owned by another controller",
+		err:       fmt.Errorf("apply deployment: %w", &controllerutil.AlreadyOwnedError{Object: &appsv1.Deployment{}, Owner: metav1.OwnerReference{Kind: "ReplicaSet", Name: "other"}}),
+		wantClass: errorInvalid, wantReason: "ChildOwnedByOther",
+	},
+	{name: "forced invalid", err: fmt.Errorf("wrapped: %w", invalidError("InvalidService", errors.New("bad port"))), wantClass: errorInvalid, wantReason: "InvalidService"},
+	{name: "forced waiting", err: waitingError("ClassNotFound", k8serrors.NewNotFound(schema.GroupResource{}, "gold")), wantClass: errorWaiting, wantReason: "ClassNotFound"},
+}
+
+func TestClassify(t *testing.T) {
+	for _, tt := range errorCases {
+		t.Run(tt.name, func(t *testing.T) {
+			class, reason := classify(tt.err)
+			if class != tt.wantClass || reason != tt.wantReason {
+				t.Errorf("got %s/%s, want %s/%s", class, reason, tt.wantClass, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestHandleError(t *testing.T) {
+	for _, tt := range errorCases {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			sd := newTestServiceDeployment("team-a", "web")
+			env := newTestEnv(t, interceptor.Funcs{}, sd)
+			env.r.requeue = requeueConfig{
+				ConflictDelay: metav1.Duration{Duration: time.Second},
+				WaitingDelay:  metav1.Duration{Duration: time.Minute},
+			}
+
+			result, err := env.r.handleError(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(sd)}, tt.err)
+			var want ctrl.Result
+			switch tt.wantClass {
+			case errorConflict:
+				want.RequeueAfter = time.Second
+			case errorWaiting:
+				want.RequeueAfter = time.Minute
+			}
+			if result != want {
+				t.Errorf("result: got %+v, want %+v", result, want)
+			}
+			switch tt.wantClass {
+			case errorTransient:
+				// Retried with backoff by the work queue
+				if err == nil || errors.Is(err, reconcile.TerminalError(nil)) {
+					t.Errorf("error: got %v, want a non-terminal error", err)
+				}
+			case errorInvalid:
+				if !errors.Is(err, reconcile.TerminalError(nil)) || !errors.Is(err, tt.err) {
+					t.Errorf("error: got %v, want a terminal error wrapping %v", err, tt.err)
+				}
+			default:
+				if err != nil {
+					t.Errorf("error: got %v, want none", err)
+				}
+			}
+
+			if err := env.client.Get(ctx, client.ObjectKeyFromObject(sd), sd); err != nil {
+				t.Fatal(err)
+			}
+			degraded := meta.FindStatusCondition(sd.Status.Conditions, apiv1.ConditionDegraded)
+			if tt.wantClass != errorInvalid {
+				if degraded != nil {
+					t.Errorf("Degraded condition: got %+v, want none", degraded)
+				}
+				return
+			}
+			if degraded == nil || degraded.Status != metav1.ConditionTrue || degraded.Reason != tt.wantReason {
+				t.Errorf("Degraded condition: got %+v, want True/%s", degraded, tt.wantReason)
+			}
+			select {
+			case ev := <-env.events.Events:
+				if !strings.HasPrefix(ev, "Warning "+tt.wantReason+" ") {
+					t.Errorf("Event: got %q, want a Warning %s", ev, tt.wantReason)
+				}
+			default:
+				t.Error("no Warning Event")
+			}
+		})
+	}
+}
+
+// TestHandleErrorDegradedFailure checks that an invalid error is retried while its Degraded condition can't be recorded.
+func TestHandleErrorDegradedFailure(t *testing.T) {
+	sd := newTestServiceDeployment("team-a", "web")
+	env := newTestEnv(t, interceptor.Funcs{
+		SubResourcePatch: func(context.Context, client.Client, string, client.Object, client.Patch, ...client.SubResourcePatchOption) error {
+			return k8serrors.NewServiceUnavailable("etcd")
+		},
+	}, sd)
+	cause := invalidError("InvalidService", errors.New("bad port"))
+
+	_, err := env.r.handleError(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(sd)}, cause)
+	if err == nil || errors.Is(err, reconcile.TerminalError(nil)) || !errors.Is(err, cause) {
+		t.Errorf("got error %v, want a non-terminal error wrapping %v", err, cause)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// namespaceScope is the set of namespaces the operator is restricted to (`--namespaces`). Empty means cluster-wide.
+//
+// A restricted operator only needs namespaced Roles, so everything cluster-scoped is off:
+// ServiceDeploymentClasses (and with them `spec.className`) and ServiceDeploymentSets, which watch Namespaces.
+type namespaceScope map[string]bool
+
+var (
+	errOutOfScope         = errors.New("outside of the namespaces this operator watches")
+	errClassesUnavailable = errors.New("ServiceDeploymentClasses are not available in namespace-scoped mode")
+)
+
+func newNamespaceScope(namespaces []string) namespaceScope {
+	scope := make(namespaceScope, len(namespaces))
+	for _, ns := range namespaces {
+		scope[ns] = true
+	}
+	return scope
+}
+
+func (s namespaceScope) restricted() bool {
+	return len(s) > 0
+}
+
+func (s namespaceScope) contains(namespace string) bool {
+	return !s.restricted() || s[namespace]
+}
+
+func (s namespaceScope) String() string {
+	if !s.restricted() {
+		return "*"
+	}
+	namespaces := make([]string, 0, len(s))
+	for ns := range s {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	return strings.Join(namespaces, ",")
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	apiv1 "github.com/jayantasamaddar/quick-reference-kubernetes/solutions/hello-crd-scaling/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// serviceGenerator renders the Service in front of the pods, named `<name>-svc`.
+type serviceGenerator struct{}
+
+func (serviceGenerator) kind() string {
+	return "Service"
+}
+
+func (serviceGenerator) object() client.Object {
+	return &corev1.Service{}
+}
+
+func (serviceGenerator) name(sdName string) string {
+	return serviceName(sdName)
+}
+
+func (serviceGenerator) render(obj client.Object, sd, effective *apiv1.ServiceDeployment, class *apiv1.ServiceDeploymentClass) {
+	renderService(obj.(*corev1.Service), sd, effective, class)
+}
+
+func (serviceGenerator) fillStatus(dst *apiv1.ServiceDeploymentStatus, _ *apiv1.ServiceDeployment, obj client.Object) {
+	fillFromServiceStatus(dst, obj.(*corev1.Service))
+}
+
+// Cluster IPs are per cluster; the placement status describes the Service from the spec instead (see syncPlacementStatus)
+func (serviceGenerator) fillClusterStatus(*apiv1.ClusterStatus, client.Object) {}
+
+func (serviceGenerator) delete(ctx context.Context, kube kubernetes.Interface, namespace, name string, opts metav1.DeleteOptions) error {
+	return kube.CoreV1().Services(namespace).Delete(ctx, name, opts)
+}
+
+// Services don't track the generation of their spec. Besides us, only load balancer controllers write them, seldom.
+func (serviceGenerator) revision(obj client.Object) string {
+	return obj.GetResourceVersion()
+}
+
+// validateService checks what the CRD can't: combinations with the type the class may have defaulted, and the CIDRs.
+func validateService(spec *apiv1.ServiceDeploymentSpecService) error {
+	var problems []string
+	external := spec.Type == corev1.ServiceTypeExternalName
+	switch {
+	case external && spec.ExternalName == "":
+		problems = append(problems, "externalName: required with type ExternalName")
+	case !external && spec.ExternalName != "":
+		problems = append(problems, fmt.Sprintf("externalName: only allowed with type ExternalName, not %q", spec.Type))
+	}
+	if spec.Headless && spec.Type != "" && spec.Type != corev1.ServiceTypeClusterIP {
+		problems = append(problems, fmt.Sprintf("headless: only allowed with type ClusterIP, not %q", spec.Type))
+	}
+	if external && (spec.IPFamilyPolicy != "" || spec.InternalTrafficPolicy != "") {
+		problems = append(problems, "ipFamilyPolicy, internalTrafficPolicy: not allowed with type ExternalName")
+	}
+	if spec.ExternalTrafficPolicy != "" && !hasNodePorts(spec.Type) {
+		problems = append(problems, fmt.Sprintf("externalTrafficPolicy: only allowed with type NodePort or LoadBalancer, not %q", spec.Type))
+	}
+	if (spec.LoadBalancerClass != "" || len(spec.LoadBalancerSourceRanges) > 0) && spec.Type != corev1.ServiceTypeLoadBalancer {
+		problems = append(problems, fmt.Sprintf("loadBalancerClass, loadBalancerSourceRanges: only allowed with type LoadBalancer, not %q", spec.Type))
+	}
+	for i, cidr := range spec.LoadBalancerSourceRanges {
+		if _, _, err := net.ParseCIDR(strings.TrimSpace(cidr)); err != nil {
+			problems = append(problems, fmt.Sprintf("loadBalancerSourceRanges[%d]: %q is not a CIDR", i, cidr))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// checkHeadless compares `headless` with the Service `key` as it exists. Its cluster IP is immutable, so a Service can't
+// become headless or stop being headless: the API server would reject the update, or the change would silently not apply.
+func checkHeadless(ctx context.Context, reader client.Reader, key client.ObjectKey, spec *apiv1.ServiceDeploymentSpecService) error {
+	var svc corev1.Service
+	if err := reader.Get(ctx, key, &svc); err != nil {
+		if k8serrors.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("get service: %w", err)
+	}
+	if spec.Type == corev1.ServiceTypeExternalName || svc.Spec.Type == corev1.ServiceTypeExternalName {
+		return nil // without a cluster IP on one side
+	}
+	if headless := svc.Spec.ClusterIP == corev1.ClusterIPNone; headless != spec.Headless {
+		return invalidError("InvalidService", fmt.Errorf("spec.service.headless: the existing Service %q has clusterIP %q, which can't be changed; delete the Service to recreate it with headless: %t",
+			key.Name, svc.Spec.ClusterIP, spec.Headless))
+	}
+	return nil
+}
+
+func fillFromServiceStatus(dst *apiv1.ServiceDeploymentStatus, svc *corev1.Service) {
+	dst.ServiceType = string(svc.Spec.Type)
+	dst.ClusterIP = svc.Spec.ClusterIP
+	dst.ExternalIPs = strings.Join(svc.Spec.ExternalIPs, ",")
+	var parts []string
+	for _, p := range svc.Spec.Ports {
+		proto := p.Protocol
+		if proto == "" {
+			proto = corev1.ProtocolTCP
+		}
+		parts = append(parts, fmt.Sprintf("%d/%s", p.Port, proto))
+	}
+	dst.Ports = strings.Join(parts, ",")
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	apiv1 "github.com/jayantasamaddar/quick-reference-kubernetes/solutions/hello-crd-scaling/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+func TestHeadlessChange(t *testing.T) {
+	tests := []struct {
+		name      string
+		clusterIP string // of the existing Service, none if empty
+		headless  bool
+		wantErr   bool
+	}{
+		{name: "new headless Service", headless: true},
+		{name: "still headless", clusterIP: corev1.ClusterIPNone, headless: true},
+		{name: "still with a cluster IP", clusterIP: "10.96.0.10"},
+		{name: "to headless", clusterIP: "10.96.0.10", headless: true, wantErr: true},
+		{name: "from headless", clusterIP: corev1.ClusterIPNone, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sd := newTestServiceDeployment("headless", "web")
+			sd.Spec.Service.Headless = tt.headless
+			objs := []client.Object{sd}
+			if tt.clusterIP != "" {
+				objs = append(objs, &corev1.Service{
+					ObjectMeta: metav1.ObjectMeta{Namespace: sd.Namespace, Name: serviceName(sd.Name)},
+					Spec: corev1.ServiceSpec{
+						Type:      corev1.ServiceTypeClusterIP,
+						ClusterIP: tt.clusterIP, ClusterIPs: []string{tt.clusterIP},
+						Ports: []corev1.ServicePort{{Name: "http", Port: 80}},
+					},
+				})
+			}
+			env := newTestEnv(t, interceptor.Funcs{}, objs...)
+			env.events.Events = nil
+
+			_, err := env.reconcile(t, sd)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("reconcile: got error %v, want error %t", err, tt.wantErr)
+			}
+			if err := env.client.Get(context.Background(), client.ObjectKeyFromObject(sd), sd); err != nil {
+				t.Fatal(err)
+			}
+			degraded := meta.FindStatusCondition(sd.Status.Conditions, apiv1.ConditionDegraded)
+			if got := degraded != nil && degraded.Status == metav1.ConditionTrue && degraded.Reason == "InvalidService"; got != tt.wantErr {
+				t.Errorf("Degraded with reason InvalidService: got %t, want %t (%+v)", got, tt.wantErr, degraded)
+			}
+		})
+	}
+}
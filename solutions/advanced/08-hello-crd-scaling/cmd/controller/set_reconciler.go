@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	apiv1 "github.com/jayantasamaddar/quick-reference-kubernetes/solutions/hello-crd-scaling/api/v1"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// errNotControlledBySet is returned for a ServiceDeployment of the set's name that the set doesn't control,
+// e.g. one created by hand before the namespace matched: it is reported, not taken over.
+var errNotControlledBySet = errors.New("servicedeployment exists and is not controlled by the set")
+
+// A second reconciler, for ServiceDeploymentSets.
+// Its children are ServiceDeployments (one per matching namespace), which are in turn reconciled by `reconciler`.
+type setReconciler struct {
+	client.Client
+	scheme   *runtime.Scheme
+	recorder *eventRecorder
+	shards   *shardManager // with sharding, the sets are only reconciled by the owner of `setShard`
+	live     *liveConfig
+}
+
+func (r *setReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx).WithValues("servicedeploymentset", req.Name)
+	log.Info("Reconciling servicedeploymentset...")
+
+	// Like ServiceDeployments, sets wait for the OperatorConfig and are left alone while the operator is paused
+	if err := r.live.wait(ctx); err != nil {
+		return ctrl.Result{}, err
+	}
+	if live := r.live.load(); live.Paused {
+		log.V(1).Info("operator paused, skipping servicedeploymentset", "operatorconfig", live.Source)
+		return ctrl.Result{}, nil
+	}
+
+	if r.shards != nil {
+		if !r.shards.begin(setShard) {
+			log.V(1).Info("skipping servicedeploymentset, its shard is owned by another replica", "shard", setShard)
+			return ctrl.Result{}, nil
+		}
+		defer r.shards.done(setShard)
+	}
+
+	// 1) Load the primary CR.
+	// The ServiceDeployments it created carry an ownerReference to it, so on deletion the Garbage Collector removes them.
+	var set apiv1.ServiceDeploymentSet
+	if err := r.Get(ctx, req.NamespacedName, &set); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	ctx = withAuditOwner(ctx, auditOwner{Kind: "ServiceDeploymentSet", Name: set.Name, Generation: set.Generation})
+
+	// 2) Find the namespaces the set targets
+	selector, err := metav1.LabelSelectorAsSelector(&set.Spec.NamespaceSelector)
+	if err != nil {
+		r.recorder.eventf(ctx, &set, nil, corev1.EventTypeWarning, "InvalidSelector", "SelectNamespaces", "Invalid namespaceSelector: %v", err)
+		return ctrl.Result{}, nil
+	}
+	var namespaces corev1.NamespaceList
+	if err := r.List(ctx, &namespaces, client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return ctrl.Result{}, fmt.Errorf("list namespaces: %w", err)
+	}
+
+	// 3) Ensure a ServiceDeployment in each of them
+	wanted := make(map[string]bool, len(namespaces.Items))
+	var children []*apiv1.ServiceDeployment
+	var conflicts []string
+	for _, ns := range namespaces.Items {
+		// Creating objects in a terminating namespace is rejected by the API server
+		if ns.Status.Phase == corev1.NamespaceTerminating {
+			continue
+		}
+		wanted[ns.Name] = true
+
+		spec, err := renderSetSpec(&set, ns.Name)
+		if err != nil {
+			r.recorder.eventf(ctx, &set, nil, corev1.EventTypeWarning, "InvalidOverride", "Render", "Invalid override for namespace %q: %v", ns.Name, err)
+			continue
+		}
+
+		sd := &apiv1.ServiceDeployment{ObjectMeta: metav1.ObjectMeta{
+			Name:      set.Name,
+			Namespace: ns.Name,
+		}}
+		result, err := controllerutil.CreateOrUpdate(ctx, r.Client, sd, func() error {
+			if sd.ResourceVersion != "" && !metav1.IsControlledBy(sd, &set) {
+				return errNotControlledBySet
+			}
+			// The template's labels and annotations next to those of others, which stay (see managedKeys)
+			previous := readManagedKeys(sd)
+			var managed managedKeys
+			templateLabels := make(map[string]string, len(set.Spec.Template.Labels)+1)
+			for k, v := range set.Spec.Template.Labels {
+				templateLabels[k] = v
+			}
+			templateLabels[apiv1.SetNameLabel] = set.Name
+			sd.Labels, managed.Labels = syncManaged(sd.Labels, previous.Labels, templateLabels)
+			sd.Annotations, managed.Annotations = syncManaged(sd.Annotations, previous.Annotations, set.Spec.Template.Annotations)
+			managed.write(sd)
+			sd.Spec = *spec
+
+			// A cluster-scoped owner is allowed for namespaced children
+			return controllerutil.SetControllerReference(&set, sd, r.scheme)
+		})
+		if errors.Is(err, errNotControlledBySet) {
+			r.recorder.eventf(ctx, &set, sd, corev1.EventTypeWarning, "ServiceDeploymentConflict", "Apply", "ServiceDeployment %s/%s exists and is not controlled by the set; leaving it alone", ns.Name, sd.Name)
+			conflicts = append(conflicts, ns.Name)
+			continue
+		}
+		if err != nil {
+			if k8serrors.IsConflict(err) {
+				log.Info("servicedeployment update conflicted, will retry", "namespace", ns.Name)
+				return ctrl.Result{Requeue: true}, nil
+			}
+			r.recorder.eventf(ctx, &set, sd, corev1.EventTypeWarning, "ApplyServiceDeploymentFailed", "Apply", "Failed to apply ServiceDeployment %s/%s: %v", ns.Name, sd.Name, err)
+			return ctrl.Result{}, fmt.Errorf("apply servicedeployment in %q: %w", ns.Name, err)
+		}
+		switch result {
+		case controllerutil.OperationResultCreated:
+			r.recorder.eventf(ctx, &set, sd, corev1.EventTypeNormal, "ServiceDeploymentCreated", "Create", "Created ServiceDeployment %s/%s", ns.Name, sd.Name)
+		case controllerutil.OperationResultUpdated:
+			r.recorder.eventf(ctx, &set, sd, corev1.EventTypeNormal, "ServiceDeploymentUpdated", "Update", "Updated ServiceDeployment %s/%s", ns.Name, sd.Name)
+		}
+		children = append(children, sd)
+	}
+
+	// 4) Delete ServiceDeployments in namespaces that no longer match
+	var existing apiv1.ServiceDeploymentList
+	if err := r.List(ctx, &existing, client.MatchingLabels{apiv1.SetNameLabel: set.Name}); err != nil {
+		return ctrl.Result{}, fmt.Errorf("list servicedeployments: %w", err)
+	}
+	for i := range existing.Items {
+		sd := &existing.Items[i]
+		if wanted[sd.Namespace] || !metav1.IsControlledBy(sd, &set) {
+			continue
+		}
+		if err := r.Delete(ctx, sd); client.IgnoreNotFound(err) != nil {
+			r.recorder.eventf(ctx, &set, sd, corev1.EventTypeWarning, "DeleteServiceDeploymentFailed", "Delete", "Failed to delete ServiceDeployment %s/%s: %v", sd.Namespace, sd.Name, err)
+			return ctrl.Result{}, fmt.Errorf("delete servicedeployment in %q: %w", sd.Namespace, err)
+		}
+		r.recorder.eventf(ctx, &set, sd, corev1.EventTypeNormal, "ServiceDeploymentDeleted", "Delete", "Deleted ServiceDeployment %s/%s", sd.Namespace, sd.Name)
+	}
+
+	// 5) Sync Status
+	if err := r.SyncStatus(ctx, &set, children, conflicts); err != nil {
+		log.Error(err, "failed to sync status with servicedeployments")
+	}
+
+	log.Info("reconciled", "namespaces", len(children))
+	return ctrl.Result{}, nil
+}
+
+// renderSetSpec returns the template spec with the override for `namespace` (if any) merged in.
+func renderSetSpec(set *apiv1.ServiceDeploymentSet, namespace string) (*apiv1.ServiceDeploymentSpec, error) {
+	spec := &apiv1.ServiceDeploymentSpec{}
+	set.Spec.Template.Spec.DeepCopyInto(spec)
+
+	for _, o := range set.Spec.Overrides {
+		if o.Namespace != namespace || len(o.Patch.Raw) == 0 {
+			continue
+		}
+		original, err := json.Marshal(spec)
+		if err != nil {
+			return nil, err
+		}
+		patched, err := jsonpatch.MergePatch(original, o.Patch.Raw)
+		if err != nil {
+			return nil, err
+		}
+		spec = &apiv1.ServiceDeploymentSpec{}
+		if err := json.Unmarshal(patched, spec); err != nil {
+			return nil, err
+		}
+	}
+	return spec, nil
+}
+
+// A ServiceDeployment counts as ready once all of its desired replicas are ready.
+// With `spec.placement` the desired replicas are summed over all target clusters, hence `>=`.
+func serviceDeploymentReady(sd *apiv1.ServiceDeployment) bool {
+	return sd.Status.DesiredReplicas >= sd.Spec.Replicas && sd.Status.ReadyReplicas >= sd.Status.DesiredReplicas
+}
+
+// SyncStatus counts the ready `children` and reports the namespaces with `conflicts` in the Conflict condition.
+func (r *setReconciler) SyncStatus(ctx context.Context, set *apiv1.ServiceDeploymentSet, children []*apiv1.ServiceDeployment, conflicts []string) error {
+	desired := apiv1.ServiceDeploymentSetStatus{Namespaces: int32(len(children))}
+	for _, sd := range children {
+		if serviceDeploymentReady(sd) {
+			desired.ReadyNamespaces++
+		} else {
+			desired.NotReady = append(desired.NotReady, sd.Namespace)
+		}
+	}
+	sort.Strings(desired.NotReady)
+	desired.Ready = fmt.Sprintf("%d/%d", desired.ReadyNamespaces, desired.Namespaces)
+
+	desired.Conditions = append([]metav1.Condition(nil), set.Status.Conditions...)
+	conflict := metav1.Condition{
+		Type:               apiv1.ConditionConflict,
+		Status:             metav1.ConditionFalse,
+		Reason:             "NoConflicts",
+		Message:            "Every matching namespace has a ServiceDeployment of the set",
+		ObservedGeneration: set.Generation,
+	}
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		conflict.Status, conflict.Reason = metav1.ConditionTrue, "NotControlledBySet"
+		conflict.Message = fmt.Sprintf("ServiceDeployments named %q exist but are not controlled by the set in: %s", set.Name, strings.Join(conflicts, ", "))
+	}
+	meta.SetStatusCondition(&desired.Conditions, conflict)
+
+	// If there are no changes, do nothing
+	if equality.Semantic.DeepEqual(set.Status, desired) {
+		return nil
+	}
+	orig := set.DeepCopy()
+	set.Status = desired
+	return r.Status().Patch(ctx, set, client.MergeFrom(orig))
+}
+
+// mapNamespaceToSets enqueues every ServiceDeploymentSet whose selector matches the namespace.
+// On updates controller-runtime calls this for both the old and the new object, so a namespace that
+// stops matching (label removed) still triggers the cleanup.
+func (r *setReconciler) mapNamespaceToSets(ctx context.Context, obj client.Object) []reconcile.Request {
+	var sets apiv1.ServiceDeploymentSetList
+	if err := r.List(ctx, &sets); err != nil {
+		log.FromContext(ctx).Error(err, "failed to list servicedeploymentsets for namespace", "namespace", obj.GetName())
+		return nil
+	}
+
+	var requests []reconcile.Request
+	for _, set := range sets.Items {
+		selector, err := metav1.LabelSelectorAsSelector(&set.Spec.NamespaceSelector)
+		if err != nil || !selector.Matches(labels.Set(obj.GetLabels())) {
+			continue
+		}
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: set.Name}})
+	}
+	return requests
+}
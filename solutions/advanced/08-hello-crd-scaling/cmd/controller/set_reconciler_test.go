@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	apiv1 "github.com/jayantasamaddar/quick-reference-kubernetes/solutions/hello-crd-scaling/api/v1"
+
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/events"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// newTestSetReconciler returns a setReconciler on a fake client holding `objs`.
+func newTestSetReconciler(objs ...client.Object) (*setReconciler, client.Client) {
+	c := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(objs...).
+		WithStatusSubresource(&apiv1.ServiceDeploymentSet{}, &apiv1.ServiceDeployment{}).
+		Build()
+	live := newLiveConfig(1, nil)
+	live.store(live.defaults())
+	return &setReconciler{
+		Client:   c,
+		scheme:   scheme,
+		recorder: newEventRecorder(eventsConfig{}, &events.FakeRecorder{}, scheme, nil, live),
+		live:     live,
+	}, c
+}
+
+func newTestSet(name string) *apiv1.ServiceDeploymentSet {
+	return &apiv1.ServiceDeploymentSet{
+		ObjectMeta: metav1.ObjectMeta{Name: name, UID: types.UID("uid-set-" + name), Generation: 1},
+		Spec: apiv1.ServiceDeploymentSetSpec{
+			NamespaceSelector: metav1.LabelSelector{MatchLabels: map[string]string{"tenant": "true"}},
+			Template:          apiv1.ServiceDeploymentTemplate{Spec: newTestServiceDeployment("", name).Spec},
+		},
+	}
+}
+
+func tenantNamespace(name string) *corev1.Namespace {
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"tenant": "true"}}}
+}
+
+func TestSetLeavesServiceDeploymentsOfOthersAlone(t *testing.T) {
+	ctx := context.Background()
+	set := newTestSet("web")
+	handMade := newTestServiceDeployment("tenant-b", "web")
+	handMade.Spec.Replicas = 7
+	r, c := newTestSetReconciler(set, tenantNamespace("tenant-a"), tenantNamespace("tenant-b"), handMade)
+
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(set)}); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+
+	var sd apiv1.ServiceDeployment
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "tenant-b", Name: "web"}, &sd); err != nil {
+		t.Fatal(err)
+	}
+	if sd.Spec.Replicas != 7 || metav1.GetControllerOf(&sd) != nil || sd.Labels[apiv1.SetNameLabel] != "" {
+		t.Errorf("hand-made ServiceDeployment was taken over: replicas %d, controller %v, labels %v", sd.Spec.Replicas, metav1.GetControllerOf(&sd), sd.Labels)
+	}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "tenant-a", Name: "web"}, &sd); err != nil {
+		t.Fatalf("ServiceDeployment of the set in tenant-a: %v", err)
+	}
+
+	if err := c.Get(ctx, client.ObjectKeyFromObject(set), set); err != nil {
+		t.Fatal(err)
+	}
+	conflict := meta.FindStatusCondition(set.Status.Conditions, apiv1.ConditionConflict)
+	if conflict == nil || conflict.Status != metav1.ConditionTrue || !strings.Contains(conflict.Message, "tenant-b") {
+		t.Errorf("Conflict condition: got %+v, want True listing tenant-b", conflict)
+	}
+	if set.Status.Namespaces != 1 {
+		t.Errorf("status.namespaces: got %d, want 1", set.Status.Namespaces)
+	}
+
+	// Once the hand-made one is gone, the set creates its own
+	handMade.ResourceVersion = ""
+	if err := c.Delete(ctx, handMade); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(set)}); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(set), set); err != nil {
+		t.Fatal(err)
+	}
+	if !meta.IsStatusConditionFalse(set.Status.Conditions, apiv1.ConditionConflict) {
+		t.Errorf("Conflict condition after deleting the hand-made one: got %+v, want False", meta.FindStatusCondition(set.Status.Conditions, apiv1.ConditionConflict))
+	}
+}
+
+func TestSetPrunesTemplateMetadata(t *testing.T) {
+	ctx := context.Background()
+	set := newTestSet("web")
+	set.Spec.Template.Labels = map[string]string{"team": "a", "tier": "web"}
+	set.Spec.Template.Annotations = map[string]string{"owner": "team-a", "docs": "https://docs"}
+	r, c := newTestSetReconciler(set, tenantNamespace("tenant-a"))
+	key := client.ObjectKey{Namespace: "tenant-a", Name: "web"}
+
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(set)}); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	// Set by others meanwhile
+	var sd apiv1.ServiceDeployment
+	if err := c.Get(ctx, key, &sd); err != nil {
+		t.Fatal(err)
+	}
+	sd.Labels[apiv1.ShardLabel] = "2"
+	sd.Annotations["note"] = "by hand"
+	if err := c.Update(ctx, &sd); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Get(ctx, client.ObjectKeyFromObject(set), set); err != nil {
+		t.Fatal(err)
+	}
+	set.Spec.Template.Labels = map[string]string{"team": "b"}
+	set.Spec.Template.Annotations = map[string]string{"owner": "team-b"}
+	if err := c.Update(ctx, set); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(set)}); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+
+	if err := c.Get(ctx, key, &sd); err != nil {
+		t.Fatal(err)
+	}
+	wantLabels := map[string]string{apiv1.SetNameLabel: "web", "team": "b", apiv1.ShardLabel: "2"}
+	if diff := cmp.Diff(wantLabels, sd.Labels); diff != "" {
+		t.Errorf("labels (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(map[string]string{"owner": "team-b", "note": "by hand"}, withoutManaged(sd.Annotations)); diff != "" {
+		t.Errorf("annotations (-want +got):\n%s", diff)
+	}
+}
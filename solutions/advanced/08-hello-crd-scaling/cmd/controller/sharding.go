@@ -0,0 +1,511 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	apiv1 "github.com/jayantasamaddar/quick-reference-kubernetes/solutions/hello-crd-scaling/api/v1"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Sharding splits the ServiceDeployments between the operator replicas, which then all reconcile at the same time
+// instead of one leader doing all the work.
+//   - Every ServiceDeployment belongs to one of `shards` shards: the one in its `servicedeployment.k8s.example.com/shard`
+//     label, else a hash of its namespace. ServiceDeploymentSets belong to shard 0.
+//   - Every replica renews a member Lease. All replicas see the same live members, so they compute the same assignment:
+//     shard i goes to the (i mod members)th member by identity.
+//   - A replica only reconciles a shard while it holds the shard's Lease. It releases the Lease once the shard is assigned
+//     to another member and its reconciles in flight are done; the new owner waits for that, or for the Lease to expire
+//     when the replica died. A ServiceDeployment whose shard label changes mid-reconcile is only written to after
+//     checking again (see stillOwns). So no object is ever reconciled by two replicas at once.
+type shardingConfig struct {
+	Enabled bool  `json:"enabled,omitempty"`
+	Shards  int32 `json:"shards,omitempty"`
+	// Namespace of the Leases. Defaults to the operator's namespace when running in a cluster.
+	Namespace string `json:"namespace,omitempty"`
+	// How long a replica keeps its shards without renewing their Leases, i.e. how long shards of a dead replica stay idle
+	LeaseDuration metav1.Duration `json:"leaseDuration,omitzero"`
+	// How often the Leases are renewed and the assignment is recomputed
+	RenewPeriod metav1.Duration `json:"renewPeriod,omitzero"`
+}
+
+const (
+	shardLeasePrefix  = "servicedeployments-operator-shard-"
+	memberLeasePrefix = "servicedeployments-operator-member-"
+	shardMemberLabel  = "servicedeployment.k8s.example.com/shard-member"
+
+	// Member Leases of replicas that are gone for this many lease durations are deleted
+	staleMemberLeases = 10
+)
+
+func (o *shardingConfig) bindFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&o.Enabled, "sharding", o.Enabled, "Split the ServiceDeployments between all replicas. Requires leader election to be disabled.")
+	fs.Var(int32Value{&o.Shards}, "shards", "Number of shards the ServiceDeployments are split into. More shards than replicas balance better.")
+	fs.StringVar(&o.Namespace, "shard-lease-namespace", o.Namespace, "Namespace of the shard Leases. Defaults to the operator's namespace when running in a cluster.")
+	fs.DurationVar(&o.LeaseDuration.Duration, "shard-lease-duration", o.LeaseDuration.Duration, "How long the shards of a replica that stopped renewing their Leases stay idle before another replica takes over.")
+	fs.DurationVar(&o.RenewPeriod.Duration, "shard-renew-period", o.RenewPeriod.Duration, "How often the shard Leases are renewed and the shards rebalanced.")
+}
+
+func (o *shardingConfig) validate() error {
+	if !o.Enabled {
+		return nil
+	}
+	var errs []error
+	if o.Shards < 1 {
+		errs = append(errs, fmt.Errorf("  sharding.shards: must be at least 1, got %d", o.Shards))
+	}
+	// Leave a replica at least two attempts to renew before it has to give its shards up
+	if o.RenewPeriod.Duration <= 0 || 3*o.RenewPeriod.Duration > o.LeaseDuration.Duration {
+		errs = append(errs, fmt.Errorf("  sharding.renewPeriod: must be positive and at most a third of leaseDuration (%s), got %s", o.LeaseDuration.Duration, o.RenewPeriod.Duration))
+	}
+	return errors.Join(errs...)
+}
+
+// shardOf returns the shard of an object: the one in its shard label if valid, else a hash of its namespace.
+func shardOf(namespace string, labels map[string]string, shards int32) int32 {
+	if v, ok := labels[apiv1.ShardLabel]; ok {
+		if n, err := strconv.ParseInt(v, 10, 32); err == nil && n >= 0 && int32(n) < shards {
+			return int32(n)
+		}
+	}
+	h := fnv.New32a()
+	h.Write([]byte(namespace))
+	return int32(h.Sum32() % uint32(shards))
+}
+
+// shardManager keeps this replica's member Lease alive and acquires, renews and releases shard Leases.
+// It runs on every replica (not only on a leader) as a manager Runnable.
+type shardManager struct {
+	cfg       shardingConfig
+	namespace string
+	identity  string
+	leases    kubernetes.Interface
+	reader    client.Reader
+
+	// ServiceDeployments (and ServiceDeploymentSets for shard 0) of newly acquired shards are requeued through these
+	events    chan event.GenericEvent
+	setEvents chan event.GenericEvent
+
+	mu sync.Mutex
+	// Shards whose Lease we hold, by the time it was last renewed
+	held map[int32]time.Time
+	// Reconciles in flight, by shard
+	inFlight map[int32]int
+	// Set on shutdown: no new reconciles are started
+	stopping bool
+}
+
+func newShardManager(cfg shardingConfig, leases kubernetes.Interface, reader client.Reader) (*shardManager, error) {
+	namespace, err := operatorNamespace(cfg.Namespace, "sharding.namespace")
+	if err != nil {
+		return nil, err
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("shard identity: %w", err)
+	}
+	return &shardManager{
+		cfg:       cfg,
+		namespace: namespace,
+		identity:  hostname + "_" + string(uuid.NewUUID()),
+		leases:    leases,
+		reader:    reader,
+		events:    make(chan event.GenericEvent),
+		setEvents: make(chan event.GenericEvent),
+		held:      map[int32]time.Time{},
+		inFlight:  map[int32]int{},
+	}, nil
+}
+
+// NeedLeaderElection is false: shards are the way replicas share the work, every replica takes part.
+func (m *shardManager) NeedLeaderElection() bool { return false }
+
+func (m *shardManager) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("sharding").WithValues("identity", m.identity)
+	logger.Info("starting", "shards", m.cfg.Shards, "namespace", m.namespace)
+	wait.UntilWithContext(log.IntoContext(ctx, logger), func(ctx context.Context) {
+		if err := m.sync(ctx); err != nil {
+			logger.Error(err, "failed to sync shards")
+		}
+	}, m.cfg.RenewPeriod.Duration)
+
+	// Hand the shards over right away instead of letting the other replicas wait for the Leases to expire.
+	// The manager stops us before its controllers, so refuse new reconciles and wait for those in flight.
+	// Shards still busy when the Leases are about to expire are left to expire.
+	m.mu.Lock()
+	m.stopping = true
+	m.mu.Unlock()
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), m.cfg.LeaseDuration.Duration*2/3)
+	defer cancelDrain()
+	_ = wait.PollUntilContextCancel(drainCtx, 100*time.Millisecond, true, func(context.Context) (bool, error) { return m.idle(), nil })
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.cfg.RenewPeriod.Duration)
+	defer cancel()
+	var errs []error
+	for shard := range m.snapshot() {
+		if m.drop(shard) {
+			errs = append(errs, m.release(ctx, shard))
+		}
+	}
+	errs = append(errs, client.IgnoreNotFound(m.leases.CoordinationV1().Leases(m.namespace).Delete(ctx, m.memberLeaseName(), metav1.DeleteOptions{})))
+	if err := errors.Join(errs...); err != nil {
+		logger.Error(err, "failed to release shards")
+	}
+	logger.Info("stopped")
+	return nil
+}
+
+// sync renews the member Lease, computes the assignment and acquires or releases shards accordingly.
+func (m *shardManager) sync(ctx context.Context) error {
+	log := log.FromContext(ctx)
+	// Also when the API server can't be reached: the other replicas take over our shards once their Leases expire
+	defer m.expire()
+	if err := m.renewMember(ctx); err != nil {
+		return fmt.Errorf("renew member lease: %w", err)
+	}
+	members, err := m.members(ctx)
+	if err != nil {
+		return fmt.Errorf("list member leases: %w", err)
+	}
+
+	var errs []error
+	for shard := int32(0); shard < m.cfg.Shards; shard++ {
+		assigned := len(members) > 0 && members[int(shard)%len(members)] == m.identity
+		switch {
+		case assigned:
+			acquired, err := m.acquire(ctx, shard)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("shard %d: %w", shard, err))
+				continue
+			}
+			if acquired {
+				log.Info("acquired shard", "shard", shard)
+				go m.requeue(ctx, shard)
+			}
+		case m.holds(shard):
+			// Finish what is in flight first, or the new owner could overlap with it
+			if !m.drop(shard) {
+				log.V(1).Info("waiting for reconciles in flight before releasing shard", "shard", shard)
+				continue
+			}
+			if err := m.release(ctx, shard); err != nil {
+				errs = append(errs, fmt.Errorf("shard %d: %w", shard, err))
+				continue
+			}
+			log.Info("released shard", "shard", shard)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m *shardManager) memberLeaseName() string {
+	h := fnv.New32a()
+	h.Write([]byte(m.identity))
+	return fmt.Sprintf("%s%08x", memberLeasePrefix, h.Sum32())
+}
+
+func (m *shardManager) renewMember(ctx context.Context) error {
+	leases := m.leases.CoordinationV1().Leases(m.namespace)
+	now := metav1.NewMicroTime(time.Now())
+	lease, err := leases.Get(ctx, m.memberLeaseName(), metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      m.memberLeaseName(),
+				Namespace: m.namespace,
+				Labels:    map[string]string{shardMemberLabel: "true"},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       ptr.To(m.identity),
+				LeaseDurationSeconds: ptr.To(int32(m.cfg.LeaseDuration.Seconds())),
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		_, err = leases.Create(ctx, lease, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	lease.Spec.RenewTime = &now
+	_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	return err
+}
+
+// members returns the identities of the live replicas, sorted. Member Leases gone stale long ago are cleaned up on the way.
+func (m *shardManager) members(ctx context.Context) ([]string, error) {
+	leases := m.leases.CoordinationV1().Leases(m.namespace)
+	list, err := leases.List(ctx, metav1.ListOptions{LabelSelector: shardMemberLabel + "=true"})
+	if err != nil {
+		return nil, err
+	}
+	var members []string
+	for i := range list.Items {
+		lease := &list.Items[i]
+		if !expired(lease, 1) {
+			members = append(members, ptr.Deref(lease.Spec.HolderIdentity, ""))
+			continue
+		}
+		if expired(lease, staleMemberLeases) {
+			if err := leases.Delete(ctx, lease.Name, metav1.DeleteOptions{Preconditions: &metav1.Preconditions{ResourceVersion: &lease.ResourceVersion}}); client.IgnoreNotFound(err) != nil && !k8serrors.IsConflict(err) {
+				log.FromContext(ctx).Error(err, "failed to delete stale member lease", "lease", lease.Name)
+			}
+		}
+	}
+	sort.Strings(members)
+	return members, nil
+}
+
+// expired reports whether `lease` was last renewed more than `factor` lease durations ago.
+func expired(lease *coordinationv1.Lease, factor int) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	d := time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second * time.Duration(factor)
+	return lease.Spec.RenewTime.Add(d).Before(time.Now())
+}
+
+// acquire takes or renews the Lease of `shard`. It reports true if the shard was newly acquired.
+// Updates carry the resourceVersion read, so two replicas racing for a free Lease can't both win.
+func (m *shardManager) acquire(ctx context.Context, shard int32) (bool, error) {
+	leases := m.leases.CoordinationV1().Leases(m.namespace)
+	name := fmt.Sprintf("%s%d", shardLeasePrefix, shard)
+	now := metav1.NewMicroTime(time.Now())
+	lease, err := leases.Get(ctx, name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: m.namespace},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       ptr.To(m.identity),
+				LeaseDurationSeconds: ptr.To(int32(m.cfg.LeaseDuration.Seconds())),
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		if _, err := leases.Create(ctx, lease, metav1.CreateOptions{}); err != nil {
+			return false, client.IgnoreAlreadyExists(err)
+		}
+		return m.hold(shard, now.Time), nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	holder := ptr.Deref(lease.Spec.HolderIdentity, "")
+	if holder != m.identity {
+		if holder != "" && !expired(lease, 1) {
+			// Still held by the previous owner, which releases it once it is done
+			return false, nil
+		}
+		lease.Spec.HolderIdentity = ptr.To(m.identity)
+		lease.Spec.AcquireTime = &now
+		lease.Spec.LeaseTransitions = ptr.To(ptr.Deref(lease.Spec.LeaseTransitions, 0) + 1)
+	}
+	lease.Spec.LeaseDurationSeconds = ptr.To(int32(m.cfg.LeaseDuration.Seconds()))
+	lease.Spec.RenewTime = &now
+	if _, err := leases.Update(ctx, lease, metav1.UpdateOptions{}); err != nil {
+		if k8serrors.IsConflict(err) {
+			// Somebody else was first; find out who on the next sync
+			return false, nil
+		}
+		return false, err
+	}
+	return m.hold(shard, now.Time), nil
+}
+
+// release clears the holder of the Lease of `shard`, if it is still ours.
+func (m *shardManager) release(ctx context.Context, shard int32) error {
+	leases := m.leases.CoordinationV1().Leases(m.namespace)
+	lease, err := leases.Get(ctx, fmt.Sprintf("%s%d", shardLeasePrefix, shard), metav1.GetOptions{})
+	if err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if ptr.Deref(lease.Spec.HolderIdentity, "") != m.identity {
+		return nil
+	}
+	lease.Spec.HolderIdentity = nil
+	lease.Spec.AcquireTime = nil
+	_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	return err
+}
+
+// requeue enqueues everything in `shard`, which may have changed while nobody owned it.
+func (m *shardManager) requeue(ctx context.Context, shard int32) {
+	var sds apiv1.ServiceDeploymentList
+	if err := m.reader.List(ctx, &sds); err != nil {
+		log.FromContext(ctx).Error(err, "failed to list servicedeployments of acquired shard", "shard", shard)
+		return
+	}
+	for i := range sds.Items {
+		if shardOf(sds.Items[i].Namespace, sds.Items[i].Labels, m.cfg.Shards) != shard {
+			continue
+		}
+		select {
+		case m.events <- event.GenericEvent{Object: &sds.Items[i]}:
+		case <-ctx.Done():
+			return
+		}
+	}
+	if shard != setShard {
+		return
+	}
+	var sets apiv1.ServiceDeploymentSetList
+	if err := m.reader.List(ctx, &sets); err != nil {
+		log.FromContext(ctx).Error(err, "failed to list servicedeploymentsets of acquired shard", "shard", shard)
+		return
+	}
+	for i := range sets.Items {
+		select {
+		case m.setEvents <- event.GenericEvent{Object: &sets.Items[i]}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ServiceDeploymentSets are cluster-scoped and comparatively few; one shard reconciles all of them
+const setShard int32 = 0
+
+func (m *shardManager) hold(shard int32, renewed time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, held := m.held[shard]
+	m.held[shard] = renewed
+	return !held
+}
+
+func (m *shardManager) holds(shard int32) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, held := m.held[shard]
+	return held
+}
+
+// drop stops reconciling `shard`, unless reconciles of it are still in flight.
+func (m *shardManager) drop(shard int32) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.inFlight[shard] > 0 {
+		return false
+	}
+	delete(m.held, shard)
+	return true
+}
+
+// expire stops reconciling shards whose Lease could not be renewed for two thirds of the lease duration.
+// Other replicas take them over once the full duration is up, so there is a margin for clock skew.
+func (m *shardManager) expire() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	deadline := time.Now().Add(-m.cfg.LeaseDuration.Duration * 2 / 3)
+	for shard, renewed := range m.held {
+		if renewed.Before(deadline) {
+			delete(m.held, shard)
+		}
+	}
+}
+
+func (m *shardManager) snapshot() map[int32]time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	held := make(map[int32]time.Time, len(m.held))
+	for shard, renewed := range m.held {
+		held[shard] = renewed
+	}
+	return held
+}
+
+// begin reports whether this replica owns `shard`, and if so counts a reconcile in flight until `done` is called.
+func (m *shardManager) begin(shard int32) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, held := m.held[shard]; !held || m.stopping {
+		return false
+	}
+	m.inFlight[shard]++
+	return true
+}
+
+func (m *shardManager) idle() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, n := range m.inFlight {
+		if n > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *shardManager) done(shard int32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight[shard]--
+}
+
+// fillStatus reports the shard of `sd` and its owner in `dst`; both stay empty without sharding.
+func (m *shardManager) fillStatus(dst *apiv1.ServiceDeploymentStatus, sd *apiv1.ServiceDeployment) {
+	if m == nil {
+		dst.Shard, dst.ShardOwner = "", ""
+		return
+	}
+	dst.Shard = fmt.Sprintf("%d/%d", shardOf(sd.Namespace, sd.Labels, m.cfg.Shards), m.cfg.Shards)
+	dst.ShardOwner = m.identity
+}
+
+// owns reports whether this replica currently owns the shard of `sd`.
+func (m *shardManager) owns(sd *apiv1.ServiceDeployment) bool {
+	return m.holds(shardOf(sd.Namespace, sd.Labels, m.cfg.Shards))
+}
+
+// stillOwns reads `sd` from the API server and reports whether it is still in `shard`, and this replica still holds it.
+// It is always true without sharding.
+func (m *shardManager) stillOwns(ctx context.Context, reader client.Reader, sd *apiv1.ServiceDeployment, shard int32) (bool, error) {
+	if m == nil {
+		return true, nil
+	}
+	var current apiv1.ServiceDeployment
+	if err := reader.Get(ctx, client.ObjectKeyFromObject(sd), &current); err != nil {
+		// Deleted meanwhile: the next reconcile cleans up, on the owner of the shard of its namespace
+		return false, client.IgnoreNotFound(err)
+	}
+	return shardOf(current.Namespace, current.Labels, m.cfg.Shards) == shard && m.holds(shard), nil
+}
+
+// int32Value is a flag.Value for int32 fields
+type int32Value struct{ p *int32 }
+
+func (v int32Value) String() string {
+	if v.p == nil {
+		return "0"
+	}
+	return strconv.FormatInt(int64(*v.p), 10)
+}
+
+func (v int32Value) Set(s string) error {
+	n, err := strconv.ParseInt(s, 10, 32)
+	if err != nil {
+		return err
+	}
+	*v.p = int32(n)
+	return nil
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	apiv1 "github.com/jayantasamaddar/quick-reference-kubernetes/solutions/hello-crd-scaling/api/v1"
+
+	appsv1 "k8s.io/api/apps/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+const testShards = 4
+
+// newTestShardManager returns a shardManager of the replica `identity`, sharing the Leases of `kube`.
+func newTestShardManager(identity string, kube kubernetes.Interface) *shardManager {
+	return &shardManager{
+		cfg: shardingConfig{
+			Enabled:       true,
+			Shards:        testShards,
+			LeaseDuration: metav1.Duration{Duration: 30 * time.Second},
+			RenewPeriod:   metav1.Duration{Duration: 10 * time.Second},
+		},
+		namespace: "ops",
+		identity:  identity,
+		leases:    kube,
+		reader:    fake.NewClientBuilder().WithScheme(scheme).Build(), // nothing to requeue
+		events:    make(chan event.GenericEvent),
+		setEvents: make(chan event.GenericEvent),
+		held:      map[int32]time.Time{},
+		inFlight:  map[int32]int{},
+	}
+}
+
+// shardHolders returns the holder of every shard Lease, "" if released.
+func shardHolders(t *testing.T, kube kubernetes.Interface) map[int32]string {
+	t.Helper()
+	holders := map[int32]string{}
+	for shard := int32(0); shard < testShards; shard++ {
+		lease, err := kube.CoordinationV1().Leases("ops").Get(context.Background(), fmt.Sprintf("%s%d", shardLeasePrefix, shard), metav1.GetOptions{})
+		if err != nil && !k8serrors.IsNotFound(err) {
+			t.Fatal(err)
+		}
+		if err == nil {
+			holders[shard] = ptr.Deref(lease.Spec.HolderIdentity, "")
+		}
+	}
+	return holders
+}
+
+// checkOwners fails unless every shard is owned by the replica in `want` ("" for none), both by the Lease and in memory.
+func checkOwners(t *testing.T, kube kubernetes.Interface, want map[int32]string, managers ...*shardManager) {
+	t.Helper()
+	holders := shardHolders(t, kube)
+	for shard := int32(0); shard < testShards; shard++ {
+		if holders[shard] != want[shard] {
+			t.Errorf("shard %d: Lease held by %q, want %q", shard, holders[shard], want[shard])
+		}
+		for _, m := range managers {
+			if holds := m.holds(shard); holds != (want[shard] == m.identity) {
+				t.Errorf("shard %d: %s holds it: %t, want %t", shard, m.identity, holds, !holds)
+			}
+		}
+	}
+}
+
+func TestShardOf(t *testing.T) {
+	hashed := shardOf("team-a", nil, testShards)
+	for _, tt := range []struct {
+		name   string
+		labels map[string]string
+		want   int32
+	}{
+		{name: "no label", want: hashed},
+		{name: "label", labels: map[string]string{apiv1.ShardLabel: "3"}, want: 3},
+		{name: "label out of range", labels: map[string]string{apiv1.ShardLabel: "4"}, want: hashed},
+		{name: "negative label", labels: map[string]string{apiv1.ShardLabel: "-1"}, want: hashed},
+		{name: "invalid label", labels: map[string]string{apiv1.ShardLabel: "one"}, want: hashed},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shardOf("team-a", tt.labels, testShards); got != tt.want {
+				t.Errorf("got shard %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestShardHandover adds a second replica: the first one hands over the shards assigned to the new one, except the one
+// it is still reconciling, which follows once that reconcile is done.
+func TestShardHandover(t *testing.T) {
+	ctx := context.Background()
+	kube := kubefake.NewClientset()
+	a, b := newTestShardManager("a", kube), newTestShardManager("b", kube)
+	sync := func(m *shardManager) {
+		t.Helper()
+		if err := m.sync(ctx); err != nil {
+			t.Fatalf("sync %s: %v", m.identity, err)
+		}
+	}
+
+	sync(a)
+	checkOwners(t, kube, map[int32]string{0: "a", 1: "a", 2: "a", 3: "a"}, a, b)
+
+	// Sorted members a, b: shards 1 and 3 go to b, which waits for a to release them
+	sync(b)
+	checkOwners(t, kube, map[int32]string{0: "a", 1: "a", 2: "a", 3: "a"}, a, b)
+
+	if !a.begin(3) {
+		t.Fatal("a can't begin a reconcile in shard 3")
+	}
+	sync(a)
+	checkOwners(t, kube, map[int32]string{0: "a", 1: "", 2: "a", 3: "a"}, a, b)
+	if b.begin(1) {
+		t.Error("b began a reconcile in shard 1 before acquiring it")
+	}
+	sync(b)
+	checkOwners(t, kube, map[int32]string{0: "a", 1: "b", 2: "a", 3: "a"}, a, b)
+
+	// Once the reconcile in flight is done
+	a.done(3)
+	sync(a)
+	sync(b)
+	checkOwners(t, kube, map[int32]string{0: "a", 1: "b", 2: "a", 3: "b"}, a, b)
+	if a.begin(3) {
+		t.Error("a began a reconcile in shard 3 after handing it over")
+	}
+	if !b.begin(3) {
+		t.Error("b can't begin a reconcile in shard 3")
+	}
+	b.done(3)
+}
+
+func TestShardLeaseExpiry(t *testing.T) {
+	ctx := context.Background()
+	kube := kubefake.NewClientset()
+	a, b := newTestShardManager("a", kube), newTestShardManager("b", kube)
+	if err := a.sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// a stops renewing: it gives its shards up itself after two thirds of the lease duration...
+	for shard := range a.held {
+		a.held[shard] = time.Now().Add(-25 * time.Second)
+	}
+	a.expire()
+	if held := a.snapshot(); len(held) != 0 {
+		t.Errorf("a still holds shards %v after failing to renew them", held)
+	}
+
+	// ...and b takes them over once the Leases (and a's member Lease) expired
+	if err := b.sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if held := b.snapshot(); len(held) != 0 {
+		t.Errorf("b acquired shards %v while a's Leases are still valid", held)
+	}
+	leases, err := kube.CoordinationV1().Leases("ops").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range leases.Items {
+		lease := &leases.Items[i]
+		if ptr.Deref(lease.Spec.HolderIdentity, "") != "a" {
+			continue
+		}
+		lease.Spec.RenewTime = &metav1.MicroTime{Time: time.Now().Add(-time.Minute)}
+		if _, err := kube.CoordinationV1().Leases("ops").Update(ctx, lease, metav1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkOwners(t, kube, map[int32]string{0: "b", 1: "b", 2: "b", 3: "b"}, a, b)
+}
+
+func TestShardStopping(t *testing.T) {
+	m := newTestShardManager("a", kubefake.NewClientset())
+	m.held[0] = time.Now()
+	if !m.begin(0) {
+		t.Fatal("can't begin a reconcile in a held shard")
+	}
+	if m.idle() {
+		t.Error("idle with a reconcile in flight")
+	}
+	if m.drop(0) {
+		t.Error("dropped a shard with a reconcile in flight")
+	}
+
+	m.mu.Lock()
+	m.stopping = true
+	m.mu.Unlock()
+	if m.begin(0) {
+		t.Error("began a reconcile while stopping")
+	}
+	m.done(0)
+	if !m.idle() {
+		t.Error("not idle once the reconcile is done")
+	}
+	if !m.drop(0) || m.holds(0) {
+		t.Error("shard not dropped once idle")
+	}
+}
+
+// TestShardLabelChangedMidReconcile reconciles a ServiceDeployment whose shard label changed after the cache was read:
+// the replica owning the former shard must leave the children to the owner of the new one.
+func TestShardLabelChangedMidReconcile(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range []struct {
+		name      string
+		label     string // on the API server
+		wantOwned bool
+	}{
+		{name: "unchanged", label: "1", wantOwned: true},
+		{name: "moved", label: "2"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			sd := newTestServiceDeployment("team-a", "web")
+			sd.Labels = map[string]string{apiv1.ShardLabel: tt.label}
+			// The cache still has the ServiceDeployment in shard 1
+			stale := interceptor.Funcs{Get: func(ctx context.Context, c client.WithWatch, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+				if err := c.Get(ctx, key, obj, opts...); err != nil {
+					return err
+				}
+				if sd, ok := obj.(*apiv1.ServiceDeployment); ok {
+					sd.Labels[apiv1.ShardLabel] = "1"
+				}
+				return nil
+			}}
+			env := newTestEnv(t, stale, sd)
+			env.r.shards = newTestShardManager("a", kubefake.NewClientset())
+			env.r.shards.held[1] = time.Now()
+
+			if _, err := env.reconcile(t, sd); err != nil {
+				t.Fatalf("reconcile: %v", err)
+			}
+			err := env.client.Get(ctx, client.ObjectKeyFromObject(sd), &appsv1.Deployment{})
+			if owned := err == nil; owned != tt.wantOwned {
+				t.Errorf("Deployment written: got %t, want %t (%v)", owned, tt.wantOwned, err)
+			}
+			if !env.r.shards.idle() {
+				t.Error("reconcile still counted in flight")
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// Tracing exports a trace per reconcile: a root span for the Reconcile call, with child spans for the steps
+// that talk to the API server (and the client-go HTTP requests below them).
+type tracingConfig struct {
+	// otlp, stdout, file, or empty to disable tracing
+	Exporter string `json:"exporter,omitempty"`
+	// OTLP/HTTP endpoint, e.g. http://otel-collector:4318. Defaults to $OTEL_EXPORTER_OTLP_ENDPOINT.
+	Endpoint string `json:"endpoint,omitempty"`
+	// File the `file` exporter appends the spans to, one JSON document per span
+	File string `json:"file,omitempty"`
+	// Fraction of reconciles that are traced, between 0 and 1
+	SampleRatio float64 `json:"sampleRatio,omitempty"`
+}
+
+var tracer = otel.Tracer("github.com/jayantasamaddar/quick-reference-kubernetes/solutions/hello-crd-scaling")
+
+func (o *tracingConfig) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Exporter, "tracing-exporter", o.Exporter, "Trace exporter: otlp, stdout or file. Empty disables tracing.")
+	fs.StringVar(&o.Endpoint, "tracing-endpoint", o.Endpoint, "OTLP/HTTP endpoint. Defaults to $OTEL_EXPORTER_OTLP_ENDPOINT.")
+	fs.StringVar(&o.File, "tracing-file", o.File, "File the `file` trace exporter appends to.")
+	fs.Float64Var(&o.SampleRatio, "tracing-sample-ratio", o.SampleRatio, "Fraction of reconciles that are traced, between 0 and 1.")
+}
+
+func (o *tracingConfig) validate() error {
+	var errs []error
+	switch o.Exporter {
+	case "", "otlp", "stdout":
+	case "file":
+		if o.File == "" {
+			errs = append(errs, errors.New("  tracing.file: must be set with the file exporter"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("  tracing.exporter: %q: must be otlp, stdout, file or empty", o.Exporter))
+	}
+	if o.SampleRatio < 0 || o.SampleRatio > 1 {
+		errs = append(errs, fmt.Errorf("  tracing.sampleRatio: must be between 0 and 1, got %v", o.SampleRatio))
+	}
+	return errors.Join(errs...)
+}
+
+// setup installs the global TracerProvider and instruments the HTTP transport of `config`, so it has to run
+// before any client is built from it. The returned function flushes the pending spans.
+func (o *tracingConfig) setup(ctx context.Context, config *rest.Config) (func(context.Context) error, error) {
+	if o.Exporter == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var exporter sdktrace.SpanExporter
+	var closeFile func() error
+	switch o.Exporter {
+	case "otlp":
+		var opts []otlptracehttp.Option
+		if o.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(o.Endpoint))
+		}
+		exp, err := otlptracehttp.New(ctx, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("otlp exporter: %w", err)
+		}
+		exporter = exp
+	case "stdout":
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		if err != nil {
+			return nil, fmt.Errorf("stdout exporter: %w", err)
+		}
+		exporter = exp
+	case "file":
+		f, err := os.OpenFile(o.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("open trace file: %w", err)
+		}
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("file exporter: %w", err)
+		}
+		exporter, closeFile = exp, f.Close
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(o.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("servicedeployments-operator"))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	// Every request client-go sends (controller-runtime's client and the clientset) becomes a child span of the caller's
+	config.Wrap(func(rt http.RoundTripper) http.RoundTripper { return otelhttp.NewTransport(rt) })
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closeFile != nil {
+			err = errors.Join(err, closeFile())
+		}
+		return err
+	}, nil
+}
+
+// endSpan marks the span as failed if `err` is set, then ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// createOrUpdate is controllerutil.CreateOrUpdate in a span of its own, recording what it did.
+func createOrUpdate(ctx context.Context, c client.Client, kind string, obj client.Object, f controllerutil.MutateFn, attrs ...attribute.KeyValue) (controllerutil.OperationResult, error) {
+	ctx, span := tracer.Start(ctx, "CreateOrUpdate "+kind, trace.WithAttributes(attrs...))
+	result, err := controllerutil.CreateOrUpdate(ctx, c, obj, f)
+	span.SetAttributes(
+		attribute.String("k8s.object.name", obj.GetName()),
+		attribute.String("operation.result", string(result)),
+	)
+	endSpan(span, err)
+	return result, err
+}
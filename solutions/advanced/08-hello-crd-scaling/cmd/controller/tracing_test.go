@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans makes the operator's spans go to the returned in-memory recorder until the end of the test.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := tracer
+	tracer = provider.Tracer("test")
+	t.Cleanup(func() {
+		tracer = previous
+		_ = provider.Shutdown(t.Context())
+	})
+	return recorder
+}
+
+func spanAttributes(span sdktrace.ReadOnlySpan) map[string]string {
+	attrs := map[string]string{}
+	for _, kv := range span.Attributes() {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	return attrs
+}
+
+func TestReconcileSpans(t *testing.T) {
+	recorder := recordSpans(t)
+	sd := newTestServiceDeployment("team-a", "web")
+	env := newTestEnv(t, defaultContainers, sd)
+
+	if _, err := env.reconcile(t, sd); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	root, ok := spans["Reconcile ServiceDeployment"]
+	if !ok {
+		t.Fatalf("no root span, got %v", recorder.Ended())
+	}
+	if root.Parent().IsValid() {
+		t.Errorf("root span has parent %v, want none", root.Parent().SpanID())
+	}
+	wantRoot := map[string]string{
+		"k8s.namespace.name":           "team-a",
+		"servicedeployment.name":       "web",
+		"servicedeployment.generation": "1",
+		"requeue":                      "false",
+	}
+	if diff := cmp.Diff(wantRoot, spanAttributes(root)); diff != "" {
+		t.Errorf("root span attributes (-want +got):\n%s", diff)
+	}
+
+	for name, want := range map[string]map[string]string{
+		"Get ServiceDeployment":     {},
+		"CreateOrUpdate Deployment": {"k8s.object.name": "web", "operation.result": "created"},
+		"CreateOrUpdate Service":    {"k8s.object.name": "web-svc", "operation.result": "created"},
+		"Event DeploymentCreated":   {"event.type": "Normal"},
+		"Event ServiceCreated":      {"event.type": "Normal"},
+		"SyncStatus":                {},
+	} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("no %q span", name)
+			continue
+		}
+		if span.SpanContext().TraceID() != root.SpanContext().TraceID() || !span.Parent().IsValid() {
+			t.Errorf("%q span is not in the trace of the reconcile", name)
+		}
+		got := spanAttributes(span)
+		for key := range got {
+			if _, ok := want[key]; !ok {
+				delete(got, key) // only the listed ones are checked
+			}
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("%q span attributes (-want +got):\n%s", name, diff)
+		}
+	}
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"math/big"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+// The webhook server's TLS certificate is managed by the operator itself, so webhooks don't depend on cert-manager.
+//   - A CA and a serving certificate for the webhook Service are kept in a Secret shared by all replicas.
+//   - The leader renews the serving certificate `rotateBefore` it expires, and the CA once it can no longer cover
+//     a full serving certificate. The previous CA stays in the bundle until it expires, so clients holding the old
+//     bundle keep trusting the server. A new CA is only added to the bundle at first: the serving certificate is
+//     signed with it once the leader injected that bundle, so the API server never sees a certificate it can't verify.
+//   - The leader injects the CA bundle into the webhook configurations and the conversion webhooks of the CRDs,
+//     and puts it back if something (e.g. `kubectl apply`) resets it.
+//   - Every replica serves the certificate from the Secret, reloaded as soon as it changes.
+type webhookConfig struct {
+	Enabled bool `json:"enabled,omitempty"`
+	Port    int  `json:"port,omitempty"`
+	// Service in front of the webhook server; the certificate is issued for its DNS names
+	ServiceName string `json:"serviceName,omitempty"`
+	// Namespace of the Service and the Secret. Defaults to the operator's namespace when running in a cluster.
+	Namespace  string `json:"namespace,omitempty"`
+	SecretName string `json:"secretName,omitempty"`
+	// Objects the CA bundle is injected into. Those that don't exist are skipped.
+	ValidatingWebhookConfigurations []string `json:"validatingWebhookConfigurations,omitempty"`
+	MutatingWebhookConfigurations   []string `json:"mutatingWebhookConfigurations,omitempty"`
+	// CRDs with `spec.conversion.strategy: Webhook`
+	ConversionCRDs []string `json:"conversionCRDs,omitempty"`
+	// Lifetime of the serving certificate; the CA lives `caValidityFactor` times as long
+	CertValidity metav1.Duration `json:"certValidity,omitzero"`
+	// How long before expiry the serving certificate is renewed
+	RotateBefore metav1.Duration `json:"rotateBefore,omitzero"`
+}
+
+const (
+	caCertKey = "ca.crt" // the CA bundle, the current CA first
+	caKeyKey  = "ca.key"
+
+	caValidityFactor = 4
+
+	// How often the leader checks expiry and the injected bundles
+	webhookCertCheckInterval = time.Minute
+	// How often every replica looks for a new certificate in the Secret
+	webhookCertReloadInterval = 10 * time.Second
+)
+
+var crdGVR = schema.GroupVersionResource{Group: "apiextensions.k8s.io", Version: "v1", Resource: "customresourcedefinitions"}
+
+func (o *webhookConfig) bindFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&o.Enabled, "webhook", o.Enabled, "Serve webhooks, with a self-managed certificate.")
+	fs.IntVar(&o.Port, "webhook-port", o.Port, "Port the webhook server listens on.")
+	fs.StringVar(&o.ServiceName, "webhook-service", o.ServiceName, "Service in front of the webhook server, the certificate is issued for.")
+	fs.StringVar(&o.Namespace, "webhook-namespace", o.Namespace, "Namespace of the webhook Service and certificate Secret. Defaults to the operator's namespace when running in a cluster.")
+	fs.StringVar(&o.SecretName, "webhook-secret", o.SecretName, "Secret the webhook CA and certificate are kept in.")
+	fs.Var((*stringList)(&o.ValidatingWebhookConfigurations), "webhook-validating-configurations", "Comma-separated ValidatingWebhookConfigurations to inject the CA bundle into.")
+	fs.Var((*stringList)(&o.MutatingWebhookConfigurations), "webhook-mutating-configurations", "Comma-separated MutatingWebhookConfigurations to inject the CA bundle into.")
+	fs.Var((*stringList)(&o.ConversionCRDs), "webhook-conversion-crds", "Comma-separated CRDs whose conversion webhook gets the CA bundle.")
+	fs.DurationVar(&o.CertValidity.Duration, "webhook-cert-validity", o.CertValidity.Duration, "Lifetime of the webhook serving certificate.")
+	fs.DurationVar(&o.RotateBefore.Duration, "webhook-cert-rotate-before", o.RotateBefore.Duration, "How long before expiry the webhook serving certificate is renewed.")
+}
+
+func (o *webhookConfig) validate() error {
+	if !o.Enabled {
+		return nil
+	}
+	var errs []error
+	if o.Port < 1 || o.Port > 65535 {
+		errs = append(errs, fmt.Errorf("  webhook.port: must be between 1 and 65535, got %d", o.Port))
+	}
+	if o.ServiceName == "" {
+		errs = append(errs, errors.New("  webhook.serviceName: must not be empty"))
+	}
+	if o.SecretName == "" {
+		errs = append(errs, errors.New("  webhook.secretName: must not be empty"))
+	}
+	if o.RotateBefore.Duration <= 0 || o.RotateBefore.Duration >= o.CertValidity.Duration {
+		errs = append(errs, fmt.Errorf("  webhook.rotateBefore: must be positive and less than certValidity (%s), got %s", o.CertValidity.Duration, o.RotateBefore.Duration))
+	}
+	return errors.Join(errs...)
+}
+
+// webhookCerts issues, rotates and serves the webhook certificate.
+type webhookCerts struct {
+	cfg       webhookConfig
+	namespace string
+	kube      kubernetes.Interface
+	dynamic   dynamic.Interface // CRDs, without a dependency on their Go types
+
+	mu sync.RWMutex
+	// Served certificate and the resourceVersion of the Secret it was loaded from
+	cert    *tls.Certificate
+	version string
+	// CA bundle the leader last injected everywhere (see renew)
+	injected []byte
+}
+
+func newWebhookCerts(cfg webhookConfig, kube kubernetes.Interface, dyn dynamic.Interface) (*webhookCerts, error) {
+	namespace, err := operatorNamespace(cfg.Namespace, "webhook.namespace")
+	if err != nil {
+		return nil, err
+	}
+	return &webhookCerts{cfg: cfg, namespace: namespace, kube: kube, dynamic: dyn}, nil
+}
+
+// server returns the webhook server, serving the certificate from the Secret.
+func (c *webhookCerts) server() webhook.Server {
+	return webhook.NewServer(webhook.Options{
+		Port: c.cfg.Port,
+		TLSOpts: []func(*tls.Config){func(cfg *tls.Config) {
+			cfg.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				c.mu.RLock()
+				defer c.mu.RUnlock()
+				if c.cert == nil {
+					return nil, errors.New("webhook certificate not loaded yet")
+				}
+				return c.cert, nil
+			}
+		}},
+	})
+}
+
+// readyCheck passes once the certificate is loaded and the webhook server answers TLS handshakes with it.
+func (c *webhookCerts) readyCheck(server webhook.Server) healthz.Checker {
+	started := server.StartedChecker()
+	return func(req *http.Request) error {
+		c.mu.RLock()
+		loaded := c.cert != nil
+		c.mu.RUnlock()
+		if !loaded {
+			return errors.New("webhook certificate not loaded")
+		}
+		return started(req)
+	}
+}
+
+// dnsNames are the names the webhook Service is reached by.
+func (c *webhookCerts) dnsNames() []string {
+	svc, ns := c.cfg.ServiceName, c.namespace
+	return []string{svc, svc + "." + ns, svc + "." + ns + ".svc", svc + "." + ns + ".svc.cluster.local"}
+}
+
+// ensure returns the Secret, creating it if it doesn't exist yet. With `rotate` it also renews what is about to expire.
+// Replicas racing to create or renew it are sorted out by the API server: the losers get AlreadyExists or a conflict.
+func (c *webhookCerts) ensure(ctx context.Context, rotate bool) (*corev1.Secret, error) {
+	secrets := c.kube.CoreV1().Secrets(c.namespace)
+	secret, err := secrets.Get(ctx, c.cfg.SecretName, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		data, _, err := c.renew(nil, nil, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: c.cfg.SecretName, Namespace: c.namespace},
+			Type:       corev1.SecretTypeTLS,
+			Data:       data,
+		}
+		created, err := secrets.Create(ctx, secret, metav1.CreateOptions{})
+		if k8serrors.IsAlreadyExists(err) {
+			return secrets.Get(ctx, c.cfg.SecretName, metav1.GetOptions{})
+		}
+		if err == nil {
+			log.FromContext(ctx).Info("created webhook certificate", "secret", c.cfg.SecretName)
+		}
+		return created, err
+	}
+	if err != nil || !rotate {
+		return secret, err
+	}
+
+	c.mu.RLock()
+	injected := c.injected
+	c.mu.RUnlock()
+	data, changed, err := c.renew(secret.Data, injected, time.Now())
+	if err != nil || !changed {
+		return secret, err
+	}
+	secret.Data = data
+	updated, err := secrets.Update(ctx, secret, metav1.UpdateOptions{})
+	if err == nil {
+		log.FromContext(ctx).Info("renewed webhook certificate", "secret", c.cfg.SecretName)
+	}
+	return updated, err
+}
+
+// renew returns the Secret data with whatever is missing, invalid or about to expire issued anew.
+// A new CA goes into the bundle first, and the serving certificate is only signed with it once `injected` (the bundle
+// the webhook configurations and CRDs hold) is that bundle: until then the API server would reject the certificate.
+func (c *webhookCerts) renew(data map[string][]byte, injected []byte, now time.Time) (map[string][]byte, bool, error) {
+	validity, rotateBefore := c.cfg.CertValidity.Duration, c.cfg.RotateBefore.Duration
+
+	bundle := parseCerts(data[caCertKey])
+	caKey, _ := parseKey(data[caKeyKey])
+	var ca *x509.Certificate
+	if len(bundle) > 0 && caKey != nil && publicKeysEqual(bundle[0].PublicKey, caKey.Public()) {
+		ca = bundle[0]
+	}
+
+	caKeyPEM := data[caKeyKey]
+	// A serving certificate must never outlive its CA
+	if ca == nil || ca.NotAfter.Before(now.Add(validity+rotateBefore)) {
+		cert, key, err := issueCA(now, caValidityFactor*validity)
+		if err != nil {
+			return nil, false, err
+		}
+		if caKeyPEM, err = encodeKey(key); err != nil {
+			return nil, false, err
+		}
+		ca, caKey, bundle = cert, key, append([]*x509.Certificate{cert}, bundle...)
+	}
+	// Drop CAs that expired, nothing they signed is valid anymore
+	bundle = slices.DeleteFunc(bundle, func(cert *x509.Certificate) bool { return cert.NotAfter.Before(now) })
+	var bundlePEM []byte
+	for _, cert := range bundle {
+		bundlePEM = append(bundlePEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+
+	certPEM, keyPEM := data[corev1.TLSCertKey], data[corev1.TLSPrivateKeyKey]
+	signedBy := -1 // index in the bundle of the CA that signed the serving certificate
+	if serving, err := tls.X509KeyPair(certPEM, keyPEM); err == nil && serving.Leaf != nil {
+		for i, cert := range bundle {
+			if serving.Leaf.CheckSignatureFrom(cert) == nil {
+				signedBy = i
+				break
+			}
+		}
+		switch {
+		case signedBy < 0 || serving.Leaf.NotAfter.Before(now) || !slices.Equal(serving.Leaf.DNSNames, c.dnsNames()):
+			signedBy = -1 // can't be served as it is, there is nothing to keep
+		case signedBy > 0 || serving.Leaf.NotAfter.Before(now.Add(rotateBefore)):
+			// Still valid: renewed with the current CA once the API server trusts it
+			if signedBy == 0 || bytes.Equal(injected, bundlePEM) {
+				signedBy = -1
+			}
+		}
+	}
+	if signedBy < 0 {
+		var err error
+		if certPEM, keyPEM, err = issueServingCert(now, validity, ca, caKey, c.dnsNames()); err != nil {
+			return nil, false, err
+		}
+	}
+
+	renewed := map[string][]byte{
+		caCertKey:               bundlePEM,
+		caKeyKey:                caKeyPEM,
+		corev1.TLSCertKey:       certPEM,
+		corev1.TLSPrivateKeyKey: keyPEM,
+	}
+	return renewed, !maps.EqualFunc(data, renewed, bytes.Equal), nil
+}
+
+// load makes the certificate in `secret` the one served, if it changed.
+func (c *webhookCerts) load(secret *corev1.Secret) error {
+	c.mu.RLock()
+	current := c.cert != nil && c.version == secret.ResourceVersion
+	c.mu.RUnlock()
+	if current {
+		return nil
+	}
+	cert, err := tls.X509KeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		return fmt.Errorf("parse webhook certificate: %w", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert, c.version = &cert, secret.ResourceVersion
+	return nil
+}
+
+// inject sets `bundle` as the CA bundle of every configured webhook configuration and conversion webhook.
+func (c *webhookCerts) inject(ctx context.Context, bundle []byte) error {
+	var errs []error
+	admission := c.kube.AdmissionregistrationV1()
+	for _, name := range c.cfg.ValidatingWebhookConfigurations {
+		cfg, err := admission.ValidatingWebhookConfigurations().Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			errs = append(errs, ignoreMissing(ctx, err, "ValidatingWebhookConfiguration", name))
+			continue
+		}
+		changed := false
+		for i := range cfg.Webhooks {
+			if !bytes.Equal(cfg.Webhooks[i].ClientConfig.CABundle, bundle) {
+				cfg.Webhooks[i].ClientConfig.CABundle, changed = bundle, true
+			}
+		}
+		if changed {
+			_, err = admission.ValidatingWebhookConfigurations().Update(ctx, cfg, metav1.UpdateOptions{})
+			errs = append(errs, err)
+		}
+	}
+	for _, name := range c.cfg.MutatingWebhookConfigurations {
+		cfg, err := admission.MutatingWebhookConfigurations().Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			errs = append(errs, ignoreMissing(ctx, err, "MutatingWebhookConfiguration", name))
+			continue
+		}
+		changed := false
+		for i := range cfg.Webhooks {
+			if !bytes.Equal(cfg.Webhooks[i].ClientConfig.CABundle, bundle) {
+				cfg.Webhooks[i].ClientConfig.CABundle, changed = bundle, true
+			}
+		}
+		if changed {
+			_, err = admission.MutatingWebhookConfigurations().Update(ctx, cfg, metav1.UpdateOptions{})
+			errs = append(errs, err)
+		}
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(bundle)
+	for _, name := range c.cfg.ConversionCRDs {
+		crd, err := c.dynamic.Resource(crdGVR).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			errs = append(errs, ignoreMissing(ctx, err, "CustomResourceDefinition", name))
+			continue
+		}
+		strategy, _, _ := unstructured.NestedString(crd.Object, "spec", "conversion", "strategy")
+		current, _, _ := unstructured.NestedString(crd.Object, "spec", "conversion", "webhook", "clientConfig", "caBundle")
+		if strategy != "Webhook" || current == encoded {
+			continue
+		}
+		patch := fmt.Appendf(nil, `{"spec":{"conversion":{"webhook":{"clientConfig":{"caBundle":%q}}}}}`, encoded)
+		_, err = c.dynamic.Resource(crdGVR).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// ignoreMissing skips webhook configurations and CRDs that aren't installed.
+func ignoreMissing(ctx context.Context, err error, kind, name string) error {
+	if k8serrors.IsNotFound(err) {
+		log.FromContext(ctx).V(1).Info("not injecting the webhook CA bundle, object not found", "kind", kind, "name", name)
+		return nil
+	}
+	return fmt.Errorf("%s %s: %w", kind, name, err)
+}
+
+// rotator renews the certificate and injects the CA bundle. With leader election it only runs on the leader.
+type webhookCertRotator struct{ *webhookCerts }
+
+func (r webhookCertRotator) NeedLeaderElection() bool { return true }
+
+func (r webhookCertRotator) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("webhook-certs")
+	ctx = log.IntoContext(ctx, logger)
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		secret, err := r.ensure(ctx, true)
+		if err == nil {
+			err = errors.Join(r.load(secret), r.inject(ctx, secret.Data[caCertKey]))
+		}
+		if err == nil {
+			r.mu.Lock()
+			r.injected = secret.Data[caCertKey]
+			r.mu.Unlock()
+		}
+		if err != nil {
+			logger.Error(err, "failed to manage webhook certificate")
+		}
+	}, webhookCertCheckInterval)
+	return nil
+}
+
+// reloader serves the latest certificate from the Secret on every replica.
+// If the Secret doesn't exist yet it creates it, so the server has a certificate before a leader is elected.
+type webhookCertReloader struct{ *webhookCerts }
+
+func (r webhookCertReloader) NeedLeaderElection() bool { return false }
+
+func (r webhookCertReloader) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("webhook-certs")
+	ctx = log.IntoContext(ctx, logger)
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		secret, err := r.ensure(ctx, false)
+		if err == nil {
+			err = r.load(secret)
+		}
+		if err != nil {
+			logger.Error(err, "failed to load webhook certificate")
+		}
+	}, webhookCertReloadInterval)
+	return nil
+}
+
+func issueCA(now time.Time, validity time.Duration) (*x509.Certificate, crypto.Signer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber(),
+		Subject:               pkix.Name{CommonName: "servicedeployments-operator-webhook-ca"},
+		NotBefore:             now.Add(-time.Hour), // clock skew
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("issue webhook CA: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	return cert, key, err
+}
+
+func issueServingCert(now time.Time, validity time.Duration, ca *x509.Certificate, caKey crypto.Signer, dnsNames []string) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serialNumber(),
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("issue webhook serving certificate: %w", err)
+	}
+	keyPEM, err = encodeKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), keyPEM, nil
+}
+
+func serialNumber() *big.Int {
+	n, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return n
+}
+
+func encodeKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+func parseKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("not a signing key")
+	}
+	return signer, nil
+}
+
+// parseCerts returns the certificates in `data`, skipping anything it can't parse.
+func parseCerts(data []byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs
+		}
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			certs = append(certs, cert)
+		}
+	}
+}
+
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	k, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && k.Equal(b)
+}
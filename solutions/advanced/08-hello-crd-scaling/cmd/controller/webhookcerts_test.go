@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"slices"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var certsEpoch = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func newTestWebhookCerts(serviceName string) *webhookCerts {
+	return &webhookCerts{
+		cfg: webhookConfig{
+			ServiceName:  serviceName,
+			CertValidity: metav1.Duration{Duration: 24 * time.Hour}, // the CA lives 96h, and is renewed from 66h on
+			RotateBefore: metav1.Duration{Duration: 6 * time.Hour},
+		},
+		namespace: "ops",
+	}
+}
+
+// renewedAt returns the Secret data after the rotator ran at each of `hours` after certsEpoch, injecting the bundle
+// every time, as the leader does.
+func renewedAt(t *testing.T, c *webhookCerts, hours ...int) map[string][]byte {
+	t.Helper()
+	var data map[string][]byte
+	for _, h := range hours {
+		renewed, _, err := c.renew(data, data[caCertKey], certsEpoch.Add(time.Duration(h)*time.Hour))
+		if err != nil {
+			t.Fatalf("renew at %dh: %v", h, err)
+		}
+		data = renewed
+	}
+	return data
+}
+
+func TestRenewWebhookCerts(t *testing.T) {
+	c := newTestWebhookCerts("webhook")
+	tests := []struct {
+		name     string
+		data     map[string][]byte
+		injected func(data map[string][]byte) []byte // defaults to the bundle of `data`
+		now      int                                 // hours after certsEpoch
+
+		wantChanged   bool
+		wantNewCA     bool // a CA was added to the bundle
+		wantNewServed bool // the serving certificate was issued anew
+		wantBundle    int
+		wantSignedBy  int // index in the bundle of the CA of the serving certificate
+	}{
+		{
+			name:        "fresh secret",
+			now:         0,
+			wantChanged: true, wantNewCA: true, wantNewServed: true, wantBundle: 1,
+		},
+		{
+			name:       "up to date",
+			data:       renewedAt(t, c, 0),
+			now:        1,
+			wantBundle: 1,
+		},
+		{
+			name:        "serving certificate nearly expired",
+			data:        renewedAt(t, c, 0),
+			now:         19,
+			wantChanged: true, wantNewServed: true, wantBundle: 1,
+		},
+		{
+			name:        "serving certificate expired",
+			data:        renewedAt(t, c, 0),
+			now:         25,
+			wantChanged: true, wantNewServed: true, wantBundle: 1,
+		},
+		{
+			name:        "DNS names changed",
+			data:        renewedAt(t, newTestWebhookCerts("old-webhook"), 0),
+			now:         1,
+			wantChanged: true, wantNewServed: true, wantBundle: 1,
+		},
+		{
+			name:        "CA nearly expired: new CA added, serving certificate kept",
+			data:        renewedAt(t, c, 0, 20, 40, 60),
+			now:         67,
+			wantChanged: true, wantNewCA: true, wantBundle: 2, wantSignedBy: 1,
+		},
+		{
+			name:         "new CA not injected yet: serving certificate kept",
+			data:         renewedAt(t, c, 0, 20, 40, 60, 67),
+			injected:     func(map[string][]byte) []byte { return renewedAt(t, c, 0, 20, 40, 60)[caCertKey] },
+			now:          68,
+			wantBundle:   2,
+			wantSignedBy: 1,
+		},
+		{
+			name:        "new CA injected: serving certificate signed with it",
+			data:        renewedAt(t, c, 0, 20, 40, 60, 67),
+			now:         68,
+			wantChanged: true, wantNewServed: true, wantBundle: 2,
+		},
+		{
+			name:        "new CA not injected, serving certificate with other DNS names: issued with the new CA anyway",
+			data:        renewedAt(t, newTestWebhookCerts("old-webhook"), 0, 20, 40, 60, 67),
+			injected:    func(map[string][]byte) []byte { return nil },
+			now:         68,
+			wantChanged: true, wantNewServed: true, wantBundle: 2,
+		},
+		{
+			name:        "previous CA expired: dropped from the bundle",
+			data:        renewedAt(t, c, 0, 20, 40, 60, 67, 68, 87),
+			now:         97,
+			wantChanged: true, wantBundle: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			injected := tt.data[caCertKey]
+			if tt.injected != nil {
+				injected = tt.injected(tt.data)
+			}
+			now := certsEpoch.Add(time.Duration(tt.now) * time.Hour)
+			got, changed, err := c.renew(tt.data, injected, now)
+			if err != nil {
+				t.Fatalf("renew: %v", err)
+			}
+			if changed != tt.wantChanged {
+				t.Errorf("changed: got %t, want %t", changed, tt.wantChanged)
+			}
+
+			before, bundle := parseCerts(tt.data[caCertKey]), parseCerts(got[caCertKey])
+			if len(bundle) != tt.wantBundle {
+				t.Fatalf("CA bundle: got %d certificates, want %d", len(bundle), tt.wantBundle)
+			}
+			if newCA := len(before) == 0 || !bundle[0].Equal(before[0]); newCA != tt.wantNewCA {
+				t.Errorf("new CA: got %t, want %t", newCA, tt.wantNewCA)
+			}
+			if key, err := parseKey(got[caKeyKey]); err != nil || !publicKeysEqual(bundle[0].PublicKey, key.Public()) {
+				t.Errorf("ca.key is not the key of the first CA of the bundle (%v)", err)
+			}
+
+			newServed := !bytes.Equal(got[corev1.TLSCertKey], tt.data[corev1.TLSCertKey])
+			if newServed != tt.wantNewServed {
+				t.Errorf("new serving certificate: got %t, want %t", newServed, tt.wantNewServed)
+			}
+			serving, err := tls.X509KeyPair(got[corev1.TLSCertKey], got[corev1.TLSPrivateKeyKey])
+			if err != nil {
+				t.Fatalf("serving certificate: %v", err)
+			}
+			if err := serving.Leaf.CheckSignatureFrom(bundle[tt.wantSignedBy]); err != nil {
+				t.Errorf("serving certificate not signed by CA %d of the bundle: %v", tt.wantSignedBy, err)
+			}
+			if serving.Leaf.NotAfter.Before(now) || serving.Leaf.NotAfter.After(bundle[tt.wantSignedBy].NotAfter) {
+				t.Errorf("serving certificate valid until %s: want after %s, before its CA expires (%s)", serving.Leaf.NotAfter, now, bundle[tt.wantSignedBy].NotAfter)
+			}
+			if !slices.Equal(serving.Leaf.DNSNames, c.dnsNames()) {
+				t.Errorf("DNS names: got %v, want %v", serving.Leaf.DNSNames, c.dnsNames())
+			}
+		})
+	}
+}